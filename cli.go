@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"Didgen/config"
+	"Didgen/db"
+)
+
+// checkConfig validates the config file and prints the values the server would
+// run with, values set by CONFIG SET in configuration.db are applied and marked
+func checkConfig(args []string) int {
+	if _, err := loadConfig("check-config", args); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+
+	fileValues := make(map[string]string)
+	for _, f := range config.Schema {
+		fileValues[f.Key], _ = config.Current().Get(f.Key)
+	}
+	configDB := filepath.Join(config.Current().DataPath, "configuration.db")
+	if _, err := os.Stat(configDB); err == nil {
+		// read only, the server migrates configuration.db at its start
+		overrides, err := db.OpenConfig()
+		if err == nil {
+			defer overrides.Close()
+			err = overrides.UpdateConfig()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: values of %s not read: %v\n", configDB, err)
+		}
+	}
+
+	fmt.Printf("# %s\n", config.ConfigPath)
+	for _, f := range config.Schema {
+		if f.Type == config.TypeUsers {
+			fmt.Printf("%s: %d users # %s\n", f.Key, len(config.Current().Users), config.Source(f.Key))
+			continue
+		}
+		if f.Type == config.TypeSecret {
+			fmt.Printf("%s: %d characters # %s\n", f.Key, len(config.Current().ClusterSecret), config.Source(f.Key))
+			continue
+		}
+		value, _ := config.Current().Get(f.Key)
+		if f.Type == config.TypeKeys {
+			fmt.Printf("%s: %d keys # %s\n", f.Key, len(config.Current().Keys), config.Source(f.Key))
+			continue
+		}
+		if f.Type == config.TypeNodes {
+			compact := new(bytes.Buffer)
+			json.Compact(compact, []byte(value))
+			value = compact.String()
+		}
+		if config.Source(f.Key) == "db" {
+			fmt.Printf("%s: %s # configuration.db, instead of %s\n", f.Key, value, fileValues[f.Key])
+		} else {
+			fmt.Printf("%s: %s # %s\n", f.Key, value, config.Source(f.Key))
+		}
+	}
+
+	errs := make([]string, 0)
+	for _, dir := range []string{config.Current().LogPath, config.Current().DataPath} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Sprintf("directory %s does not exist", dir))
+		}
+	}
+	for _, file := range []string{config.Current().TLSCertFile, config.Current().TLSKeyFile, config.Current().TLSCACertFile} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			errs = append(errs, fmt.Sprintf("tls file %s does not exist", file))
+		}
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "error: %s\n", e)
+		}
+		return 1
+	}
+	fmt.Println("# configuration OK")
+	return 0
+}
+
+// keys manages the keys of data.db while no server runs on the data path
+func keys(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	sub := args[0]
+	flags, err := loadConfig("keys "+sub, args[1:])
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+	argc := map[string]int{"list": 0, "get": 1, "set": 2, "del": 1}
+	if n, ok := argc[sub]; !ok || flags.NArg() != n {
+		usage()
+		return 2
+	}
+
+	if err = db.LockDataDir(false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.UnlockDataDir()
+	db.InitData()
+	defer db.DATA.Close()
+	if err = db.DATA.CreateKeysRecordTable(false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err = runKeys(sub, flags.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func runKeys(sub string, args []string) error {
+	switch sub {
+	case "list":
+		keys, err := db.DATA.GetKeysFromRecordTable()
+		if err != nil {
+			return err
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			id, err := db.DATA.GetKey(key)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%d\n", key, id)
+		}
+	case "get":
+		if _, err := db.DATA.GetKeyFromRecordTable(args[0]); err == sql.ErrNoRows {
+			return fmt.Errorf("key '%s' does not exist", args[0])
+		}
+		id, err := db.DATA.GetKey(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+	case "set":
+		value, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("value %s is not an integer", args[1])
+		}
+		idgen, err := db.NewIdGenerator(args[0])
+		if err != nil {
+			return err
+		}
+		if err = db.DATA.AddKeyToRecordTable(args[0]); err != nil {
+			return err
+		}
+		if err = idgen.Reset(value, false); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+	case "del":
+		if _, err := db.DATA.GetKeyFromRecordTable(args[0]); err == sql.ErrNoRows {
+			return fmt.Errorf("key '%s' does not exist", args[0])
+		}
+		idgen, err := db.NewIdGenerator(args[0])
+		if err != nil {
+			return err
+		}
+		if err = idgen.Delete(); err != nil {
+			return err
+		}
+		if err = db.DATA.DeleteKeyFromRecordTable(args[0]); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+	}
+	return nil
+}
+
+// configHistory lists or rolls back the config changes kept in configuration.db,
+// a rollback is applied by the server at its next start or SIGHUP
+func configHistory(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	sub := args[0]
+	flags, err := loadConfig("config "+sub, args[1:])
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+	argc := map[string][]int{"history": {0, 1}, "rollback": {1, 1}}
+	if n, ok := argc[sub]; !ok || flags.NArg() < n[0] || flags.NArg() > n[1] {
+		usage()
+		return 2
+	}
+	configDB := filepath.Join(config.Current().DataPath, "configuration.db")
+	if _, err = os.Stat(configDB); err != nil {
+		fmt.Fprintf(os.Stderr, "%s does not exist\n", configDB)
+		return 1
+	}
+	db.InitConfig()
+	defer db.CONFIG.Close()
+
+	if err = runConfigHistory(sub, flags.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func runConfigHistory(sub string, args []string) error {
+	switch sub {
+	case "history":
+		count := int64(10)
+		if len(args) > 0 {
+			var err error
+			if count, err = strconv.ParseInt(args[0], 10, 64); err != nil || count < 1 {
+				return fmt.Errorf("count %s is not a positive integer", args[0])
+			}
+		}
+		changes, err := db.CONFIG.History(count)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s: %s -> %s\n", c.Revision, c.Time.Format("2006-01-02 15:04:05"), c.Action, c.Client, c.Key, c.Old, c.New)
+		}
+	case "rollback":
+		revision, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("revision %s is not an integer", args[0])
+		}
+		values, err := db.CONFIG.RollbackValues(revision)
+		if err != nil {
+			return err
+		}
+		changes := make([]db.ConfigChange, 0, len(values))
+		for _, f := range config.Schema {
+			value, ok := values[f.Key]
+			if !ok {
+				continue
+			}
+			if value, err = f.Validate(value); err != nil {
+				return fmt.Errorf("%s: %v", f.Key, err)
+			}
+			oldValue, _ := config.Current().Get(f.Key)
+			if oldValue == value {
+				continue
+			}
+			changes = append(changes, db.ConfigChange{Key: f.Key, Old: oldValue, New: value})
+		}
+		if len(changes) == 0 {
+			fmt.Println("nothing to roll back, the values are the same")
+			return nil
+		}
+		newRevision, err := db.CONFIG.Commit(fmt.Sprintf("rollback to %d", revision), fmt.Sprintf("cli@%d", os.Getpid()), changes)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			fmt.Printf("%s: %s -> %s\n", c.Key, c.Old, c.New)
+		}
+		fmt.Printf("revision %d, applied by the server at its next start or SIGHUP\n", newRevision)
+	}
+	return nil
+}
+
+// plan prints what reconciling the keys section would do to data.db, it only
+// reads, a running server is fine
+func plan(args []string) int {
+	if _, err := loadConfig("plan", args); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+	current := make(map[string]int64)
+	dataDB := filepath.Join(config.Current().DataPath, "data.db")
+	if _, err := os.Stat(dataDB); err == nil {
+		db.InitData()
+		defer db.DATA.Close()
+		var err error
+		if current, err = db.DATA.KeyValues(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, change := range db.PlanKeys(config.Current().KeySpecs(), current) {
+		counts[change.Action]++
+		switch change.Action {
+		case db.KeyCreate:
+			fmt.Printf("+ %s: create, last id %d\n", change.Key, change.To)
+		case db.KeyAdvance:
+			fmt.Printf("~ %s: advance, last id from %d to %d\n", change.Key, change.From, change.To)
+		case db.KeyDrift:
+			fmt.Printf("! %s: drift, %s\n", change.Key, change.Reason)
+		default:
+			fmt.Printf("  %s: ok, last id %d\n", change.Key, change.From)
+		}
+	}
+	fmt.Printf("%d to create, %d to advance, %d drift, %d ok\n", counts[db.KeyCreate], counts[db.KeyAdvance], counts[db.KeyDrift], counts[db.KeyOk])
+	return 0
+}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Every connection on trans_port starts with a handshake in which both sides
+// prove they know cluster_secret, without sending it:
+//
+//	dialer -> listener: {node, nonce}          node is its host:trans_port
+//	listener -> dialer: {node, nonce, proof}
+//	dialer -> listener: {proof}
+//
+// The listener takes the connection only from the host of the nodes entry
+// the dialer names. Then every line is signed with a key of the connection
+// and its sequence number, so it can be neither forged nor replayed.
+const handshakeTimeout = 5 * time.Second
+
+type hello struct {
+	Node  string `json:"node,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+	Proof string `json:"proof,omitempty"`
+}
+
+// link is a connection after the handshake, writes are serialized by the
+// caller
+type link struct {
+	conn     net.Conn
+	scanner  *bufio.Scanner
+	writer   *bufio.Writer
+	key      []byte
+	send     string // direction of the lines written, in their signature
+	recv     string
+	sent     uint64
+	received uint64
+}
+
+func newLink(conn net.Conn) *link {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), MaxMessageSize+2*sha256.Size+1)
+	return &link{conn: conn, scanner: scanner, writer: bufio.NewWriter(conn)}
+}
+
+func (l *link) writeHello(h *hello) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if _, err = l.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.writer.Flush()
+}
+
+func (l *link) readHello() (*hello, error) {
+	line, err := l.scan()
+	if err != nil {
+		return nil, err
+	}
+	h := new(hello)
+	if err = json.Unmarshal(line, h); err != nil {
+		return nil, fmt.Errorf("handshake: %v", err)
+	}
+	return h, nil
+}
+
+func (l *link) scan() ([]byte, error) {
+	if !l.scanner.Scan() {
+		if err := l.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return l.scanner.Bytes(), nil
+}
+
+// write sends one signed line
+func (l *link) write(data []byte) error {
+	l.sent++
+	mac := hex.EncodeToString(l.sign(l.send, l.sent, data))
+	if _, err := l.writer.WriteString(mac + " "); err != nil {
+		return err
+	}
+	if _, err := l.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.writer.Flush()
+}
+
+// read returns the next line, an error when its signature does not match
+func (l *link) read() ([]byte, error) {
+	line, err := l.scan()
+	if err != nil {
+		return nil, err
+	}
+	l.received++
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return nil, fmt.Errorf("message %d is not signed", l.received)
+	}
+	mac, err := hex.DecodeString(string(line[:i]))
+	if err != nil || !hmac.Equal(mac, l.sign(l.recv, l.received, line[i+1:])) {
+		return nil, fmt.Errorf("message %d has a wrong signature", l.received)
+	}
+	return line[i+1:], nil
+}
+
+func (l *link) sign(direction string, seq uint64, data []byte) []byte {
+	h := hmac.New(sha256.New, l.key)
+	fmt.Fprintf(h, "%s %d ", direction, seq)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func proof(secret []byte, parts ...string) string {
+	h := hmac.New(sha256.New, secret)
+	for _, part := range parts {
+		h.Write([]byte(part + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// dialHandshake authenticates the node dialed, the connection is closed by
+// the caller on an error
+func (t *Transport) dialHandshake(conn net.Conn) (*link, error) {
+	l := newLink(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	if err = l.writeHello(&hello{Node: t.self, Nonce: nonce}); err != nil {
+		return nil, err
+	}
+	reply, err := l.readHello()
+	if err != nil {
+		return nil, err
+	}
+	if reply.Nonce == "" || !hmac.Equal([]byte(reply.Proof), []byte(proof(t.secret, "listener", nonce, reply.Nonce, reply.Node))) {
+		return nil, fmt.Errorf("node %s failed the handshake, cluster_secret differs", conn.RemoteAddr())
+	}
+	if err = l.writeHello(&hello{Proof: proof(t.secret, "dialer", reply.Nonce, nonce, t.self)}); err != nil {
+		return nil, err
+	}
+	l.key = []byte(proof(t.secret, "key", nonce, reply.Nonce))
+	l.send, l.recv = "dialer", "listener"
+	return l, nil
+}
+
+// acceptHandshake authenticates the node which connected and returns its
+// entry in nodes, host:trans_port
+func (t *Transport) acceptHandshake(conn net.Conn) (*link, string, error) {
+	l := newLink(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	request, err := l.readHello()
+	if err != nil {
+		return nil, "", err
+	}
+	if request.Nonce == "" || !t.allowed(request.Node, conn.RemoteAddr()) {
+		return nil, "", fmt.Errorf("%s is not the node %s of nodes", conn.RemoteAddr(), request.Node)
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, "", err
+	}
+	if err = l.writeHello(&hello{Node: t.self, Nonce: nonce, Proof: proof(t.secret, "listener", request.Nonce, nonce, t.self)}); err != nil {
+		return nil, "", err
+	}
+	reply, err := l.readHello()
+	if err != nil {
+		return nil, "", err
+	}
+	if !hmac.Equal([]byte(reply.Proof), []byte(proof(t.secret, "dialer", nonce, request.Nonce, request.Node))) {
+		return nil, "", fmt.Errorf("node %s failed the handshake, cluster_secret differs", request.Node)
+	}
+	l.key = []byte(proof(t.secret, "key", request.Nonce, nonce))
+	l.send, l.recv = "listener", "dialer"
+	return l, request.Node, nil
+}
+
+// allowed tells whether remote is an address of the host of node, an entry
+// of nodes, any entry when node is empty
+func (t *Transport) allowed(node string, remote net.Addr) bool {
+	addr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, peer := range t.peers {
+		if node != "" && peer != node {
+			continue
+		}
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "Didgen/logger_seelog"
+)
+
+const (
+	StateUnknown = "unknown" // not heard from yet
+	StateAlive   = "alive"
+	StateSuspect = "suspect" // missed a heartbeat
+	StateDead    = "dead"    // silent for heartbeat_time_out
+
+	MessagePing = "ping"
+)
+
+// NodeInfo is what a node tells about itself in every heartbeat
+type NodeInfo struct {
+	Id         string `json:"id"`
+	ServerId   int    `json:"server_id"`
+	Host       string `json:"host"`
+	ServerPort string `json:"server_port"`
+	TransPort  string `json:"trans_port"`
+}
+
+// PeerConfig is an entry of nodes in configuration.yml
+type PeerConfig struct {
+	Host       string
+	ServerPort string
+	TransPort  string
+}
+
+// Config of a node, taken from configuration.yml by the server, it does not
+// read any global so several nodes can run in one process
+type Config struct {
+	ServerId   int
+	Host       string
+	ServerPort string
+	TransPort  string
+	Node       string // host:trans_port of the entry of this node in nodes
+	Secret     string // cluster_secret
+	Peers      []PeerConfig
+	Interval   time.Duration // heartbeat_time_interval
+	Timeout    time.Duration // heartbeat_time_out
+}
+
+// Peer is the membership state of another node
+type Peer struct {
+	Config   PeerConfig
+	Info     NodeInfo // known after the first heartbeat
+	State    string
+	PingSent time.Time // of the heartbeat waiting for its reply
+	PongRecv time.Time
+	Linked   bool
+}
+
+func (p *Peer) Addr() string {
+	return net.JoinHostPort(p.Config.Host, p.Config.TransPort)
+}
+
+// Cluster is the membership of this node, it heartbeats every peer on
+// trans_port and tracks whether they are alive
+type Cluster struct {
+	config    Config
+	self      NodeInfo
+	transport *Transport
+	peers     []*Peer
+	started   time.Time
+	done      chan struct{}
+
+	wait sync.WaitGroup
+	lock sync.RWMutex
+}
+
+// NodeID is the id of a node in CLUSTER NODES, stable across restarts
+func NodeID(serverId int, host, serverPort string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d %s:%s", serverId, host, serverPort)))
+	return hex.EncodeToString(sum[:])
+}
+
+func New(cfg Config) *Cluster {
+	c := &Cluster{
+		config: cfg,
+		self: NodeInfo{
+			Id:         NodeID(cfg.ServerId, cfg.Host, cfg.ServerPort),
+			ServerId:   cfg.ServerId,
+			Host:       cfg.Host,
+			ServerPort: cfg.ServerPort,
+			TransPort:  cfg.TransPort,
+		},
+		done: make(chan struct{}),
+	}
+	addrs := make([]string, 0, len(cfg.Peers))
+	for _, peer := range cfg.Peers {
+		p := &Peer{Config: peer, State: StateUnknown}
+		c.peers = append(c.peers, p)
+		addrs = append(addrs, p.Addr())
+	}
+	c.transport = NewTransport(cfg.Node, cfg.Secret, addrs)
+	c.transport.Handle(MessagePing, c.handlePing)
+	return c
+}
+
+func (c *Cluster) Self() NodeInfo {
+	return c.self
+}
+
+// Transport lets other subsystems exchange their own messages with the peers
+func (c *Cluster) Transport() *Transport {
+	return c.transport
+}
+
+// Start listens on trans_port and starts the heartbeats, while the port is
+// taken, by the process a restart hands over from, it keeps trying
+func (c *Cluster) Start() error {
+	c.started = time.Now()
+	addr := net.JoinHostPort(c.config.Host, c.config.TransPort)
+	err := c.transport.Listen(addr)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Cluster listen %s error: %v, retrying", addr, err))
+		c.wait.Add(1)
+		go c.listenLoop(addr)
+	} else {
+		log.Info(fmt.Sprintf("Cluster listening on %s, node id %s, %d peers", addr, c.self.Id, len(c.peers)))
+	}
+	c.wait.Add(1)
+	go c.heartbeatLoop()
+	return nil
+}
+
+func (c *Cluster) listenLoop(addr string) {
+	defer c.wait.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.transport.Listen(addr); err == nil {
+				log.Info(fmt.Sprintf("Cluster listening on %s, node id %s, %d peers", addr, c.self.Id, len(c.peers)))
+				return
+			}
+		}
+	}
+}
+
+func (c *Cluster) heartbeatLoop() {
+	defer c.wait.Done()
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	c.heartbeat()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.heartbeat()
+		}
+	}
+}
+
+// heartbeat pings every peer at once and waits for the replies, at most an
+// interval, then updates the states
+func (c *Cluster) heartbeat() {
+	var wait sync.WaitGroup
+	for _, peer := range c.peers {
+		wait.Add(1)
+		go func(peer *Peer) {
+			defer wait.Done()
+			c.ping(peer)
+		}(peer)
+	}
+	wait.Wait()
+	c.updateStates(time.Now())
+}
+
+func (c *Cluster) ping(peer *Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.Interval)
+	defer cancel()
+	c.lock.Lock()
+	if peer.PingSent.IsZero() {
+		peer.PingSent = time.Now()
+	}
+	c.lock.Unlock()
+
+	info := NodeInfo{}
+	err := c.transport.Call(ctx, peer.Addr(), MessagePing, c.self, &info)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	peer.Linked = c.transport.Connected(peer.Addr())
+	if err != nil {
+		log.Debug(fmt.Sprintf("Cluster ping %s error: %v", peer.Addr(), err))
+		return
+	}
+	peer.Info = info
+	peer.PingSent = time.Time{}
+	peer.PongRecv = time.Now()
+}
+
+func (c *Cluster) handlePing(from string, payload json.RawMessage) (interface{}, error) {
+	return c.self, nil
+}
+
+// updateStates derives the states from the last reply, a peer is suspect
+// after it missed a heartbeat and dead after heartbeat_time_out
+func (c *Cluster) updateStates(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, peer := range c.peers {
+		state := c.state(peer, now)
+		if state != peer.State {
+			log.Info(fmt.Sprintf("Cluster node %s %s -> %s", peer.Addr(), peer.State, state))
+			peer.State = state
+		}
+	}
+}
+
+func (c *Cluster) state(peer *Peer, now time.Time) string {
+	last := peer.PongRecv
+	if last.IsZero() {
+		if now.Sub(c.started) > c.config.Timeout {
+			return StateDead
+		}
+		return StateUnknown
+	}
+	switch silent := now.Sub(last); {
+	case silent > c.config.Timeout:
+		return StateDead
+	case silent > c.config.Interval+c.config.Interval/2:
+		return StateSuspect
+	}
+	return StateAlive
+}
+
+// Peers returns a copy of the membership
+func (c *Cluster) Peers() []Peer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	peers := make([]Peer, 0, len(c.peers))
+	for _, peer := range c.peers {
+		peers = append(peers, *peer)
+	}
+	return peers
+}
+
+func (c *Cluster) Close() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	close(c.done)
+	c.transport.Close()
+	c.wait.Wait()
+}
@@ -0,0 +1,156 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	testInterval = 50 * time.Millisecond
+	testTimeout  = 300 * time.Millisecond
+)
+
+// newTestCluster starts the nodes on loopback, all with the same nodes and
+// cluster_secret, except the secrets given
+func newTestCluster(t *testing.T, n int, secrets ...string) []*Cluster {
+	t.Helper()
+	peers := make([]PeerConfig, n)
+	for i := range peers {
+		host, port, _ := net.SplitHostPort(freeAddr(t))
+		peers[i] = PeerConfig{Host: host, ServerPort: "0", TransPort: port}
+	}
+	nodes := make([]*Cluster, n)
+	for i, self := range peers {
+		secret := "s3cret"
+		if i < len(secrets) {
+			secret = secrets[i]
+		}
+		others := make([]PeerConfig, 0, n-1)
+		others = append(others, peers[:i]...)
+		others = append(others, peers[i+1:]...)
+		nodes[i] = New(Config{
+			ServerId:   i + 1,
+			Host:       self.Host,
+			ServerPort: self.ServerPort,
+			TransPort:  self.TransPort,
+			Node:       net.JoinHostPort(self.Host, self.TransPort),
+			Secret:     secret,
+			Peers:      others,
+			Interval:   testInterval,
+			Timeout:    testTimeout,
+		})
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(nodes[i].Close)
+	}
+	return nodes
+}
+
+// peerState is the state c has of the node at addr
+func peerState(c *Cluster, addr string) string {
+	for _, peer := range c.Peers() {
+		if peer.Addr() == addr {
+			return peer.State
+		}
+	}
+	return ""
+}
+
+// waitStates waits until c had the states of addr in order, states in
+// between are allowed
+func waitStates(t *testing.T, c *Cluster, addr string, states ...string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	seen := make([]string, 0)
+	for len(states) > 0 && time.Now().Before(deadline) {
+		state := peerState(c, addr)
+		if len(seen) == 0 || seen[len(seen)-1] != state {
+			seen = append(seen, state)
+		}
+		if state == states[0] {
+			states = states[1:]
+			continue
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(states) > 0 {
+		t.Fatalf("node %s went %v, waiting for %v", addr, seen, states)
+	}
+}
+
+func transAddr(c *Cluster) string {
+	return net.JoinHostPort(c.self.Host, c.self.TransPort)
+}
+
+func TestMembership(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	for _, c := range nodes {
+		for _, other := range nodes {
+			if c != other {
+				waitStates(t, c, transAddr(other), StateAlive)
+			}
+		}
+	}
+	for _, peer := range nodes[0].Peers() {
+		if !peer.Linked {
+			t.Errorf("node %s is alive but not linked", peer.Addr())
+		}
+		want := nodes[1].Self()
+		if peer.Addr() == transAddr(nodes[2]) {
+			want = nodes[2].Self()
+		}
+		if peer.Info != want {
+			t.Errorf("node %s told %+v, want %+v", peer.Addr(), peer.Info, want)
+		}
+	}
+
+	// a node dropping out is suspect after a missed heartbeat, then dead
+	gone := transAddr(nodes[2])
+	nodes[2].Close()
+	waitStates(t, nodes[0], gone, StateSuspect, StateDead)
+	waitStates(t, nodes[1], gone, StateDead)
+	if state := peerState(nodes[0], transAddr(nodes[1])); state != StateAlive {
+		t.Errorf("node %s %s after another node dropped out", transAddr(nodes[1]), state)
+	}
+}
+
+func TestMembershipSecret(t *testing.T) {
+	nodes := newTestCluster(t, 2, "s3cret", "other")
+	// never heard from, a node is dead after heartbeat_time_out
+	waitStates(t, nodes[0], transAddr(nodes[1]), StateDead)
+	waitStates(t, nodes[1], transAddr(nodes[0]), StateDead)
+	for _, peer := range nodes[0].Peers() {
+		if !peer.PongRecv.IsZero() {
+			t.Errorf("node %s with another cluster_secret replied", peer.Addr())
+		}
+	}
+}
+
+func TestPeerState(t *testing.T) {
+	now := time.Now()
+	c := &Cluster{config: Config{Interval: time.Second, Timeout: 5 * time.Second}, started: now.Add(-2 * time.Second)}
+	cases := []struct {
+		started, pong time.Duration // ago, 0 for never
+		want          string
+	}{
+		{2 * time.Second, 0, StateUnknown},
+		{6 * time.Second, 0, StateDead},
+		{6 * time.Second, time.Second, StateAlive},
+		{6 * time.Second, 1500 * time.Millisecond, StateAlive},
+		{6 * time.Second, 1600 * time.Millisecond, StateSuspect},
+		{6 * time.Second, 5 * time.Second, StateSuspect},
+		{6 * time.Second, 5100 * time.Millisecond, StateDead},
+	}
+	for _, tc := range cases {
+		c.started = now.Add(-tc.started)
+		peer := &Peer{}
+		if tc.pong > 0 {
+			peer.PongRecv = now.Add(-tc.pong)
+		}
+		if got := c.state(peer, now); got != tc.want {
+			t.Errorf("started %v ago, reply %v ago: %s, want %s", tc.started, tc.pong, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SlotCount is the number of hash slots, the same as redis cluster so the
+// clients compute the slot of a key themselves
+const SlotCount = 16384
+
+// crc16 of redis cluster, CCITT XMODEM
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// KeySlot is the hash slot of a key, only the part between the first { and
+// the next } is hashed when it is not empty, so {user}.a and {user}.b share
+// a slot
+func KeySlot(key []byte) int {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % SlotCount)
+}
+
+// SlotRange is the slots from Start to End, both included
+type SlotRange struct {
+	Start int
+	End   int
+}
+
+func (r SlotRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// ParseSlots reads space separated slots and ranges, "0-5460 6000"
+func ParseSlots(spec string) ([]SlotRange, error) {
+	ranges := make([]SlotRange, 0)
+	for _, field := range strings.Fields(spec) {
+		bounds := strings.SplitN(field, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a slot", field)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("'%s' is not a slot range", field)
+			}
+		}
+		if start < 0 || end >= SlotCount || start > end {
+			return nil, fmt.Errorf("'%s' is not within 0-%d", field, SlotCount-1)
+		}
+		ranges = append(ranges, SlotRange{Start: start, End: end})
+	}
+	return ranges, nil
+}
+
+func FormatSlots(ranges []SlotRange) string {
+	fields := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		fields = append(fields, r.String())
+	}
+	return strings.Join(fields, " ")
+}
+
+// Slots is the owner of every slot, the host:server_port of a node, and the
+// epoch of its last move. A move is assigned the epoch after the highest
+// known, so when two maps differ on a slot the higher epoch wins.
+type Slots struct {
+	owners [SlotCount]string
+	epochs [SlotCount]uint64
+}
+
+// SlotOwner is a slot moved away from its configured node
+type SlotOwner struct {
+	Slot  int    `json:"slot"`
+	Node  string `json:"node"`
+	Epoch uint64 `json:"epoch"`
+}
+
+// NewSlots assigns the slots of the nodes with their own slots to them and
+// splits the others evenly between the nodes without, in the order given
+func NewSlots(nodes []string, specs map[string][]SlotRange) (*Slots, error) {
+	s := new(Slots)
+	for _, node := range nodes {
+		for _, r := range specs[node] {
+			for slot := r.Start; slot <= r.End; slot++ {
+				if s.owners[slot] != "" {
+					return nil, fmt.Errorf("slot %d is assigned to %s and %s", slot, s.owners[slot], node)
+				}
+				s.owners[slot] = node
+			}
+		}
+	}
+	free := make([]int, 0, SlotCount)
+	for slot := range s.owners {
+		if s.owners[slot] == "" {
+			free = append(free, slot)
+		}
+	}
+	rest := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if len(specs[node]) == 0 {
+			rest = append(rest, node)
+		}
+	}
+	if len(rest) == 0 {
+		if len(free) > 0 {
+			return nil, fmt.Errorf("%d slots are not assigned, %d first", len(free), free[0])
+		}
+		return s, nil
+	}
+	for i, slot := range free {
+		s.owners[slot] = rest[i*len(rest)/len(free)]
+	}
+	return s, nil
+}
+
+func (s *Slots) Owner(slot int) string {
+	return s.owners[slot]
+}
+
+// Of is the owner of a slot with the epoch it moved there in
+func (s *Slots) Of(slot int) SlotOwner {
+	return SlotOwner{Slot: slot, Node: s.owners[slot], Epoch: s.epochs[slot]}
+}
+
+// Epoch is the highest epoch of any slot, 0 while none moved
+func (s *Slots) Epoch() uint64 {
+	var epoch uint64
+	for _, e := range s.epochs {
+		if e > epoch {
+			epoch = e
+		}
+	}
+	return epoch
+}
+
+// Assign moves a slot unless it already moved in this or a later epoch,
+// false when it is ignored
+func (s *Slots) Assign(o SlotOwner) bool {
+	if o.Slot < 0 || o.Slot >= SlotCount || o.Epoch <= s.epochs[o.Slot] {
+		return false
+	}
+	s.owners[o.Slot] = o.Node
+	s.epochs[o.Slot] = o.Epoch
+	return true
+}
+
+// Moved lists the slots which moved, those a node tells the others
+func (s *Slots) Moved() []SlotOwner {
+	moved := make([]SlotOwner, 0)
+	for slot, epoch := range s.epochs {
+		if epoch > 0 {
+			moved = append(moved, SlotOwner{Slot: slot, Node: s.owners[slot], Epoch: epoch})
+		}
+	}
+	return moved
+}
+
+// Ranges lists the contiguous ranges of slots of a node
+func (s *Slots) Ranges(node string) []SlotRange {
+	ranges := make([]SlotRange, 0)
+	for slot := 0; slot < SlotCount; slot++ {
+		if s.owners[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].End == slot-1 {
+			ranges[n-1].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{Start: slot, End: slot})
+		}
+	}
+	return ranges
+}
+
+// Nodes lists the nodes owning a slot at least, sorted
+func (s *Slots) Nodes() []string {
+	seen := make(map[string]bool)
+	nodes := make([]string, 0)
+	for _, owner := range s.owners {
+		if owner != "" && !seen[owner] {
+			seen[owner] = true
+			nodes = append(nodes, owner)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
@@ -0,0 +1,386 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "Didgen/logger_seelog"
+)
+
+// MaxMessageSize bounds one message on trans_port
+const MaxMessageSize = 64 << 20
+
+// Message is one line of json on trans_port, a request or the reply to the
+// request of the same Id
+type Message struct {
+	Id      uint64          `json:"id"`
+	Type    string          `json:"type"`
+	Reply   bool            `json:"reply,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Handler serves a request of a type, from is the sender as authenticated by
+// the handshake, host:trans_port of its entry in nodes, the result is sent
+// back as the payload of the reply
+type Handler func(from string, payload json.RawMessage) (interface{}, error)
+
+// Transport sends requests to peers and serves theirs, one connection per
+// peer in each direction, every connection authenticated with the secret
+type Transport struct {
+	self     string   // host:trans_port in nodes
+	secret   []byte   // cluster_secret
+	peers    []string // host:trans_port of the other nodes, the only ones served
+	handlers map[string]Handler
+	listener net.Listener
+	conns    map[string]*peerConn // outgoing, by address
+	inbound  map[net.Conn]bool
+	nextId   uint64
+	closed   bool
+
+	wait sync.WaitGroup
+	lock sync.Mutex
+}
+
+type peerConn struct {
+	conn    net.Conn
+	link    *link
+	pending map[uint64]chan *Message
+	err     error
+
+	writeLock sync.Mutex
+	lock      sync.Mutex
+}
+
+func NewTransport(self, secret string, peers []string) *Transport {
+	return &Transport{
+		self:     self,
+		secret:   []byte(secret),
+		peers:    peers,
+		handlers: make(map[string]Handler),
+		conns:    make(map[string]*peerConn),
+		inbound:  make(map[net.Conn]bool),
+	}
+}
+
+// Handle registers the handler of a request type, before Listen
+func (t *Transport) Handle(typ string, handler Handler) {
+	t.lock.Lock()
+	t.handlers[typ] = handler
+	t.lock.Unlock()
+}
+
+func (t *Transport) Listen(addr string) error {
+	if len(t.secret) == 0 {
+		return fmt.Errorf("cluster_secret is not set")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		listener.Close()
+		return fmt.Errorf("transport is closed")
+	}
+	t.listener = listener
+	t.lock.Unlock()
+
+	t.wait.Add(1)
+	go t.acceptLoop(listener)
+	return nil
+}
+
+// Addr is the address the transport listens on, nil before Listen
+func (t *Transport) Addr() net.Addr {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Addr()
+}
+
+func (t *Transport) acceptLoop(listener net.Listener) {
+	defer t.wait.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !t.allowed("", conn.RemoteAddr()) {
+			log.Warn(fmt.Sprintf("Cluster connection from %s refused, not a host of nodes", conn.RemoteAddr()))
+			conn.Close()
+			continue
+		}
+		t.lock.Lock()
+		if t.closed {
+			t.lock.Unlock()
+			conn.Close()
+			return
+		}
+		t.inbound[conn] = true
+		t.lock.Unlock()
+		t.wait.Add(1)
+		go t.serveConn(conn)
+	}
+}
+
+func (t *Transport) serveConn(conn net.Conn) {
+	defer t.wait.Done()
+	defer func() {
+		t.lock.Lock()
+		delete(t.inbound, conn)
+		t.lock.Unlock()
+		conn.Close()
+	}()
+
+	l, from, err := t.acceptHandshake(conn)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Cluster connection from %s refused: %v", conn.RemoteAddr(), err))
+		return
+	}
+	var writeLock sync.Mutex
+	var requests sync.WaitGroup
+	defer requests.Wait()
+
+	for {
+		line, err := l.read()
+		if err != nil {
+			if err != io.EOF {
+				log.Warn(fmt.Sprintf("Cluster connection from %s closed: %v", from, err))
+			}
+			return
+		}
+		request := new(Message)
+		if err := json.Unmarshal(line, request); err != nil || request.Reply {
+			return
+		}
+		t.lock.Lock()
+		handler, ok := t.handlers[request.Type]
+		t.lock.Unlock()
+
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			reply := &Message{Id: request.Id, Type: request.Type, Reply: true}
+			if !ok {
+				reply.Error = fmt.Sprintf("unknown message type '%s'", request.Type)
+			} else if result, err := handler(from, request.Payload); err != nil {
+				reply.Error = err.Error()
+			} else if result != nil {
+				reply.Payload, err = json.Marshal(result)
+				if err != nil {
+					reply.Error = err.Error()
+				}
+			}
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			writeMessage(l, reply)
+		}()
+	}
+}
+
+func writeMessage(l *link, m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return l.write(data)
+}
+
+// Call sends a request to the node at addr and decodes the payload of its
+// reply into result, ctx bounds the dial and the wait
+func (t *Transport) Call(ctx context.Context, addr, typ string, payload, result interface{}) error {
+	pc, err := t.conn(ctx, addr)
+	if err != nil {
+		return err
+	}
+	request := &Message{Id: atomic.AddUint64(&t.nextId, 1), Type: typ}
+	if payload != nil {
+		if request.Payload, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	wait := make(chan *Message, 1)
+	pc.lock.Lock()
+	if pc.err != nil {
+		pc.lock.Unlock()
+		return pc.err
+	}
+	pc.pending[request.Id] = wait
+	pc.lock.Unlock()
+	defer func() {
+		pc.lock.Lock()
+		delete(pc.pending, request.Id)
+		pc.lock.Unlock()
+	}()
+
+	pc.writeLock.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.conn.SetWriteDeadline(deadline)
+	}
+	err = writeMessage(pc.link, request)
+	pc.conn.SetWriteDeadline(time.Time{})
+	pc.writeLock.Unlock()
+	if err != nil {
+		t.drop(addr, pc, err)
+		return err
+	}
+
+	select {
+	case reply, ok := <-wait:
+		if !ok {
+			pc.lock.Lock()
+			err = pc.err
+			pc.lock.Unlock()
+			return err
+		}
+		if reply.Error != "" {
+			return fmt.Errorf("%s", reply.Error)
+		}
+		if result != nil && len(reply.Payload) > 0 {
+			return json.Unmarshal(reply.Payload, result)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Transport) conn(ctx context.Context, addr string) (*peerConn, error) {
+	if len(t.secret) == 0 {
+		return nil, fmt.Errorf("cluster_secret is not set")
+	}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil, fmt.Errorf("transport is closed")
+	}
+	pc, ok := t.conns[addr]
+	t.lock.Unlock()
+	if ok {
+		return pc, nil
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := t.dialHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pc = &peerConn{
+		conn:    conn,
+		link:    l,
+		pending: make(map[uint64]chan *Message),
+	}
+	t.lock.Lock()
+	if other, ok := t.conns[addr]; ok || t.closed {
+		t.lock.Unlock()
+		conn.Close()
+		if ok {
+			return other, nil
+		}
+		return nil, fmt.Errorf("transport is closed")
+	}
+	t.conns[addr] = pc
+	t.lock.Unlock()
+
+	t.wait.Add(1)
+	go t.readReplies(addr, pc)
+	return pc, nil
+}
+
+func (t *Transport) readReplies(addr string, pc *peerConn) {
+	defer t.wait.Done()
+	for {
+		line, err := pc.link.read()
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("connection to %s closed", addr)
+			}
+			t.drop(addr, pc, err)
+			return
+		}
+		reply := new(Message)
+		if err := json.Unmarshal(line, reply); err != nil {
+			t.drop(addr, pc, err)
+			return
+		}
+		// under the lock, drop closes the pending channels
+		pc.lock.Lock()
+		if wait, ok := pc.pending[reply.Id]; ok {
+			wait <- reply
+			delete(pc.pending, reply.Id)
+		}
+		pc.lock.Unlock()
+	}
+}
+
+// drop closes a connection after an error, the pending calls fail with it and
+// the next call dials again
+func (t *Transport) drop(addr string, pc *peerConn, err error) {
+	t.lock.Lock()
+	if t.conns[addr] == pc {
+		delete(t.conns, addr)
+	}
+	t.lock.Unlock()
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if pc.err != nil {
+		return
+	}
+	pc.err = err
+	pc.conn.Close()
+	for id, wait := range pc.pending {
+		close(wait)
+		delete(pc.pending, id)
+	}
+}
+
+// Connected tells whether there is an outgoing connection to addr
+func (t *Transport) Connected(addr string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.conns[addr]
+	return ok
+}
+
+// Close stops listening and closes every connection
+func (t *Transport) Close() {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	t.closed = true
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	for conn := range t.inbound {
+		conn.Close()
+	}
+	conns := make(map[string]*peerConn)
+	for addr, pc := range t.conns {
+		conns[addr] = pc
+	}
+	t.lock.Unlock()
+
+	for addr, pc := range conns {
+		t.drop(addr, pc, fmt.Errorf("transport is closed"))
+	}
+	t.wait.Wait()
+}
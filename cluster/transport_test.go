@@ -0,0 +1,136 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// newTestTransport listens on addr and answers "whoami" with the sender
+func newTestTransport(t *testing.T, addr, secret string, peers ...string) (*Transport, *int32) {
+	t.Helper()
+	tr := NewTransport(addr, secret, peers)
+	served := new(int32)
+	tr.Handle("whoami", func(from string, payload json.RawMessage) (interface{}, error) {
+		atomic.AddInt32(served, 1)
+		return from, nil
+	})
+	if err := tr.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tr.Close)
+	return tr, served
+}
+
+func call(tr *Transport, addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var from string
+	err := tr.Call(ctx, addr, "whoami", nil, &from)
+	return from, err
+}
+
+func TestTransportAuthenticated(t *testing.T) {
+	a, b := freeAddr(t), freeAddr(t)
+	ta, _ := newTestTransport(t, a, "s3cret", b)
+	tb, _ := newTestTransport(t, b, "s3cret", a)
+	if from, err := call(ta, b); err != nil || from != a {
+		t.Errorf("a -> b: from %q, %v, want %s", from, err, a)
+	}
+	if from, err := call(tb, a); err != nil || from != b {
+		t.Errorf("b -> a: from %q, %v, want %s", from, err, b)
+	}
+	// the connection stays open for the next calls
+	for i := 0; i < 3; i++ {
+		if _, err := call(ta, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTransportRefused(t *testing.T) {
+	a, b, other := freeAddr(t), freeAddr(t), freeAddr(t)
+	_, served := newTestTransport(t, b, "s3cret", a)
+
+	wrong := NewTransport(a, "guess", []string{b})
+	defer wrong.Close()
+	if _, err := call(wrong, b); err == nil {
+		t.Error("a wrong cluster_secret was served")
+	}
+	stranger := NewTransport(other, "s3cret", []string{b})
+	defer stranger.Close()
+	if _, err := call(stranger, b); err == nil {
+		t.Error("a node not in nodes was served")
+	}
+	// the name and the secret of a, from another address
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, Timeout: 2 * time.Second}
+	if conn, err := dialer.Dial("tcp", b); err == nil {
+		defer conn.Close()
+		if _, err = NewTransport(a, "s3cret", nil).dialHandshake(conn); err == nil {
+			t.Error("a node was served from an address not in nodes")
+		}
+	}
+	unset := NewTransport(a, "", []string{b})
+	defer unset.Close()
+	if _, err := call(unset, b); err == nil {
+		t.Error("a call without cluster_secret was sent")
+	}
+	if n := atomic.LoadInt32(served); n != 0 {
+		t.Errorf("%d requests served", n)
+	}
+}
+
+func TestTransportForgedMessage(t *testing.T) {
+	a, b := freeAddr(t), freeAddr(t)
+	_, served := newTestTransport(t, b, "s3cret", a)
+	request := []byte(`{"id":1,"type":"whoami"}`)
+
+	// without the handshake
+	conn, err := net.Dial("tcp", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(append(request, '\n'))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Errorf("unauthenticated request answered %q", line)
+	}
+
+	// after the handshake, signed with the wrong key
+	ta := NewTransport(a, "s3cret", []string{b})
+	conn, err = net.Dial("tcp", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	l, err := ta.dialHandshake(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.key = []byte("forged")
+	if err = l.write(request); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := l.read(); err == nil {
+		t.Errorf("forged request answered %q", line)
+	}
+	if n := atomic.LoadInt32(served); n != 0 {
+		t.Errorf("%d requests served", n)
+	}
+}
@@ -7,20 +7,56 @@ package config
 import (
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"Didgen/model"
 	"github.com/go-gypsy/yaml"
 )
 
 var ConfigFile *yaml.File
-var Config *model.ServerConfig
+var ConfigPath string
+
+// current holds the *model.ServerConfig in effect. A stored config is never
+// changed, SIGHUP and CONFIG SET store a changed copy with Update, so a
+// request reads it while it is replaced
+var current atomic.Value
+var updateLock sync.Mutex
+
+// Current is the config in effect, read only
+func Current() *model.ServerConfig {
+	c, _ := current.Load().(*model.ServerConfig)
+	return c
+}
+
+// Store makes c the config in effect, c is not changed afterwards
+func Store(c *model.ServerConfig) {
+	current.Store(c)
+}
 
+// Update stores a copy of the config in effect with the changes of change,
+// updates never lose each other's changes
+func Update(change func(c *model.ServerConfig)) {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+	next := *Current()
+	change(&next)
+	current.Store(&next)
+}
+
+// Init reads the config file, an empty path runs on defaults and environment
+// variables alone
 func Init(config_path string) error {
-	cfg, err := GetConfigFile(config_path)
-	if err != nil {
-		return err
+	ConfigPath = config_path
+	var cfg *yaml.File
+	if config_path != "" {
+		var err error
+		cfg, err = GetConfigFile(config_path)
+		if err != nil {
+			return err
+		}
 	}
-	_, err = GetConfig(cfg)
+	_, err := GetConfig(cfg)
 	if err != nil {
 		return err
 	}
@@ -33,124 +69,42 @@ func GetConfigFile(config_path string) (*yaml.File, error) {
 	}
 
 	if _, err := os.Stat(config_path); os.IsNotExist(err) {
-		fmt.Printf("Init Config (%s) error: config_path does not exist!\n", config_path)
-		return ConfigFile, err
+		return nil, fmt.Errorf("config_path %s does not exist", config_path)
 	}
 
-	ConfigFile, err := yaml.ReadFile(config_path)
+	file, err := yaml.ReadFile(config_path)
 	if err != nil {
-		fmt.Printf("Init Config (%s) error: %s\n", config_path, err)
-		return ConfigFile, err
+		return nil, err
 	}
+	ConfigFile = file
 	return ConfigFile, nil
 }
 
+// GetConfig builds Config from the schema defaults, the config file and the
+// DIDGEN_* environment variables, the error lists every invalid key
 func GetConfig(cfg *yaml.File) (*model.ServerConfig, error) {
-	if Config != nil {
-		return Config, nil
-	}
-
-	var err error
-	Config = new(model.ServerConfig)
-
-	Config.LogPath, err = cfg.Get("log_path")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['log_path'] error: %s\n", err))
-		return Config, err
+	if c := Current(); c != nil {
+		return c, nil
 	}
 
-	Config.LogLevel, err = cfg.Get("log_level")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['log_level'] error: %s\n", err))
-		return Config, err
-	}
-
-	Config.ServerHost, err = cfg.Get("server_host")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['server_host'] error: %s\n", err))
-		return Config, err
-	}
-
-	Config.ServerPort, err = cfg.Get("server_port")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['server_host'] error: %s\n", err))
-		return Config, err
-	}
-
-	Config.TransPort, err = cfg.Get("trans_port")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['trans_host'] error: %s\n", err))
-		return Config, err
-	}
-
-	serverIdTmp, err := cfg.GetInt("server_id")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['server_id'] error: %s\n", err))
-		return Config, err
-	}
-	Config.ServerId = int(serverIdTmp)
-
-	Config.Nodes = make([]map[string]string, 0)
-	nodesNum, err := cfg.Count("nodes")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['nodes'] count error: %s\n", err))
-		return Config, err
-	}
-	for i := 0; i < nodesNum; i++ {
-		node := make(map[string]string)
-		serverHost, err := cfg.Get("nodes[0].server_host")
-		if err != nil {
-			fmt.Printf(fmt.Sprintf("Get Config['node'] server_host error: %s\n", err))
-			return Config, err
-		}
-		serverPort, err := cfg.Get("nodes[0].server_port")
-		if err != nil {
-			fmt.Printf(fmt.Sprintf("Get Config['node'] server_port error: %s\n", err))
-			return Config, err
-		}
-		transPort, err := cfg.Get("nodes[0].trans_port")
-		if err != nil {
-			fmt.Printf(fmt.Sprintf("Get Config['node'] trans_port error: %s\n", err))
-			return Config, err
-		}
-		node["server_host"] = serverHost
-		node["server_port"] = serverPort
-		node["trans_port"] = transPort
-		Config.Nodes = append(Config.Nodes, node)
-	}
-
-	heartbeatTimeOutTmp, err := cfg.GetInt("heartbeat_time_out")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['heartbeat_time_out'] error: %s\n", err))
-		return Config, err
-	}
-	Config.HeartbeatTimeOut = int(heartbeatTimeOutTmp)
-
-	heartbeatTimeIntervalTmp, err := cfg.GetInt("heartbeat_time_interval")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['heartbeat_time_interval'] error: %s\n", err))
-		return Config, err
-	}
-	Config.HeartbeatTimeInterval = int(heartbeatTimeIntervalTmp)
-
-	threadsTmp, err := cfg.GetInt("threads")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['threads'] error: %s\n", err))
-		return Config, err
-	}
-	Config.Threads = int(threadsTmp)
-
-	Config.DataPath, err = cfg.Get("data_path")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['data_path'] error: %s\n", err))
-		return Config, err
+	c := new(model.ServerConfig)
+	errs := load(cfg, c, sources)
+	Store(c)
+	if len(errs) > 0 {
+		return c, errs
 	}
+	return c, nil
+}
 
-	Config.BatchSize, err = cfg.GetInt("batch_size")
-	if err != nil {
-		fmt.Printf(fmt.Sprintf("Get Config['batch_size'] error: %s\n", err))
-		return Config, err
+// unquote strips the quotes go-gypsy keeps around "quoted" scalars
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
 	}
+	return value
+}
 
-	return Config, nil
+func isNotFound(err error) bool {
+	_, ok := err.(*yaml.NodeNotFound)
+	return ok
 }
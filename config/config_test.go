@@ -0,0 +1,90 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"Didgen/model"
+	"github.com/go-gypsy/yaml"
+)
+
+func loadString(t *testing.T, text string) (*model.ServerConfig, Errors) {
+	path := filepath.Join(t.TempDir(), "configuration.yml")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := yaml.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := new(model.ServerConfig)
+	return target, load(cfg, target, make(map[string]string))
+}
+
+func TestNodeSlots(t *testing.T) {
+	c, errs := loadString(t, `
+cluster_secret: s3cret
+nodes:
+    - server_host: 127.0.0.1
+      server_port: 6390
+      trans_port: 6090
+      slots: "0-5460"
+    - server_host: 127.0.0.1
+      server_port: 6391
+      trans_port: 6091
+`)
+	if len(errs) > 0 {
+		t.Fatalf("load: %v", errs)
+	}
+	if len(c.Nodes) != 2 {
+		t.Fatalf("nodes: %v", c.Nodes)
+	}
+	if c.Nodes[0]["slots"] != "0-5460" {
+		t.Errorf("nodes[0].slots = %q, want 0-5460", c.Nodes[0]["slots"])
+	}
+	if _, ok := c.Nodes[1]["slots"]; ok {
+		t.Errorf("nodes[1].slots = %q, want none", c.Nodes[1]["slots"])
+	}
+}
+
+func TestNodeSlotsInvalid(t *testing.T) {
+	_, errs := loadString(t, `
+nodes:
+    - server_host: 127.0.0.1
+      server_port: 6390
+      trans_port: 6090
+      slots: "0-16384"
+`)
+	if len(errs) == 0 {
+		t.Fatal("slots out of range accepted")
+	}
+}
+
+func TestClusterSecretRequired(t *testing.T) {
+	nodes := `
+nodes:
+    - server_host: 127.0.0.1
+      server_port: 6390
+      trans_port: 6090
+    - server_host: 127.0.0.1
+      server_port: 6391
+      trans_port: 6091
+`
+	if _, errs := loadString(t, nodes); len(errs) == 0 {
+		t.Error("other nodes accepted without cluster_secret")
+	}
+	if _, errs := loadString(t, "replication: async\n"); len(errs) == 0 {
+		t.Error("replication async accepted without cluster_secret")
+	}
+	if _, errs := loadString(t, "cluster_secret: "+SecretPlaceholder+"\n"+nodes); len(errs) == 0 {
+		t.Error("the cluster_secret of the example accepted")
+	}
+	c, errs := loadString(t, "cluster_secret: s3cret\n"+nodes)
+	if len(errs) > 0 {
+		t.Fatalf("load: %v", errs)
+	}
+	if c.ClusterSecret != "s3cret" {
+		t.Errorf("cluster_secret = %q", c.ClusterSecret)
+	}
+}
@@ -0,0 +1,362 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"Didgen/cluster"
+	"Didgen/model"
+	"github.com/go-gypsy/yaml"
+)
+
+const (
+	TypeString = "string"
+	TypeSecret = "secret" // a string never shown
+	TypeInt    = "int"
+	TypeOctal  = "octal"
+	TypePort   = "port"
+	TypeEnum   = "enum"
+	TypeNodes  = "nodes"
+	TypeUsers  = "users"
+	TypeKeys   = "keys"
+
+	// EnvPrefix and the upper case key name the environment variable of a key,
+	// DIDGEN_BATCH_SIZE for batch_size
+	EnvPrefix = "DIDGEN_"
+
+	// SecretPlaceholder is the cluster_secret of the example in
+	// configuration.yml, known to anyone, it is refused
+	SecretPlaceholder = "change-this-secret"
+)
+
+// Field describes one key of configuration.yml
+type Field struct {
+	Key     string
+	Type    string
+	Default string
+	Min     int64
+	Max     int64
+	Values  []string // of TypeEnum
+}
+
+// Schema lists the keys in the order of configuration.yml, every key is
+// optional and falls back to its default
+var Schema = []*Field{
+	{Key: "log_level", Type: TypeEnum, Default: "INFO", Values: []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+	{Key: "log_path", Type: TypeString, Default: "logs"},
+	{Key: "server_host", Type: TypeString, Default: "0.0.0.0"},
+	{Key: "server_port", Type: TypePort, Default: "6389"},
+	{Key: "trans_port", Type: TypePort, Default: "6089"},
+	{Key: "server_id", Type: TypeInt, Default: "0", Min: 0, Max: 1023},
+	{Key: "unix_socket", Type: TypeString, Default: ""},
+	{Key: "unix_socket_perm", Type: TypeOctal, Default: "700", Min: 0, Max: 0777},
+	{Key: "nodes", Type: TypeNodes, Default: "[]"},
+	{Key: "cluster_secret", Type: TypeSecret, Default: ""},
+	{Key: "heartbeat_time_out", Type: TypeInt, Default: "10", Min: 1, Max: 3600},
+	{Key: "heartbeat_time_interval", Type: TypeInt, Default: "5", Min: 1, Max: 3600},
+	{Key: "replication", Type: TypeEnum, Default: "none", Values: []string{"none", "raft", "async"}},
+	{Key: "election_timeout", Type: TypeInt, Default: "1000", Min: 100, Max: 60000},
+	{Key: "replicaof", Type: TypeString, Default: ""},
+	{Key: "promote_margin", Type: TypeInt, Default: "100000", Min: 0, Max: 1 << 40},
+	{Key: "redirect", Type: TypeEnum, Default: "moved", Values: []string{"moved", "proxy"}},
+	{Key: "cluster_enabled", Type: TypeEnum, Default: "no", Values: []string{"no", "yes"}},
+	{Key: "sentinel_master_name", Type: TypeString, Default: "mymaster"},
+	{Key: "max_clients", Type: TypeInt, Default: "10000", Min: 0, Max: 1 << 20},
+	{Key: "max_request_args", Type: TypeInt, Default: "1024", Min: 0, Max: 1 << 20},
+	{Key: "max_bulk_length", Type: TypeInt, Default: "65536", Min: 0, Max: 512 << 20},
+	{Key: "idle_timeout", Type: TypeInt, Default: "0", Min: 0, Max: 86400 * 365},
+	{Key: "read_timeout", Type: TypeInt, Default: "30", Min: 0, Max: 86400},
+	{Key: "shutdown_timeout", Type: TypeInt, Default: "10", Min: 0, Max: 86400},
+	{Key: "threads", Type: TypeInt, Default: "0", Min: 0, Max: 1024},
+	{Key: "data_path", Type: TypeString, Default: "data"},
+	{Key: "batch_size", Type: TypeInt, Default: "5000", Min: 1, Max: 1 << 40},
+	{Key: "shared_storage", Type: TypeEnum, Default: "no", Values: []string{"no", "yes"}},
+	{Key: "users", Type: TypeUsers, Default: "[]"},
+	{Key: "keys", Type: TypeKeys, Default: "[]"},
+	{Key: "tls_cert_file", Type: TypeString, Default: ""},
+	{Key: "tls_key_file", Type: TypeString, Default: ""},
+	{Key: "tls_ca_cert_file", Type: TypeString, Default: ""},
+	{Key: "tls_auth_clients", Type: TypeEnum, Default: "no", Values: []string{"no", "optional", "yes"}},
+}
+
+// Errors lists every invalid key of a config at once
+type Errors []string
+
+func (e Errors) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(e, "\n  "))
+}
+
+func (e *Errors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+func LookupField(key string) (*Field, bool) {
+	for _, f := range Schema {
+		if f.Key == key {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func (f *Field) Env() string {
+	return EnvPrefix + strings.ToUpper(f.Key)
+}
+
+// Validate checks a value and returns it in the format Get uses
+func (f *Field) Validate(value string) (string, error) {
+	switch f.Type {
+	case TypeInt, TypeOctal:
+		base := 10
+		if f.Type == TypeOctal {
+			base = 8
+		}
+		number, err := strconv.ParseInt(value, base, 64)
+		if err != nil {
+			return "", fmt.Errorf("'%s' is not an integer", value)
+		}
+		if number < f.Min || number > f.Max {
+			if f.Type == TypeOctal {
+				return "", fmt.Errorf("%o is out of range [%o, %o]", number, f.Min, f.Max)
+			}
+			return "", fmt.Errorf("%d is out of range [%d, %d]", number, f.Min, f.Max)
+		}
+		return strconv.FormatInt(number, base), nil
+	case TypePort:
+		if err := validatePort(value); err != nil {
+			return "", err
+		}
+	case TypeEnum:
+		for _, v := range f.Values {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("'%s' is not one of %s", value, strings.Join(f.Values, ", "))
+	case TypeNodes:
+		nodes := make([]map[string]string, 0)
+		if err := json.Unmarshal([]byte(value), &nodes); err != nil {
+			return "", fmt.Errorf("not a list of nodes: %v", err)
+		}
+		for i, node := range nodes {
+			if node["server_host"] == "" {
+				return "", fmt.Errorf("nodes[%d].server_host is missing", i)
+			}
+			for _, port := range []string{"server_port", "trans_port"} {
+				if err := validatePort(node[port]); err != nil {
+					return "", fmt.Errorf("nodes[%d].%s %v", i, port, err)
+				}
+			}
+			if _, err := cluster.ParseSlots(node["slots"]); err != nil {
+				return "", fmt.Errorf("nodes[%d].slots %v", i, err)
+			}
+		}
+	case TypeKeys:
+		keys := make([]map[string]string, 0)
+		if err := json.Unmarshal([]byte(value), &keys); err != nil {
+			return "", fmt.Errorf("not a list of keys: %v", err)
+		}
+		names := make(map[string]bool)
+		for i, key := range keys {
+			spec, err := model.ParseKeySpec(key)
+			if err != nil {
+				return "", fmt.Errorf("keys[%d] %v", i, err)
+			}
+			if names[spec.Name] {
+				return "", fmt.Errorf("keys[%d] %s is declared twice", i, spec.Name)
+			}
+			names[spec.Name] = true
+		}
+	case TypeUsers:
+		users := make([]map[string]string, 0)
+		if err := json.Unmarshal([]byte(value), &users); err != nil {
+			return "", fmt.Errorf("not a list of users: %v", err)
+		}
+		for i, user := range users {
+			if user["name"] == "" {
+				return "", fmt.Errorf("users[%d].name is missing", i)
+			}
+		}
+	}
+	return value, nil
+}
+
+func validatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("'%s' is not a port number", value)
+	}
+	return nil
+}
+
+// readField reads a key from the config file, lists are turned into the
+// json Get and the environment variables use
+func readField(cfg *yaml.File, f *Field) (string, bool, error) {
+	switch f.Type {
+	case TypeNodes:
+		return readList(cfg, f.Key, []string{"server_host", "server_port", "trans_port", "slots"})
+	case TypeUsers:
+		return readList(cfg, f.Key, []string{"name", "password", "commands", "keys", "enabled"})
+	case TypeKeys:
+		return readList(cfg, f.Key, []string{"name", "type", "start", "step", "min", "max", "batch_size"})
+	}
+	value, err := cfg.Get(f.Key)
+	if err != nil {
+		if isNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return unquote(value), true, nil
+}
+
+func readList(cfg *yaml.File, key string, fields []string) (string, bool, error) {
+	count, err := cfg.Count(key)
+	if err != nil {
+		if isNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	list := make([]map[string]string, 0, count)
+	for i := 0; i < count; i++ {
+		item := make(map[string]string)
+		for _, field := range fields {
+			value, err := cfg.Get(fmt.Sprintf("%s[%d].%s", key, i, field))
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return "", false, fmt.Errorf("%s[%d].%s: %v", key, i, field, err)
+			}
+			item[field] = unquote(value)
+		}
+		list = append(list, item)
+	}
+	data, _ := json.Marshal(list)
+	return string(data), true, nil
+}
+
+// Source tells where the value of a key comes from: default, file or env
+func Source(key string) string {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	return sources[key]
+}
+
+func SetSource(key, source string) {
+	sourcesLock.Lock()
+	sources[key] = source
+	sourcesLock.Unlock()
+}
+
+var sources = make(map[string]string)
+var sourcesLock sync.Mutex
+
+// Reload reads the config file and the environment again into a new config,
+// the config in effect is left as it is
+func Reload() (*model.ServerConfig, map[string]string, error) {
+	var cfg *yaml.File
+	if ConfigPath != "" {
+		var err error
+		cfg, err = yaml.ReadFile(ConfigPath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	target := new(model.ServerConfig)
+	targetSources := make(map[string]string)
+	if errs := load(cfg, target, targetSources); len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return target, targetSources, nil
+}
+
+// load applies defaults, the config file and the environment to target, in
+// this order, and checks all values before returning
+func load(cfg *yaml.File, target *model.ServerConfig, targetSources map[string]string) Errors {
+	errs := make(Errors, 0)
+	for _, f := range Schema {
+		value, source := f.Default, "default"
+		if cfg != nil {
+			fileValue, ok, err := readField(cfg, f)
+			if err != nil {
+				errs.add("%s: %v", f.Key, err)
+				continue
+			}
+			if ok {
+				value, source = fileValue, "file"
+			}
+		}
+		if envValue, ok := os.LookupEnv(f.Env()); ok {
+			value, source = envValue, "env"
+		}
+		valid, err := f.Validate(value)
+		if err != nil {
+			if source == "env" {
+				errs.add("%s (%s): %v", f.Key, f.Env(), err)
+			} else {
+				errs.add("%s: %v", f.Key, err)
+			}
+			continue
+		}
+		if err = target.Set(f.Key, valid); err != nil {
+			errs.add("%s: %v", f.Key, err)
+			continue
+		}
+		targetSources[f.Key] = source
+	}
+
+	if len(errs) == 0 {
+		checkConfig(target, &errs)
+	}
+	return errs
+}
+
+// checkConfig validates the keys which depend on each other
+func checkConfig(c *model.ServerConfig, errs *Errors) {
+	if c.HeartbeatTimeInterval >= c.HeartbeatTimeOut {
+		errs.add("heartbeat_time_interval: %d must be less than heartbeat_time_out %d", c.HeartbeatTimeInterval, c.HeartbeatTimeOut)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs.add("tls_cert_file, tls_key_file: both or none must be set")
+	}
+	if c.TLSAuthClients != "no" && c.TLSCACertFile == "" {
+		errs.add("tls_auth_clients: %s needs tls_ca_cert_file", c.TLSAuthClients)
+	}
+	if c.Replication == "raft" && len(c.Nodes) < 2 {
+		errs.add("replication: raft needs nodes to list this node and at least one other")
+	}
+	if c.ClusterSecret == "" && (len(c.Nodes) > 1 || c.Replication != "none" || c.ClusterEnabled == "yes") {
+		errs.add("cluster_secret: must be set with other nodes, replication or cluster_enabled, trans_port takes the nodes knowing it only")
+	}
+	if c.ClusterSecret == SecretPlaceholder {
+		errs.add("cluster_secret: is the example of configuration.yml, set a secret of your own")
+	}
+	if c.SharedStorage == "yes" && c.Replication != "none" {
+		errs.add("shared_storage: yes shares data.db, it does not go with replication %s", c.Replication)
+	}
+	if c.ReplicaOf != "" {
+		if c.Replication != "async" {
+			errs.add("replicaof: needs replication async")
+		} else if _, _, err := net.SplitHostPort(c.ReplicaOf); err != nil {
+			errs.add("replicaof: %s is not host:trans_port of the primary", c.ReplicaOf)
+		}
+	}
+	if c.ClusterEnabled == "yes" {
+		if c.Replication != "none" || c.SharedStorage == "yes" {
+			errs.add("cluster_enabled: yes shards the keys between the nodes, it does not go with replication %s or shared_storage", c.Replication)
+		}
+		if len(c.Nodes) == 0 {
+			errs.add("cluster_enabled: yes needs nodes to list this node and the others")
+		}
+	}
+	if c.ServerPort == "0" && c.UnixSocket == "" {
+		errs.add("server_port: 0 needs unix_socket, there would be no listener")
+	}
+}
@@ -2,10 +2,9 @@ package db
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"path/filepath"
-	"strings"
+	"sort"
 
 	"Didgen/config"
 	log "Didgen/logger_seelog"
@@ -13,30 +12,25 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// configuration.db holds the values set by CONFIG SET, they override
+// configuration.yml and the environment: defaults < yaml < env < CONFIG SET
 const (
-	ConfigTableName         = "__config__"
-	CreateConfigTableNTStmt = `
+	OverridesTableName       = "__config_overrides__"
+	CreateOverridesTableStmt = `
 	CREATE TABLE IF NOT EXISTS %s (
-        id Integer,
-		log_level Text,
-        log_path Text,
-        server_host Text,
-        server_port Text,
-        trans_port Text,
-        server_id Integer,
-        nodes Text,
-        heartbeat_time_out Integer,
-        heartbeat_time_interval Integer,
-        threads Integer,
-        data_path Text,
-        batch_size Integer,
-		PRIMARY KEY (id)
+		k VARCHAR(255) NOT NULL,
+		v TEXT NOT NULL,
+		PRIMARY KEY (k)
 	)`
-	UpdateConfigStmt = `UPDATE %s SET %s = ? WHERE id = 1`
-	InsertConfigStmt = `INSERT INTO %s (id) VALUES (1)`
+	SelectOverridesStmt = "SELECT k, v FROM %s"
+	UpsertOverrideStmt  = "INSERT OR REPLACE INTO %s (k, v) VALUES (?, ?)"
+	DeleteOverrideStmt  = "DELETE FROM %s WHERE k = ?"
+
+	// ConfigTableName is the table of older versions, a copy of every value
+	// of configuration.yml taken on the first start
+	ConfigTableName  = "__config__"
 	SelectConfigStmt = `SELECT log_level, log_path, server_host, server_port, trans_port, server_id, nodes, heartbeat_time_out,
 	                    heartbeat_time_interval, threads, data_path, batch_size FROM %s`
-	ConfigPrefix = "cfg."
 )
 
 var CONFIG *Config
@@ -48,13 +42,27 @@ type Config struct {
 func InitConfig() {
 	cfg := new(Config)
 	cfg.InitDB()
-	cfg.CreateConfigTable(false)
+	cfg.CreateOverridesTable()
+	cfg.migrateConfigTable()
+	cfg.CreateUsersTable()
+	cfg.CreateHistoryTable()
 	cfg.UpdateConfig()
 	CONFIG = cfg
 }
 
+// OpenConfig opens configuration.db read only, nothing is created, migrated
+// or written, a running server may use it meanwhile
+func OpenConfig() (*Config, error) {
+	dbPath := filepath.Join(config.Current().DataPath, "configuration.db")
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	return &Config{DB: db}, nil
+}
+
 func (c *Config) InitDB() {
-	dbPath := filepath.Join(config.Config.DataPath, "configuration.db")
+	dbPath := filepath.Join(config.Current().DataPath, "configuration.db")
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		panic(err)
@@ -64,85 +72,29 @@ func (c *Config) InitDB() {
 	c.DB = db
 }
 
-func (c *Config) CreateConfigTable(force bool) error {
-	if force {
-		sqlStmt := fmt.Sprintf(DropTableStmt, ConfigTableName)
-		_, err := c.DB.Exec(sqlStmt)
-		if err != nil {
-			log.Error(fmt.Sprintf("Config.CreateConfigTable with force, error: %v", err))
-			return err
-		}
-	}
-	sqlStmt := fmt.Sprintf(CreateConfigTableNTStmt, ConfigTableName)
+func (c *Config) CreateOverridesTable() error {
+	sqlStmt := fmt.Sprintf(CreateOverridesTableStmt, OverridesTableName)
 	_, err := c.DB.Exec(sqlStmt)
 	if err != nil {
-		log.Error(fmt.Sprintf("Config.CreateConfigTable without force, error: %v", err))
-		return err
-	}
-
-	sqlStmt = fmt.Sprintf(RowCountStmt, ConfigTableName)
-	rows, err := c.DB.Query(sqlStmt)
-	if err != nil {
-		log.Error(fmt.Sprintf("Config.CreateConfigTable, count error: %v", err))
+		log.Error(fmt.Sprintf("Config.CreateOverridesTable, error: %v", err))
+		countError(err)
 		return err
 	}
-	defer rows.Close()
-	var rowCount int64
-	for rows.Next() {
-		err = rows.Scan(&rowCount)
-		if err != nil {
-			log.Error(fmt.Sprintf("Config.CreateConfigTable, count error: %v", err))
-			return err
-		}
-	}
-
-	if rowCount == int64(0) {
-		sqlStmt = fmt.Sprintf(InsertConfigStmt, ConfigTableName)
-		_, err = c.DB.Exec(sqlStmt)
-		if err != nil {
-			log.Error(fmt.Sprintf("Config.CreateConfigTable, insert value error: %v", err))
-			return err
-		}
-		cfg := make(map[string]interface{})
-		cfg["log_level"] = config.Config.LogLevel
-		cfg["log_path"] = config.Config.LogPath
-		cfg["server_host"] = config.Config.ServerHost
-		cfg["server_port"] = config.Config.ServerPort
-		cfg["trans_port"] = config.Config.TransPort
-		cfg["server_id"] = config.Config.ServerId
-		nodes, _ := json.MarshalIndent(config.Config.Nodes, "", "    ")
-		cfg["nodes"] = string(nodes)
-		cfg["heartbeat_time_out"] = config.Config.HeartbeatTimeOut
-		cfg["heartbeat_time_interval"] = config.Config.HeartbeatTimeInterval
-		cfg["threads"] = config.Config.Threads
-		cfg["data_path"] = config.Config.DataPath
-		cfg["batch_size"] = config.Config.BatchSize
-		c.Update(cfg)
-	}
 	return nil
 }
 
-func (c *Config) Update(keys map[string]interface{}) error {
-	for key, value := range keys {
-		sqlStmt := fmt.Sprintf(UpdateConfigStmt, ConfigTableName, key)
-		_, err := c.DB.Exec(sqlStmt, value)
-		if err != nil {
-			if strings.Contains(strings.ToLower(err.Error()), "unique constraint") {
-				return nil
-			}
-			log.Error(fmt.Sprintf("Config.Update key: '%s', error: %v", key, err))
-			return err
-		}
+// migrateConfigTable keeps the values of the old table which differ from the
+// file as overrides, so an upgrade does not change the running config
+func (c *Config) migrateConfigTable() error {
+	var count int64
+	err := c.DB.QueryRow(fmt.Sprintf(GetKeysStmt, ConfigTableName)).Scan(&count)
+	if err != nil || count == 0 {
+		return err
 	}
 
-	return nil
-}
-
-func (c *Config) UpdateConfig() error {
 	result := new(model.ServerConfigDB)
-	sqlStmt := fmt.Sprintf(SelectConfigStmt, ConfigTableName)
-	row := c.DB.QueryRow(sqlStmt)
-	err := row.Scan(&result.LogLevel,
+	row := c.DB.QueryRow(fmt.Sprintf(SelectConfigStmt, ConfigTableName))
+	err = row.Scan(&result.LogLevel,
 		&result.LogPath,
 		&result.ServerHost,
 		&result.ServerPort,
@@ -154,35 +106,136 @@ func (c *Config) UpdateConfig() error {
 		&result.Threads,
 		&result.DataPath,
 		&result.BatchSize)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(fmt.Sprintf("Config.migrateConfigTable, error: %v", err))
+		countError(err)
+		return err
+	}
+	if err == nil {
+		// nodes and data_path of the old table were never applied
+		old := map[string]string{
+			"log_level":               result.LogLevel,
+			"log_path":                result.LogPath,
+			"server_host":             result.ServerHost,
+			"server_port":             result.ServerPort,
+			"trans_port":              result.TransPort,
+			"server_id":               fmt.Sprintf("%d", result.ServerId),
+			"heartbeat_time_out":      fmt.Sprintf("%d", result.HeartbeatTimeOut),
+			"heartbeat_time_interval": fmt.Sprintf("%d", result.HeartbeatTimeInterval),
+			"threads":                 fmt.Sprintf("%d", result.Threads),
+			"batch_size":              fmt.Sprintf("%d", result.BatchSize),
+		}
+		for key, value := range old {
+			current, _ := config.Current().Get(key)
+			if value == current {
+				continue
+			}
+			if err = c.SetOverride(key, value); err != nil {
+				return err
+			}
+			log.Info(fmt.Sprintf("Config.migrateConfigTable, %s: '%s' kept as override of '%s'", key, value, current))
+		}
+	}
+
+	_, err = c.DB.Exec(fmt.Sprintf(DropTableStmt, ConfigTableName))
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.migrateConfigTable, drop error: %v", err))
+		countError(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Config) Overrides() (map[string]string, error) {
+	result := make(map[string]string)
+	sqlStmt := fmt.Sprintf(SelectOverridesStmt, OverridesTableName)
+	rows, err := c.DB.Query(sqlStmt)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.Overrides, error: %v", err))
+		countError(err)
+		return result, err
+	}
+	defer rows.Close()
+	var key, value string
+	for rows.Next() {
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			log.Error(fmt.Sprintf("Config.Overrides, row error: %v", err))
+			countError(err)
+			return result, err
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+func (c *Config) SetOverride(key, value string) error {
+	sqlStmt := fmt.Sprintf(UpsertOverrideStmt, OverridesTableName)
+	_, err := c.DB.Exec(sqlStmt, key, value)
 	if err != nil {
-		log.Error(fmt.Sprintf("Config.UpdateConfig, error: %v", err))
+		log.Error(fmt.Sprintf("Config.SetOverride key: '%s', error: %v", key, err))
+		countError(err)
 		return err
 	}
-	config.Config.LogLevel = result.LogLevel
-	config.Config.LogPath = result.LogPath
-	config.Config.ServerHost = result.ServerHost
-	config.Config.ServerPort = result.ServerPort
-	config.Config.TransPort = result.TransPort
-	config.Config.ServerId = result.ServerId
-	// config.Config.Nodes = result.
-	config.Config.HeartbeatTimeOut = result.HeartbeatTimeOut
-	config.Config.HeartbeatTimeInterval = result.HeartbeatTimeInterval
-	config.Config.Threads = result.Threads
-	config.Config.DataPath = result.DataPath
-	config.Config.BatchSize = result.BatchSize
 	return nil
 }
 
-func (c *Config) Set(key, value string) error {
-	switch key {
-	case "log_level", "log_path", "server_host", "server_port", "trans_port", "server_id",
-		"heartbeat_time_out", "heartbeat_time_interval", "threads", "data_path", "batch_size":
-		err := c.Update(map[string]interface{}{key: value})
+func (c *Config) DeleteOverride(key string) error {
+	sqlStmt := fmt.Sprintf(DeleteOverrideStmt, OverridesTableName)
+	_, err := c.DB.Exec(sqlStmt, key)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.DeleteOverride key: '%s', error: %v", key, err))
+		countError(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Config) UpdateConfig() error {
+	var keys []string
+	var err error
+	config.Update(func(cfg *model.ServerConfig) {
+		keys, err = c.ApplyTo(cfg)
+	})
+	for _, key := range keys {
+		config.SetSource(key, "db")
+	}
+	return err
+}
+
+// ApplyTo overrides cfg with the values of configuration.db and returns the
+// keys it changed, invalid values are skipped
+func (c *Config) ApplyTo(cfg *model.ServerConfig) ([]string, error) {
+	overrides, err := c.Overrides()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	applied := make([]string, 0, len(keys))
+	for _, key := range keys {
+		field, ok := config.LookupField(key)
+		if !ok {
+			log.Warn(fmt.Sprintf("Config.ApplyTo, unknown key '%s' in configuration.db", key))
+			continue
+		}
+		value, err := field.Validate(overrides[key])
+		if err == nil {
+			err = cfg.Set(key, value)
+		}
 		if err != nil {
-			return err
+			log.Warn(fmt.Sprintf("Config.ApplyTo, %s in configuration.db: %v", key, err))
+			continue
 		}
-		return c.UpdateConfig()
-	default:
-		return fmt.Errorf("cfg.key not found!")
+		applied = append(applied, key)
 	}
+	return applied, nil
+}
+
+func (c *Config) Close() error {
+	return c.DB.Close()
 }
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"Didgen/config"
+	"Didgen/model"
+)
+
+// check-config reads the values of CONFIG SET without touching
+// configuration.db, not even migrating the table of older versions
+func TestOpenConfigReadOnly(t *testing.T) {
+	saved := config.Current()
+	config.Store(&model.ServerConfig{DataPath: t.TempDir(), BatchSize: 100})
+	defer config.Store(saved)
+	InitConfig()
+	if err := CONFIG.SetOverride("batch_size", "7"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := CONFIG.DB.Exec(fmt.Sprintf(`CREATE TABLE %s (log_level, log_path, server_host, server_port, trans_port, server_id, nodes,
+		heartbeat_time_out, heartbeat_time_interval, threads, data_path, batch_size)`, ConfigTableName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	CONFIG.Close()
+	CONFIG = nil
+	path := filepath.Join(config.Current().DataPath, "configuration.db")
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := OpenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.UpdateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Current().BatchSize; got != 7 {
+		t.Errorf("batch_size %d, want the override 7", got)
+	}
+	if config.Source("batch_size") != "db" {
+		t.Errorf("batch_size from %s, want db", config.Source("batch_size"))
+	}
+	if err = c.SetOverride("batch_size", "8"); err == nil {
+		t.Error("an override written on a read only configuration.db")
+	}
+	c.Close()
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("configuration.db changed")
+	}
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var count int64
+	if err = raw.QueryRow(fmt.Sprintf(GetKeysStmt, ConfigTableName)).Scan(&count); err != nil || count != 1 {
+		t.Errorf("table %s migrated: %d, %v", ConfigTableName, count, err)
+	}
+}
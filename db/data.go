@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"Didgen/config"
 	log "Didgen/logger_seelog"
@@ -21,6 +22,7 @@ const (
 	InsertKeyStmt  = "INSERT INTO %s (k) VALUES ('%s')"
 	SelectKeyStmt  = "SELECT k FROM %s WHERE k = '%s'"
 	SelectKeysStmt = "SELECT k FROM %s"
+	CountKeyStmt   = "SELECT count(*) FROM %s WHERE k = ?"
 	DeleteKeyStmt  = "DELETE FROM %s WHERE k = '%s'"
 
 	KeyPrefixFmt       = "idgen_%s"
@@ -36,13 +38,17 @@ const (
 	)`
 	DropTableStmt    = `DROP TABLE IF EXISTS %s`
 	InsertIdStmt     = "INSERT INTO %s (id) VALUES (%d)"
+	InsertFirstStmt  = "INSERT INTO %s (id) SELECT %d WHERE NOT EXISTS (SELECT 1 FROM %s)"
 	SelectIdStmt     = "SELECT id FROM %s"
 	UpdateIdIncrStmt = "UPDATE %s SET id = id + %d"
 	UpdateIdStmt     = "UPDATE %s SET id = %d"
+	UpdateIdCasStmt  = "UPDATE %s SET id = %d WHERE id = %d"
 	RowCountStmt     = "SELECT count(*) FROM %s"
 	GetKeysStmt      = "SELECT count(*) FROM sqlite_master WHERE type='table' AND name='%s'"
 
 	BatchCount = 1
+	// milliseconds a write waits for the other instances with shared_storage
+	SharedBusyTimeout = 30000
 )
 
 var DATA *Data
@@ -57,23 +63,64 @@ func InitData() {
 	DATA = data
 }
 
+// Close closes data.db and configuration.db, once the ids are flushed
+func Close() {
+	if DATA != nil {
+		if err := DATA.Close(); err != nil {
+			log.Error(fmt.Sprintf("Data.Close, error: %v", err))
+		}
+	}
+	if CONFIG != nil {
+		if err := CONFIG.Close(); err != nil {
+			log.Error(fmt.Sprintf("Config.Close, error: %v", err))
+		}
+	}
+}
+
 func (d *Data) InitDB() {
-	dbPath := filepath.Join(config.Config.DataPath, "data.db")
+	dbPath := filepath.Join(config.Current().DataPath, "data.db")
+	if config.Current().SharedStorage == "yes" {
+		dbPath += fmt.Sprintf("?_busy_timeout=%d", SharedBusyTimeout)
+	}
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		panic(err)
 	} else if db == nil {
 		panic("db is nil")
 	}
+	if config.Current().SharedStorage == "yes" {
+		if err = walMode(db); err != nil {
+			panic(err)
+		}
+	}
 	d.DB = db
 }
 
+// walMode switches data.db to wal, where the readers of the other instances
+// do not block a refill. The switch needs data.db to itself, so it is tried
+// again while other instances are starting, once done it stays.
+func walMode(db *sql.DB) error {
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		var mode string
+		if err = db.QueryRow("PRAGMA journal_mode").Scan(&mode); err == nil && strings.ToLower(mode) == "wal" {
+			return nil
+		}
+		if _, err = db.Exec("PRAGMA journal_mode=WAL"); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
 func (d *Data) CreateKeysRecordTable(force bool) error {
 	if force {
 		sqlStmt := fmt.Sprintf(DropTableStmt, KeysRecordTableName)
 		_, err := d.DB.Exec(sqlStmt)
 		if err != nil {
 			log.Info(fmt.Sprintf("Data.CreateKeysRecordTable with force, error: %v", err))
+			countError(err)
 			return err
 		}
 	}
@@ -81,6 +128,7 @@ func (d *Data) CreateKeysRecordTable(force bool) error {
 	_, err := d.DB.Exec(sqlStmt)
 	if err != nil {
 		log.Info(fmt.Sprintf("Data.CreateKeysRecordTable without force, error: %v", err))
+		countError(err)
 		return err
 	}
 	return nil
@@ -94,6 +142,7 @@ func (d *Data) AddKeyToRecordTable(key string) error {
 			return nil
 		}
 		log.Info(fmt.Sprintf("Data.AddKeyToRecordTable('%s'), error: %v", key, err))
+		countError(err)
 		return err
 	}
 	return nil
@@ -106,17 +155,30 @@ func (d *Data) GetKeyFromRecordTable(key string) (string, error) {
 	err := row.Scan(&result)
 	if err != nil {
 		log.Info(fmt.Sprintf("Data.GetKeyFromRecordTable('%s'), error: %v", key, err))
+		countError(err)
 		return "", err
 	}
 	return result, nil
 }
 
+// HasKey is true when key is in __idgen__, without logging a missing key
+func (d *Data) HasKey(key string) (bool, error) {
+	var count int
+	err := d.DB.QueryRow(fmt.Sprintf(CountKeyStmt, KeysRecordTableName), key).Scan(&count)
+	if err != nil {
+		countError(err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (d *Data) GetKeysFromRecordTable() ([]string, error) {
 	result := make([]string, 0)
 	sqlStmt := fmt.Sprintf(SelectKeysStmt, KeysRecordTableName)
 	rows, err := d.DB.Query(sqlStmt)
 	if err != nil {
 		log.Info(fmt.Sprintf("Data.GetKeysFromRecordTable, error: %v", err))
+		countError(err)
 		return result, err
 	}
 	defer rows.Close()
@@ -125,6 +187,7 @@ func (d *Data) GetKeysFromRecordTable() ([]string, error) {
 		err = rows.Scan(&key)
 		if err != nil {
 			log.Error(fmt.Sprintf("Data.GetKeysFromRecordTable, row error: %v", err))
+			countError(err)
 			return result, err
 		}
 		if key != "" {
@@ -139,6 +202,7 @@ func (d *Data) DeleteKeyFromRecordTable(key string) error {
 	_, err := d.DB.Exec(sqlStmt)
 	if err != nil {
 		log.Info(fmt.Sprintf("Data.DeleteKeyFromRecordTable('%s'), error: %v", key, err))
+		countError(err)
 		return err
 	}
 	return nil
@@ -149,37 +213,28 @@ func (d *Data) FmtKey(key string) string {
 }
 
 func (d *Data) CreateKeyTable(key string) error {
+	return d.InitKeyTable(key, 0)
+}
+
+// InitKeyTable creates the table of a key at value, a table which exists
+// keeps its value
+func (d *Data) InitKeyTable(key string, value int64) error {
 	idKey := d.FmtKey(key)
 	sqlStmt := fmt.Sprintf(CreateKeyTableNTStmt, idKey)
 	_, err := d.DB.Exec(sqlStmt)
 	if err != nil {
-		log.Info(fmt.Sprintf("Data.CreateKeyTable('%s'), error: %v", key, err))
+		log.Info(fmt.Sprintf("Data.InitKeyTable('%s'), error: %v", key, err))
+		countError(err)
 		return err
 	}
-	sqlStmt = fmt.Sprintf(RowCountStmt, idKey)
-	rows, err := d.DB.Query(sqlStmt)
+	// one statement, another instance sharing data.db may create it too
+	sqlStmt = fmt.Sprintf(InsertFirstStmt, idKey, value, idKey)
+	_, err = d.DB.Exec(sqlStmt)
 	if err != nil {
-		log.Info(fmt.Sprintf("Data.CreateKeyTable('%s'), count error: %v", key, err))
+		log.Info(fmt.Sprintf("Data.InitKeyTable('%s'), insert value error: %v", key, err))
+		countError(err)
 		return err
 	}
-	defer rows.Close()
-	var rowCount int64
-	for rows.Next() {
-		err = rows.Scan(&rowCount)
-		if err != nil {
-			log.Error(fmt.Sprintf("Data.CreateKeyTable('%s'), count error: %v", key, err))
-			return err
-		}
-	}
-
-	if rowCount == int64(0) {
-		sqlStmt = fmt.Sprintf(InsertIdStmt, idKey, 0)
-		_, err = d.DB.Exec(sqlStmt)
-		if err != nil {
-			log.Info(fmt.Sprintf("Data.CreateKeyTable('%s'), insert value error: %v", key, err))
-			return err
-		}
-	}
 
 	return nil
 }
@@ -190,6 +245,7 @@ func (d *Data) ResetKeyTable(key string, value int64) error {
 	_, err := d.DB.Exec(sqlStmt)
 	if err != nil {
 		log.Info(fmt.Sprintf("Data.ResetKeyTable('%s'), error: %v", key, err))
+		countError(err)
 		return err
 	}
 	return nil
@@ -201,6 +257,7 @@ func (d *Data) DeleteKeyTable(key string) error {
 	_, err := d.DB.Exec(sqlStmt)
 	if err != nil {
 		log.Info(fmt.Sprintf("Data.DeleteKeyTable('%s'), error: %v", key, err))
+		countError(err)
 		return err
 	}
 	return nil
@@ -212,17 +269,60 @@ func (d *Data) IncrKey(key string, value int64) error {
 	tx, err := d.DB.Begin()
 	if err != nil {
 		log.Error(fmt.Sprintf("Data.IncrKey('%s'), value: %d, error: %v", key, value, err))
+		countError(err)
+		return err
 	}
 	_, err = tx.Exec(sqlStmt)
 	if err != nil {
 		tx.Rollback()
 		log.Error(fmt.Sprintf("Data.IncrKey('%s'), value: %d, error: %v", key, value, err))
+		countError(err)
 		return err
 	}
 	tx.Commit()
 	return nil
 }
 
+// ReserveKey moves the key from to to, only if it is still at from, the
+// compare and swap of a refill: false when another writer moved it first
+func (d *Data) ReserveKey(key string, from int64, to int64) (bool, error) {
+	idKey := d.FmtKey(key)
+	sqlStmt := fmt.Sprintf(UpdateIdCasStmt, idKey, to, from)
+	result, err := d.DB.Exec(sqlStmt)
+	if err != nil {
+		log.Error(fmt.Sprintf("Data.ReserveKey('%s'), from: %d, to: %d, error: %v", key, from, to, err))
+		countError(err)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseKey moves the key back from batchMax to cur, it does nothing when the
+// key is not at batchMax any more
+func (d *Data) ReleaseKey(key string, batchMax int64, cur int64) (bool, error) {
+	idKey := d.FmtKey(key)
+	sqlStmt := fmt.Sprintf(UpdateIdCasStmt, idKey, cur, batchMax)
+	result, err := d.DB.Exec(sqlStmt)
+	if err != nil {
+		log.Error(fmt.Sprintf("Data.ReleaseKey('%s'), error: %v", key, err))
+		countError(err)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (d *Data) Close() error {
+	return d.DB.Close()
+}
+
 func (d *Data) GetKey(key string) (int64, error) {
 	var id int64
 	idKey := d.FmtKey(key)
@@ -231,6 +331,7 @@ func (d *Data) GetKey(key string) (int64, error) {
 	err := row.Scan(&id)
 	if err != nil {
 		log.Error(fmt.Sprintf("Data.GetKey('%s'), error: %v", key, err))
+		countError(err)
 		return 0, err
 	}
 	return id, nil
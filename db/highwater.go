@@ -0,0 +1,44 @@
+package db
+
+import (
+	"Didgen/raft"
+)
+
+// HighWater moves the high-water mark of a key, the last id reserved in
+// data.db. The local one writes data.db at once with a compare and swap, so
+// instances sharing data.db never reserve the same batch, replication raft
+// replaces it with one which commits every move to the raft log before.
+type HighWater interface {
+	// Reserve moves the key to to, refill read it at from
+	Reserve(key string, from, to int64) error
+	// Release moves the key back from batchMax to cur, unless it moved on
+	Release(key string, batchMax, cur int64) (bool, error)
+}
+
+// ErrConflict is returned by Reserve when the key is not at from any more,
+// refill reads it again
+var ErrConflict = raft.ErrConflict
+
+var HIGHWATER HighWater = localHighWater{}
+
+// Reserve is the Reserve of a HighWater on data.db
+func (d *Data) Reserve(key string, from, to int64) error {
+	reserved, err := d.ReserveKey(key, from, to)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		return ErrConflict
+	}
+	return nil
+}
+
+type localHighWater struct{}
+
+func (localHighWater) Reserve(key string, from, to int64) error {
+	return DATA.Reserve(key, from, to)
+}
+
+func (localHighWater) Release(key string, batchMax, cur int64) (bool, error) {
+	return DATA.ReleaseKey(key, batchMax, cur)
+}
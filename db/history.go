@@ -0,0 +1,179 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "Didgen/logger_seelog"
+)
+
+const (
+	HistoryTableName       = "__config_history__"
+	CreateHistoryTableStmt = `
+	CREATE TABLE IF NOT EXISTS %s (
+		revision INTEGER NOT NULL,
+		time INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		client TEXT NOT NULL,
+		k VARCHAR(255) NOT NULL,
+		old TEXT NOT NULL,
+		new TEXT NOT NULL,
+		PRIMARY KEY (revision, k)
+	)`
+	MaxRevisionStmt   = "SELECT IFNULL(MAX(revision), 0) FROM %s"
+	InsertHistoryStmt = "INSERT INTO %s (revision, time, action, client, k, old, new) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	SelectHistoryStmt = `SELECT revision, time, action, client, k, old, new FROM %s
+	                     WHERE revision > (SELECT IFNULL(MAX(revision), 0) FROM %s) - ? ORDER BY revision DESC, k`
+	SelectChangesAfterStmt = "SELECT k, old FROM %s WHERE revision > ? ORDER BY revision DESC"
+	RevisionExistsStmt     = "SELECT count(*) FROM %s WHERE revision = ?"
+)
+
+// ConfigChange is one key of a revision, a revision groups the keys changed
+// by one CONFIG SET, reload or rollback
+type ConfigChange struct {
+	Revision int64
+	Time     time.Time
+	Action   string
+	Client   string
+	Key      string
+	Old      string
+	New      string
+}
+
+func (c *Config) CreateHistoryTable() error {
+	sqlStmt := fmt.Sprintf(CreateHistoryTableStmt, HistoryTableName)
+	_, err := c.DB.Exec(sqlStmt)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.CreateHistoryTable, error: %v", err))
+		countError(err)
+		return err
+	}
+	return nil
+}
+
+// Commit stores the new values as overrides and records them as a revision,
+// both or neither
+func (c *Config) Commit(action, client string, changes []ConfigChange) (int64, error) {
+	return c.record(action, client, changes, true)
+}
+
+// Record only adds a revision, for changes which do not come from
+// configuration.db like a reload of configuration.yml
+func (c *Config) Record(action, client string, changes []ConfigChange) (int64, error) {
+	return c.record(action, client, changes, false)
+}
+
+func (c *Config) record(action, client string, changes []ConfigChange, override bool) (int64, error) {
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.record, begin error: %v", err))
+		countError(err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var revision int64
+	err = tx.QueryRow(fmt.Sprintf(MaxRevisionStmt, HistoryTableName)).Scan(&revision)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.record, revision error: %v", err))
+		countError(err)
+		return 0, err
+	}
+	revision++
+	now := time.Now().Unix()
+	for _, change := range changes {
+		if override {
+			_, err = tx.Exec(fmt.Sprintf(UpsertOverrideStmt, OverridesTableName), change.Key, change.New)
+			if err != nil {
+				log.Error(fmt.Sprintf("Config.record key: '%s', override error: %v", change.Key, err))
+				countError(err)
+				return 0, err
+			}
+		}
+		_, err = tx.Exec(fmt.Sprintf(InsertHistoryStmt, HistoryTableName), revision, now, action, client, change.Key, change.Old, change.New)
+		if err != nil {
+			log.Error(fmt.Sprintf("Config.record key: '%s', history error: %v", change.Key, err))
+			countError(err)
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error(fmt.Sprintf("Config.record, commit error: %v", err))
+		countError(err)
+		return 0, err
+	}
+	return revision, nil
+}
+
+// History returns the changes of the last count revisions, newest first
+func (c *Config) History(count int64) ([]ConfigChange, error) {
+	result := make([]ConfigChange, 0)
+	sqlStmt := fmt.Sprintf(SelectHistoryStmt, HistoryTableName, HistoryTableName)
+	rows, err := c.DB.Query(sqlStmt, count)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.History, error: %v", err))
+		countError(err)
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change ConfigChange
+		var unix int64
+		err = rows.Scan(&change.Revision, &unix, &change.Action, &change.Client, &change.Key, &change.Old, &change.New)
+		if err != nil {
+			log.Error(fmt.Sprintf("Config.History, row error: %v", err))
+			countError(err)
+			return result, err
+		}
+		change.Time = time.Unix(unix, 0)
+		result = append(result, change)
+	}
+	return result, nil
+}
+
+// RollbackValues returns the values the keys changed after revision had
+// right after it, revision 0 is the state before the first change
+func (c *Config) RollbackValues(revision int64) (map[string]string, error) {
+	if revision < 0 {
+		return nil, fmt.Errorf("revision %d does not exist", revision)
+	}
+	if revision > 0 {
+		var count int64
+		err := c.DB.QueryRow(fmt.Sprintf(RevisionExistsStmt, HistoryTableName), revision).Scan(&count)
+		if err != nil {
+			log.Error(fmt.Sprintf("Config.RollbackValues, error: %v", err))
+			countError(err)
+			return nil, err
+		}
+		if count == 0 {
+			return nil, fmt.Errorf("revision %d does not exist", revision)
+		}
+	}
+
+	result := make(map[string]string)
+	rows, err := c.DB.Query(fmt.Sprintf(SelectChangesAfterStmt, HistoryTableName), revision)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(fmt.Sprintf("Config.RollbackValues, error: %v", err))
+		countError(err)
+		return nil, err
+	}
+	defer rows.Close()
+	// newest first, so the oldest change after revision wins
+	for rows.Next() {
+		var key, old string
+		if err = rows.Scan(&key, &old); err != nil {
+			log.Error(fmt.Sprintf("Config.RollbackValues, row error: %v", err))
+			countError(err)
+			return nil, err
+		}
+		result[key] = old
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("revision %d is the current one", revision)
+	}
+	return result, nil
+}
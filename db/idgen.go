@@ -2,27 +2,46 @@ package db
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"Didgen/config"
+	"Didgen/model"
 )
 
 type IdGenerator struct {
-	key       string // id generator key name
-	cur       int64  // current id
-	batchMax  int64  // max id before get from db
-	batchSize int64  // batch size
+	key       string         // id generator key name
+	cur       int64          // current id
+	batchMax  int64          // max id before get from db
+	batchSize int64          // batch size
+	spec      *model.KeySpec // step and bounds of a declared key, nil for 1 and none
+	closed    bool           // no more ids after Close
+	stale     int32          // the batch was dropped by Invalidate
 
 	lock sync.Mutex
 }
 
+var ErrGeneratorClosed = fmt.Errorf("id generator is closed, server is shutting down")
+
+// a refill losing to other writers reads the key again for up to
+// refillTimeout, backing off for a random while which doubles each time up
+// to refillBackoffMax
+const (
+	refillTimeout    = 10 * time.Second
+	refillBackoff    = time.Millisecond
+	refillBackoffMax = 20 * time.Millisecond
+)
+
 func NewIdGenerator(key string) (*IdGenerator, error) {
 	idgen := new(IdGenerator)
 	if len(key) == 0 {
 		return nil, fmt.Errorf("key is empty")
 	}
 	idgen.key = key
-	idgen.batchSize = config.Config.BatchSize
+	idgen.batchSize = config.Current().BatchSize
 	idgen.cur = 0
 	idgen.batchMax = idgen.cur
 	return idgen, nil
@@ -43,24 +62,165 @@ func (g *IdGenerator) Current() (int64, error) {
 }
 
 func (g *IdGenerator) Next() (int64, error) {
-	var id int64
-	var err error
 	g.lock.Lock()
 	defer g.lock.Unlock()
-	if g.batchMax < g.cur+1 {
-		id, err = DATA.GetKey(g.key)
-		if err != nil {
+	if g.closed {
+		return 0, ErrGeneratorClosed
+	}
+	if atomic.CompareAndSwapInt32(&g.stale, 1, 0) {
+		g.batchMax = g.cur
+	}
+	step, max := g.bounds()
+	if g.cur > g.batchMax-step {
+		if err := g.refill(step, max); err != nil {
 			return 0, err
 		}
-		err = DATA.IncrKey(g.key, g.batchSize)
+	}
+	g.cur += step
+	return g.cur, nil
+}
+
+func (g *IdGenerator) bounds() (int64, int64) {
+	if g.spec == nil {
+		return 1, math.MaxInt64
+	}
+	return g.spec.Step, g.spec.Max
+}
+
+// refill reserves the next batch in the db, never past max, a cycle key
+// starts over at min once max is reached. The batch is taken by a compare and
+// swap on the value read, when another writer moved the key in between it is
+// read again
+func (g *IdGenerator) refill(step, max int64) error {
+	start := time.Now()
+	if err := g.retry("refill", func() error { return g.reserve(step, max) }); err != nil {
+		return err
+	}
+	Stats.recordRefill(start)
+	return nil
+}
+
+// retry runs attempt again for as long as it loses to other writers with
+// ErrConflict
+func (g *IdGenerator) retry(what string, attempt func() error) error {
+	start := time.Now()
+	var err error
+	backoff := refillBackoff
+	conflicts := 0
+	for {
+		if err = attempt(); err != ErrConflict {
+			return err
+		}
+		conflicts++
+		atomic.AddInt64(&Stats.RefillConflicts, 1)
+		if time.Since(start) > refillTimeout {
+			return fmt.Errorf("key '%s' %s gave up after %d conflicts in %v", g.key, what, conflicts, refillTimeout)
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(backoff))))
+		if backoff *= 2; backoff > refillBackoffMax {
+			backoff = refillBackoffMax
+		}
+	}
+}
+
+func (g *IdGenerator) reserve(step, max int64) error {
+	id, err := DATA.GetKey(g.key)
+	if err != nil {
+		return err
+	}
+	base := id
+	if id > max-step {
+		if g.spec == nil || g.spec.Type != model.KeyTypeCycle {
+			return fmt.Errorf("key '%s' reached its max %d", g.key, max)
+		}
+		base = g.spec.Min - step
+	}
+	batch := g.batchSize
+	if g.spec != nil && g.spec.BatchSize > 0 {
+		batch = g.spec.BatchSize
+	}
+	// the last id of the batch which fits below max, max - base is not
+	// negative but may not fit an int64 when base is, so it is unsigned
+	count := batch
+	if left := (uint64(max) - uint64(base)) / uint64(step); left < uint64(batch) {
+		count = int64(left)
+	}
+	if err = HIGHWATER.Reserve(g.key, id, base+count*step); err != nil {
+		return err
+	}
+	g.batchMax = base + count*step
+	g.cur = base
+	return nil
+}
+
+// SetBatchSize applies to the next refill, the current batch is used up first
+func (g *IdGenerator) SetBatchSize(size int64) {
+	g.lock.Lock()
+	g.batchSize = size
+	g.lock.Unlock()
+}
+
+// SetSpec applies the step and bounds of a declared key from the next id on,
+// nil makes it a plain key again
+func (g *IdGenerator) SetSpec(spec *model.KeySpec) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if spec != nil && g.spec != nil && *spec == *g.spec {
+		return
+	}
+	g.spec = spec
+	// a batch of the old step is not on the new grid
+	if g.batchMax > g.cur {
+		if _, err := HIGHWATER.Release(g.key, g.batchMax, g.cur); err == nil {
+			g.batchMax = g.cur
+		}
+	}
+}
+
+// Advance moves the key forward to value, it never moves it backwards. Like
+// a refill it is a compare and swap on the value read, a batch another writer
+// reserved in between is never handed out again
+func (g *IdGenerator) Advance(value int64) (bool, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	advanced := false
+	err := g.retry("advance", func() error {
+		id, err := DATA.GetKey(g.key)
 		if err != nil {
-			return 0, err
+			return err
+		}
+		if id >= value {
+			return nil
 		}
-		g.batchMax = id + g.batchSize
-		g.cur = id
+		if err = DATA.Reserve(g.key, id, value); err != nil {
+			return err
+		}
+		advanced = true
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-	g.cur++
-	return g.cur, nil
+	if !advanced {
+		if g.cur < value {
+			g.cur = value
+		}
+		return false, nil
+	}
+	g.cur = value
+	g.batchMax = value
+	return true, nil
+}
+
+// Create makes a new key start at value. Unlike Reset it never moves a key
+// back, another instance sharing data.db may have created it and reserved
+// batches already
+func (g *IdGenerator) Create(value int64) error {
+	if err := DATA.InitKeyTable(g.key, value); err != nil {
+		return err
+	}
+	_, err := g.Advance(value)
+	return err
 }
 
 func (g *IdGenerator) Reset(value int64, force bool) error {
@@ -88,6 +248,33 @@ func (g *IdGenerator) Reset(value int64, force bool) error {
 	return nil
 }
 
+// Close stops the generator and gives the unused part of its batch back,
+// unless another writer moved the key on since the batch was taken
+func (g *IdGenerator) Close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	if g.cur >= g.batchMax {
+		return nil
+	}
+	_, err := HIGHWATER.Release(g.key, g.batchMax, g.cur)
+	if err != nil {
+		return err
+	}
+	g.batchMax = g.cur
+	return nil
+}
+
+// Invalidate drops the batch, the next id comes after the high-water in
+// data.db. It does not wait for a refill in progress, so applying a
+// replicated change never blocks on the generator.
+func (g *IdGenerator) Invalidate() {
+	atomic.StoreInt32(&g.stale, 1)
+}
+
 func (g *IdGenerator) Delete() error {
 	g.lock.Lock()
 	defer g.lock.Unlock()
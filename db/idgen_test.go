@@ -0,0 +1,235 @@
+package db
+
+import (
+	"math"
+	"sync"
+	"testing"
+
+	"Didgen/config"
+	"Didgen/model"
+)
+
+// setupData opens a data.db of its own for the test
+func setupData(t *testing.T, cfg *model.ServerConfig) {
+	if cfg == nil {
+		cfg = new(model.ServerConfig)
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 100
+	}
+	cfg.DataPath = t.TempDir()
+	saved, savedHighWater := config.Current(), HIGHWATER
+	config.Store(cfg)
+	HIGHWATER = localHighWater{}
+	InitData()
+	if err := DATA.CreateKeysRecordTable(false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		DATA.Close()
+		DATA = nil
+		config.Store(saved)
+		HIGHWATER = savedHighWater
+	})
+}
+
+func newKey(t *testing.T, key string, value int64) *IdGenerator {
+	idgen, err := NewIdGenerator(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = idgen.Reset(value, false); err != nil {
+		t.Fatal(err)
+	}
+	return idgen
+}
+
+// a negative value reserves one batch, max - value does not fit an int64
+func TestNextAfterNegativeSet(t *testing.T) {
+	setupData(t, nil)
+	for _, value := range []int64{-10, math.MinInt64 + 1} {
+		idgen := newKey(t, "negative", value)
+		id, err := idgen.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != value+1 {
+			t.Errorf("SET %d, GET = %d, want %d", value, id, value+1)
+		}
+		high, err := DATA.GetKey("negative")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if high != value+100 {
+			t.Errorf("SET %d, high-water %d, want %d", value, high, value+100)
+		}
+	}
+}
+
+func TestNextStopsAtMax(t *testing.T) {
+	setupData(t, nil)
+	idgen := newKey(t, "bounded", -5)
+	idgen.SetSpec(&model.KeySpec{Name: "bounded", Type: model.KeyTypeSequence, Step: 2, Min: math.MinInt64, Max: 0})
+	ids := make([]int64, 0)
+	for {
+		id, err := idgen.Next()
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) != 2 || ids[0] != -3 || ids[1] != -1 {
+		t.Errorf("ids %v, want [-3 -1]", ids)
+	}
+}
+
+// generators of one key on one data.db, with batches taken at once by
+// ReserveKey and given back by ReleaseKey on Close, never issue an id twice.
+// Each creates the key first, as instances starting with a newly declared key
+func TestGeneratorsDisjoint(t *testing.T) {
+	setupData(t, &model.ServerConfig{BatchSize: 7, SharedStorage: "yes"})
+	const start = 1000
+	// another process on the same file
+	other := new(Data)
+	other.InitDB()
+	defer other.Close()
+
+	const generators, ids, reserves = 8, 2000, 200
+	issued := make([][]int64, generators+1)
+	errs := make(chan error, generators+1)
+	var wait sync.WaitGroup
+	for i := 0; i < generators; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			idgen, err := NewIdGenerator("shared")
+			if err == nil {
+				err = idgen.Create(start)
+			}
+			for n := 0; n < ids && err == nil; n++ {
+				if n == ids/2 {
+					// a restart, the rest of the batch is given back
+					if err = idgen.Close(); err != nil {
+						break
+					}
+					idgen, _ = NewIdGenerator("shared")
+				}
+				var id int64
+				if id, err = idgen.Next(); err == nil {
+					issued[i] = append(issued[i], id)
+				}
+			}
+			if err == nil {
+				err = idgen.Close()
+			}
+			errs <- err
+		}(i)
+	}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		if err := other.InitKeyTable("shared", start); err != nil {
+			errs <- err
+			return
+		}
+		for n := 0; n < reserves; n++ {
+			from, err := other.GetKey("shared")
+			if err != nil {
+				errs <- err
+				return
+			}
+			reserved, err := other.ReserveKey("shared", from, from+7)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if reserved {
+				for id := from + 1; id <= from+7; id++ {
+					issued[generators] = append(issued[generators], id)
+				}
+			}
+		}
+		errs <- nil
+	}()
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	high, err := DATA.GetKey("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]int)
+	for i, ids := range issued {
+		for _, id := range ids {
+			if owner, ok := seen[id]; ok {
+				t.Fatalf("id %d issued by %d and %d", id, owner, i)
+			}
+			seen[id] = i
+			if id <= start || id > high {
+				t.Fatalf("id %d issued outside of %d and the high-water mark %d", id, start, high)
+			}
+		}
+	}
+	if len(seen) < generators*ids {
+		t.Errorf("%d ids issued, want %d", len(seen), generators*ids)
+	}
+}
+
+// Advance, as provisioning runs it, racing refills never moves the key back
+// under a batch already handed out
+func TestAdvanceDuringRefills(t *testing.T) {
+	setupData(t, &model.ServerConfig{BatchSize: 5, SharedStorage: "yes"})
+	newKey(t, "advanced", 0)
+
+	const generators, ids, advances = 4, 2000, 500
+	issued := make([][]int64, generators)
+	errs := make(chan error, generators+1)
+	var wait sync.WaitGroup
+	for i := 0; i < generators; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			idgen, err := NewIdGenerator("advanced")
+			for n := 0; n < ids && err == nil; n++ {
+				var id int64
+				if id, err = idgen.Next(); err == nil {
+					issued[i] = append(issued[i], id)
+				}
+			}
+			errs <- err
+		}(i)
+	}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		provision, err := NewIdGenerator("advanced")
+		for n := 0; n < advances && err == nil; n++ {
+			var high int64
+			if high, err = DATA.GetKey("advanced"); err == nil {
+				_, err = provision.Advance(high + 3)
+			}
+		}
+		errs <- err
+	}()
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[int64]int)
+	for i, ids := range issued {
+		for _, id := range ids {
+			if owner, ok := seen[id]; ok {
+				t.Fatalf("id %d issued by %d and %d", id, owner, i)
+			}
+			seen[id] = i
+		}
+	}
+}
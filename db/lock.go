@@ -0,0 +1,122 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"Didgen/config"
+	log "Didgen/logger_seelog"
+)
+
+const (
+	LockFileName = "didgen.lock"
+
+	// EnvForceUnlock set to 1 takes over a lock file whose owner is gone but
+	// which is still locked, as happens with some network file systems
+	EnvForceUnlock = "DIDGEN_FORCE_UNLOCK"
+	// EnvHandoffLockFd passes the locked file to the new process of a restart
+	EnvHandoffLockFd = "DIDGEN_HANDOFF_LOCK_FD"
+)
+
+var lockFile *os.File
+
+// LockDataDir takes the exclusive lock of data_path, so no second process
+// issues ids from the same data.db. The lock file records PID and hostname.
+// Instances with shared_storage take it shared, only keeping out the
+// processes which need data.db for themselves, like the keys commands
+func LockDataDir(shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	path := filepath.Join(config.Current().DataPath, LockFileName)
+	if fdValue := os.Getenv(EnvHandoffLockFd); fdValue != "" {
+		os.Unsetenv(EnvHandoffLockFd)
+		fd, err := strconv.Atoi(fdValue)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", EnvHandoffLockFd, fdValue)
+		}
+		lockFile = os.NewFile(uintptr(fd), path)
+		return writeLockOwner(lockFile)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK && os.Getenv(EnvForceUnlock) == "1" && !lockOwnerAlive(path) {
+		log.Warn(fmt.Sprintf("Data dir lock %s held by %s, taken over because %s=1", path, lockOwner(path), EnvForceUnlock))
+		f.Close()
+		// a new file gets a new lock, the old one is left to its holder
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		if f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+			return err
+		}
+		err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	}
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return fmt.Errorf("data path %s is in use by %s, stop it first or, if that process is gone, start with %s=1", config.Current().DataPath, lockOwner(path), EnvForceUnlock)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lockFile = f
+	return writeLockOwner(f)
+}
+
+// LockFile is the locked file, for handing the lock to a new process
+func LockFile() *os.File {
+	return lockFile
+}
+
+// UnlockDataDir releases the lock, unless a new process holds it as well
+func UnlockDataDir() {
+	if lockFile != nil {
+		lockFile.Close()
+		lockFile = nil
+	}
+}
+
+func writeLockOwner(f *os.File) error {
+	hostname, _ := os.Hostname()
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), hostname)), 0)
+	return err
+}
+
+func lockOwner(path string) string {
+	data, err := ioutil.ReadFile(path)
+	owner := strings.Fields(string(data))
+	if err != nil || len(owner) != 2 {
+		return "another process"
+	}
+	return fmt.Sprintf("pid %s on %s", owner[0], owner[1])
+}
+
+// lockOwnerAlive is true when the lock owner is a running process of this
+// host, which is never taken over
+func lockOwnerAlive(path string) bool {
+	data, err := ioutil.ReadFile(path)
+	owner := strings.Fields(string(data))
+	if err != nil || len(owner) != 2 {
+		return false
+	}
+	hostname, _ := os.Hostname()
+	pid, err := strconv.Atoi(owner[0])
+	if err != nil || owner[1] != hostname {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
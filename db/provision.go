@@ -0,0 +1,82 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+
+	"Didgen/model"
+)
+
+const (
+	KeyCreate  = "create"  // declared, not in __idgen__
+	KeyAdvance = "advance" // behind its start, moved forward
+	KeyOk      = "ok"
+	KeyDrift   = "drift" // differs from the declaration and is left alone
+)
+
+// KeyChange is what reconciling the keys section does to one key
+type KeyChange struct {
+	Key    string
+	Action string
+	From   int64 // last id issued, before
+	To     int64 // and after
+	Reason string
+}
+
+// PlanKeys compares the declared keys with the last ids of __idgen__, it
+// never plans to move a key backwards
+func PlanKeys(specs []*model.KeySpec, current map[string]int64) []KeyChange {
+	changes := make([]KeyChange, 0, len(specs))
+	declared := make(map[string]bool)
+	for _, spec := range specs {
+		declared[spec.Name] = true
+		last, ok := current[spec.Name]
+		change := KeyChange{Key: spec.Name, Action: KeyOk, From: last, To: last}
+		switch {
+		case !ok:
+			change.Action, change.To = KeyCreate, spec.Initial()
+		case last < spec.Initial():
+			change.Action, change.To = KeyAdvance, spec.Initial()
+		case last > spec.Max:
+			change.Action = KeyDrift
+			change.Reason = fmt.Sprintf("%d is beyond max %d", last, spec.Max)
+		case spec.Type == model.KeyTypeSequence && last > spec.Max-spec.Step:
+			change.Action = KeyDrift
+			change.Reason = fmt.Sprintf("no id left before max %d", spec.Max)
+		}
+		changes = append(changes, change)
+	}
+
+	// without a keys section every key is managed by hand
+	if len(specs) == 0 {
+		return changes
+	}
+	undeclared := make([]string, 0)
+	for key := range current {
+		if !declared[key] {
+			undeclared = append(undeclared, key)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, key := range undeclared {
+		changes = append(changes, KeyChange{Key: key, Action: KeyDrift, From: current[key], To: current[key], Reason: "not declared in keys"})
+	}
+	return changes
+}
+
+// KeyValues returns the last id stored for every key of __idgen__
+func (d *Data) KeyValues() (map[string]int64, error) {
+	result := make(map[string]int64)
+	keys, err := d.GetKeysFromRecordTable()
+	if err != nil {
+		return result, err
+	}
+	for _, key := range keys {
+		id, err := d.GetKey(key)
+		if err != nil {
+			return result, err
+		}
+		result[key] = id
+	}
+	return result, nil
+}
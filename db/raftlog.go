@@ -0,0 +1,233 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	log "Didgen/logger_seelog"
+	"Didgen/raft"
+)
+
+const (
+	RaftStateTableName     = "__raft_state__"
+	RaftLogTableName       = "__raft_log__"
+	CreateRaftStateTableNT = `
+	CREATE TABLE IF NOT EXISTS %s (
+		k VARCHAR(255) NOT NULL,
+		v TEXT NOT NULL,
+		PRIMARY KEY (k)
+	)`
+	CreateRaftLogTableNT = `
+	CREATE TABLE IF NOT EXISTS %s (
+		idx INTEGER NOT NULL,
+		term INTEGER NOT NULL,
+		data BLOB,
+		PRIMARY KEY (idx)
+	)`
+	SelectRaftStateStmt  = "SELECT k, v FROM %s"
+	ReplaceRaftStateStmt = "REPLACE INTO %s (k, v) VALUES (?, ?)"
+	SelectRaftLogStmt    = "SELECT idx, term, data FROM %s ORDER BY idx"
+	DeleteRaftLogStmt    = "DELETE FROM %s WHERE idx >= ?"
+	CompactRaftLogStmt   = "DELETE FROM %s WHERE idx < ?"
+	InsertRaftLogStmt    = "INSERT INTO %s (idx, term, data) VALUES (?, ?, ?)"
+)
+
+// RaftLog is the log of replication raft, in data.db next to the keys, with
+// the index of the last entry applied to them. The keys are the snapshot, the
+// entries applied are compacted.
+type RaftLog struct {
+	DB *sql.DB
+}
+
+func (d *Data) RaftLog() (*RaftLog, error) {
+	for _, stmt := range []string{
+		fmt.Sprintf(CreateRaftStateTableNT, RaftStateTableName),
+		fmt.Sprintf(CreateRaftLogTableNT, RaftLogTableName),
+	} {
+		if _, err := d.DB.Exec(stmt); err != nil {
+			log.Error(fmt.Sprintf("Data.RaftLog, error: %v", err))
+			countError(err)
+			return nil, err
+		}
+	}
+	return &RaftLog{DB: d.DB}, nil
+}
+
+func (l *RaftLog) state() (map[string]string, error) {
+	rows, err := l.DB.Query(fmt.Sprintf(SelectRaftStateStmt, RaftStateTableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	state := make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err = rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		state[k] = v
+	}
+	return state, rows.Err()
+}
+
+func (l *RaftLog) InitialState() (uint64, string, []raft.Entry, error) {
+	state, err := l.state()
+	if err != nil {
+		log.Error(fmt.Sprintf("RaftLog.InitialState, error: %v", err))
+		return 0, "", nil, err
+	}
+	term, _ := strconv.ParseUint(state["term"], 10, 64)
+
+	rows, err := l.DB.Query(fmt.Sprintf(SelectRaftLogStmt, RaftLogTableName))
+	if err != nil {
+		log.Error(fmt.Sprintf("RaftLog.InitialState, error: %v", err))
+		return 0, "", nil, err
+	}
+	defer rows.Close()
+	entries := make([]raft.Entry, 0)
+	for rows.Next() {
+		var entry raft.Entry
+		if err = rows.Scan(&entry.Index, &entry.Term, &entry.Data); err != nil {
+			return 0, "", nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return term, state["vote"], entries, rows.Err()
+}
+
+func (l *RaftLog) SaveState(term uint64, vote string) error {
+	return l.save(map[string]string{"term": strconv.FormatUint(term, 10), "vote": vote})
+}
+
+// Applied is the index of the last entry applied to the keys
+func (l *RaftLog) Applied() (uint64, error) {
+	state, err := l.state()
+	if err != nil {
+		return 0, err
+	}
+	applied, _ := strconv.ParseUint(state["applied"], 10, 64)
+	return applied, nil
+}
+
+func (l *RaftLog) SetApplied(index uint64) error {
+	return l.save(map[string]string{"applied": strconv.FormatUint(index, 10)})
+}
+
+func (l *RaftLog) save(values map[string]string) error {
+	tx, err := l.DB.Begin()
+	if err != nil {
+		countError(err)
+		return err
+	}
+	defer tx.Rollback()
+	for k, v := range values {
+		if _, err = tx.Exec(fmt.Sprintf(ReplaceRaftStateStmt, RaftStateTableName), k, v); err != nil {
+			log.Error(fmt.Sprintf("RaftLog.save('%s'), error: %v", k, err))
+			countError(err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Compact drops the entries before index, applied to the keys
+func (l *RaftLog) Compact(index uint64) error {
+	if _, err := l.DB.Exec(fmt.Sprintf(CompactRaftLogStmt, RaftLogTableName), index); err != nil {
+		log.Error(fmt.Sprintf("RaftLog.Compact(%d), error: %v", index, err))
+		countError(err)
+		return err
+	}
+	return nil
+}
+
+// Reset replaces the log with the last entry of a snapshot, applied to the
+// keys already
+func (l *RaftLog) Reset(index, term uint64) error {
+	tx, err := l.DB.Begin()
+	if err != nil {
+		countError(err)
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(fmt.Sprintf(DeleteRaftLogStmt, RaftLogTableName), 0); err != nil {
+		log.Error(fmt.Sprintf("RaftLog.Reset, error: %v", err))
+		countError(err)
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(InsertRaftLogStmt, RaftLogTableName), index, term, nil); err != nil {
+		log.Error(fmt.Sprintf("RaftLog.Reset(%d), error: %v", index, err))
+		countError(err)
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(ReplaceRaftStateStmt, RaftStateTableName), "applied", strconv.FormatUint(index, 10)); err != nil {
+		log.Error(fmt.Sprintf("RaftLog.Reset('applied'), error: %v", err))
+		countError(err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (l *RaftLog) Append(entries []raft.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tx, err := l.DB.Begin()
+	if err != nil {
+		countError(err)
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(fmt.Sprintf(DeleteRaftLogStmt, RaftLogTableName), entries[0].Index); err != nil {
+		log.Error(fmt.Sprintf("RaftLog.Append, error: %v", err))
+		countError(err)
+		return err
+	}
+	for _, entry := range entries {
+		if _, err = tx.Exec(fmt.Sprintf(InsertRaftLogStmt, RaftLogTableName), entry.Index, entry.Term, entry.Data); err != nil {
+			log.Error(fmt.Sprintf("RaftLog.Append(%d), error: %v", entry.Index, err))
+			countError(err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ApplyCommand applies a committed command to the keys of data.db, applying
+// it twice leaves them the same, so a crash before SetApplied does no harm
+func (d *Data) ApplyCommand(c *raft.Command) error {
+	if c.Op == raft.OpDel {
+		if err := d.DeleteKeyTable(c.Key); err != nil {
+			return err
+		}
+		return d.DeleteKeyFromRecordTable(c.Key)
+	}
+	if c.Op == raft.OpReserve {
+		// a batch of a key deleted since is not created again
+		var count int
+		if err := d.DB.QueryRow(fmt.Sprintf(GetKeysStmt, d.FmtKey(c.Key))).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return raft.ErrConflict
+		}
+	}
+	if err := d.CreateKeyTable(c.Key); err != nil {
+		return err
+	}
+	if err := d.AddKeyToRecordTable(c.Key); err != nil {
+		return err
+	}
+	current, err := d.GetKey(c.Key)
+	if err != nil {
+		return err
+	}
+	state := raft.Sequences{c.Key: current}
+	if err = state.Apply(c); err != nil {
+		return err
+	}
+	if state[c.Key] == current {
+		return nil
+	}
+	return d.ResetKeyTable(c.Key, state[c.Key])
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"testing"
+
+	"Didgen/raft"
+)
+
+// a compacted log starts with the last entry compacted, a reset one with the
+// entry of the snapshot, and a Node starts from either
+func TestRaftLogCompact(t *testing.T) {
+	setupData(t, nil)
+	l, err := DATA.RaftLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]raft.Entry, 0)
+	for i := uint64(1); i <= 10; i++ {
+		entries = append(entries, raft.Entry{Index: i, Term: 1, Data: []byte("x")})
+	}
+	if err = l.Append(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.SetApplied(8); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Compact(6); err != nil {
+		t.Fatal(err)
+	}
+	_, _, got, err := l.InitialState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 5 || got[0].Index != 6 || got[4].Index != 10 {
+		t.Fatalf("log after compacting at 6: %v", got)
+	}
+	node, err := raft.NewNode(raft.Config{Id: "a", Peers: []string{"a"}, ElectionTicks: 10, HeartbeatTicks: 2, Storage: raftLogStorage{l}, Applied: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := node.Status(); status.LastIndex != 10 || status.Applied != 8 {
+		t.Errorf("node on the compacted log: %+v", status)
+	}
+
+	if err = l.Reset(20, 3); err != nil {
+		t.Fatal(err)
+	}
+	_, _, got, err = l.InitialState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Index != 20 || got[0].Term != 3 {
+		t.Errorf("log after a reset at 20: %v", got)
+	}
+	if applied, err := l.Applied(); err != nil || applied != 20 {
+		t.Errorf("applied %d after a reset at 20: %v", applied, err)
+	}
+	node, err = raft.NewNode(raft.Config{Id: "a", Peers: []string{"a"}, ElectionTicks: 10, HeartbeatTicks: 2, Storage: raftLogStorage{l}, Applied: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := node.Status(); status.LastIndex != 20 || status.Applied != 20 {
+		t.Errorf("node on the reset log: %+v", status)
+	}
+}
+
+// raftLogStorage is a RaftLog without keys to snapshot
+type raftLogStorage struct {
+	*RaftLog
+}
+
+func (raftLogStorage) Snapshot() ([]byte, error) {
+	return []byte("{}"), nil
+}
+
+func (raftLogStorage) Restore(snapshot raft.Snapshot) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"fmt"
+
+	"Didgen/cluster"
+	log "Didgen/logger_seelog"
+)
+
+const (
+	SlotsTableName     = "__slots__"
+	CreateSlotsTableNT = `
+	CREATE TABLE IF NOT EXISTS %s (
+		slot INTEGER NOT NULL,
+		node VARCHAR(255) NOT NULL,
+		epoch INTEGER NOT NULL,
+		PRIMARY KEY (slot)
+	)`
+	SelectSlotsStmt  = "SELECT slot, node, epoch FROM %s ORDER BY slot"
+	ReplaceSlotsStmt = "REPLACE INTO %s (slot, node, epoch) VALUES (?, ?, ?)"
+)
+
+// MovedSlots are the slots moved away from the node nodes assigns them to,
+// the rest of the map follows from the config
+func (d *Data) MovedSlots() ([]cluster.SlotOwner, error) {
+	moved := make([]cluster.SlotOwner, 0)
+	var count int
+	if err := d.DB.QueryRow(fmt.Sprintf(GetKeysStmt, SlotsTableName)).Scan(&count); err != nil {
+		log.Error(fmt.Sprintf("Data.MovedSlots, error: %v", err))
+		countError(err)
+		return nil, err
+	}
+	if count == 0 {
+		// no slot moved yet, SaveSlots creates the table
+		return moved, nil
+	}
+	rows, err := d.DB.Query(fmt.Sprintf(SelectSlotsStmt, SlotsTableName))
+	if err != nil {
+		log.Error(fmt.Sprintf("Data.MovedSlots, error: %v", err))
+		countError(err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o cluster.SlotOwner
+		if err = rows.Scan(&o.Slot, &o.Node, &o.Epoch); err != nil {
+			countError(err)
+			return nil, err
+		}
+		moved = append(moved, o)
+	}
+	return moved, rows.Err()
+}
+
+func (d *Data) SaveSlots(moved []cluster.SlotOwner) error {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		countError(err)
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(fmt.Sprintf(CreateSlotsTableNT, SlotsTableName)); err != nil {
+		log.Error(fmt.Sprintf("Data.SaveSlots, error: %v", err))
+		countError(err)
+		return err
+	}
+	for _, o := range moved {
+		if _, err = tx.Exec(fmt.Sprintf(ReplaceSlotsStmt, SlotsTableName), o.Slot, o.Node, o.Epoch); err != nil {
+			log.Error(fmt.Sprintf("Data.SaveSlots(%d), error: %v", o.Slot, err))
+			countError(err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counters of the storage layer, reported by INFO
+var Stats = new(StorageStats)
+
+type StorageStats struct {
+	Refills          int64 // segments taken from data.db
+	RefillTimeUsec   int64 // total time spent on refills
+	RefillMaxUsec    int64
+	RefillLastUsec   int64
+	RefillConflicts  int64 // refills which lost the compare and swap to another writer
+	SqliteErrors     int64
+	LastSqliteError  atomic.Value // string
+	LastSqliteErrorT int64        // unix time of the last error
+}
+
+func (s *StorageStats) recordRefill(start time.Time) {
+	usec := int64(time.Since(start) / time.Microsecond)
+	atomic.AddInt64(&s.Refills, 1)
+	atomic.AddInt64(&s.RefillTimeUsec, usec)
+	atomic.StoreInt64(&s.RefillLastUsec, usec)
+	for {
+		max := atomic.LoadInt64(&s.RefillMaxUsec)
+		if usec <= max || atomic.CompareAndSwapInt64(&s.RefillMaxUsec, max, usec) {
+			break
+		}
+	}
+}
+
+func (s *StorageStats) ResetStats() {
+	atomic.StoreInt64(&s.Refills, 0)
+	atomic.StoreInt64(&s.RefillTimeUsec, 0)
+	atomic.StoreInt64(&s.RefillMaxUsec, 0)
+	atomic.StoreInt64(&s.RefillLastUsec, 0)
+	atomic.StoreInt64(&s.RefillConflicts, 0)
+	atomic.StoreInt64(&s.SqliteErrors, 0)
+}
+
+// countError records a failed sqlite call, a missing row is not a failure
+func countError(err error) {
+	if err == nil || err == sql.ErrNoRows {
+		return
+	}
+	atomic.AddInt64(&Stats.SqliteErrors, 1)
+	Stats.LastSqliteError.Store(err.Error())
+	atomic.StoreInt64(&Stats.LastSqliteErrorT, time.Now().Unix())
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+
+	log "Didgen/logger_seelog"
+)
+
+const (
+	UsersTableName         = "__users__"
+	CreateUsersTableNTStmt = `
+	CREATE TABLE IF NOT EXISTS %s (
+		name Text NOT NULL,
+		password Text,
+		commands Text,
+		keys Text,
+		enabled Integer,
+		PRIMARY KEY (name)
+	)`
+	ReplaceUserStmt = `INSERT OR REPLACE INTO %s (name, password, commands, keys, enabled) VALUES (?, ?, ?, ?, ?)`
+	SelectUsersStmt = `SELECT name, password, commands, keys, enabled FROM %s`
+	DeleteUserStmt  = `DELETE FROM %s WHERE name = ?`
+)
+
+// users added with ACL SETUSER, they take precedence over users with the same
+// name in configuration.yml
+
+func (c *Config) CreateUsersTable() error {
+	sqlStmt := fmt.Sprintf(CreateUsersTableNTStmt, UsersTableName)
+	_, err := c.DB.Exec(sqlStmt)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.CreateUsersTable, error: %v", err))
+		countError(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Config) GetUsers() ([]map[string]string, error) {
+	result := make([]map[string]string, 0)
+	sqlStmt := fmt.Sprintf(SelectUsersStmt, UsersTableName)
+	rows, err := c.DB.Query(sqlStmt)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.GetUsers, error: %v", err))
+		countError(err)
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, password, commands, keys string
+		var enabled int
+		err = rows.Scan(&name, &password, &commands, &keys, &enabled)
+		if err != nil {
+			log.Error(fmt.Sprintf("Config.GetUsers, row error: %v", err))
+			countError(err)
+			return result, err
+		}
+		user := map[string]string{
+			"name":     name,
+			"password": password,
+			"commands": commands,
+			"keys":     keys,
+			"enabled":  "on",
+		}
+		if enabled == 0 {
+			user["enabled"] = "off"
+		}
+		result = append(result, user)
+	}
+	return result, nil
+}
+
+func (c *Config) SetUser(user map[string]string) error {
+	enabled := 1
+	if user["enabled"] == "off" {
+		enabled = 0
+	}
+	sqlStmt := fmt.Sprintf(ReplaceUserStmt, UsersTableName)
+	_, err := c.DB.Exec(sqlStmt, user["name"], user["password"], user["commands"], user["keys"], enabled)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.SetUser('%s'), error: %v", user["name"], err))
+		countError(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Config) DeleteUser(name string) error {
+	sqlStmt := fmt.Sprintf(DeleteUserStmt, UsersTableName)
+	_, err := c.DB.Exec(sqlStmt, name)
+	if err != nil {
+		log.Error(fmt.Sprintf("Config.DeleteUser('%s'), error: %v", name, err))
+		countError(err)
+		return err
+	}
+	return nil
+}
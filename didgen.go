@@ -1,82 +1,226 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	"Didgen/config"
 	"Didgen/db"
 	log "Didgen/logger_seelog"
 	"Didgen/server"
+	"Didgen/systemd"
 	_ "net/http/pprof"
 )
 
-func init() {
-	configPath := "./configuration.yml"
-
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		fmt.Printf("Init Config error: (%s) does not exist!\n", configPath)
-		os.Exit(1)
-	} else {
-		err = config.Init(configPath)
-		if err != nil {
-			fmt.Printf("Init Config failed: (%s), error: %v!\n", configPath, err)
-			os.Exit(1)
+const defaultConfigPath = "./configuration.yml"
+
+func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		os.Exit(serve(args))
+	case "version":
+		fmt.Printf("Didgen %s (%s %s/%s)\n", server.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	case "check-config":
+		os.Exit(checkConfig(args))
+	case "keys":
+		os.Exit(keys(args))
+	case "config":
+		os.Exit(configHistory(args))
+	case "plan":
+		os.Exit(plan(args))
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: didgen <command> [--config path] [arguments]
+
+Commands:
+  serve                      run the server, the default command
+  version                    print the version
+  check-config               validate the config and print the effective values
+  keys list                  list the keys and their last issued id
+  keys get <key>             print the last issued id of a key
+  keys set <key> <value>     create a key or reset it, the next id is value+1
+  keys del <key>             delete a key
+  plan                       show what the keys section would change in data.db
+  config history [count]     list the config changes of the last count revisions
+  config rollback <revision> set the keys changed since revision back
+
+The keys commands refuse to run while a server uses the data path.
+`)
+}
+
+// loadConfig reads the config file of the --config flag
+func loadConfig(name string, args []string) (*flag.FlagSet, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of configuration.yml")
+	flags.Usage = usage
+	if err := flags.Parse(args); err != nil {
+		return flags, err
+	}
+	explicit := false
+	flags.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "config"
+	})
+	if _, err := os.Stat(*configPath); os.IsNotExist(err) {
+		if explicit {
+			return flags, fmt.Errorf("Init Config error: (%s) does not exist!", *configPath)
 		}
+		// without a config file the defaults and DIDGEN_* variables are used
+		*configPath = ""
+	}
+	if err := config.Init(*configPath); err != nil {
+		return flags, fmt.Errorf("Init Config failed: (%s), error: %v", *configPath, err)
+	}
+	return flags, nil
+}
+
+func initServe(args []string) error {
+	if _, err := loadConfig("serve", args); err != nil {
+		return err
 	}
 
-	_, err := log.NewLogger("main", config.Config.LogPath, "didgen.log", config.Config.LogLevel, "size", "20971520", "5", true)
+	_, err := log.NewLogger("main", config.Current().LogPath, "didgen.log", config.Current().LogLevel, "size", "20971520", "5", true)
 	if err != nil {
-		fmt.Printf(fmt.Sprintf("Init logger error: %s\n", err))
-		os.Exit(1)
+		return fmt.Errorf("Init logger error: %s", err)
 	}
 
+	err = db.LockDataDir(config.Current().SharedStorage == "yes")
+	if err != nil {
+		log.Error(fmt.Sprintf("Lock data path error: %v", err))
+		log.CloseAll()
+		return err
+	}
 	db.InitConfig()
 
-	threads := runtime.GOMAXPROCS(config.Config.Threads)
+	threads := runtime.GOMAXPROCS(config.Current().Threads)
 	log.Info(fmt.Sprintf("Server with threads: %d", threads))
-	log.Info(fmt.Sprintf("Server config path: %s", configPath))
-	log.Info(fmt.Sprintf("Server log path: %s", config.Config.LogPath))
-	log.Info(fmt.Sprintf("Server log level: %s", config.Config.LogLevel))
-	log.Info(fmt.Sprintf("Server host: %s", config.Config.ServerHost))
-	log.Info(fmt.Sprintf("Server port: %s", config.Config.ServerPort))
-	log.Info(fmt.Sprintf("Server data path: %s", config.Config.DataPath))
-	log.Info(fmt.Sprintf("Server batch_size: %d", config.Config.BatchSize))
-	log.Info(fmt.Sprintf("Server nodes: %v", config.Config.Nodes))
+	log.Info(fmt.Sprintf("Server config path: %s", config.ConfigPath))
+	log.Info(fmt.Sprintf("Server log path: %s", config.Current().LogPath))
+	log.Info(fmt.Sprintf("Server log level: %s", config.Current().LogLevel))
+	log.Info(fmt.Sprintf("Server host: %s", config.Current().ServerHost))
+	log.Info(fmt.Sprintf("Server port: %s", config.Current().ServerPort))
+	log.Info(fmt.Sprintf("Server data path: %s", config.Current().DataPath))
+	log.Info(fmt.Sprintf("Server batch_size: %d", config.Current().BatchSize))
+	log.Info(fmt.Sprintf("Server nodes: %v", config.Current().Nodes))
+	return nil
 }
 
-func main() {
+func serve(args []string) int {
+	if err := initServe(args); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Println(err)
+		}
+		return 1
+	}
+
 	log.Info("Start Service")
 	db.InitData()
 	var s *server.Server
-	s, err := server.NewServer(config.Config.ServerHost, config.Config.ServerPort)
+	s, err := server.NewServer(config.Current().ServerHost, config.Current().ServerPort)
 	if err != nil {
 		log.Error(fmt.Sprintf("Create Server, error: %v", err))
-		s.Close()
-		os.Exit(1)
+		log.CloseAll()
+		return 1
 	}
 
 	err = s.Init()
 	if err != nil {
 		log.Error(fmt.Sprintf("Init Server error: %v", err))
 		s.Close()
-		os.Exit(1)
+		log.CloseAll()
+		return 1
 	}
 
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	// SIGHUP reloads configuration.yml
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	// SIGUSR2 restarts the binary without closing the listeners
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, syscall.SIGUSR2)
 
+	// systemd learns the new main pid on a restart, NotifyAccess=all is needed
+	// for the restarted process to be heard
+	if _, err := systemd.Notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		log.Error(fmt.Sprintf("systemd notify error: %v", err))
+	}
+	if systemd.Watchdog(func() bool { return ctx.Err() == nil }) {
+		log.Info(fmt.Sprintf("systemd watchdog every %v", systemd.WatchdogInterval()/2))
+	}
+
+	var handoff *server.Handoff
+	shutdown := make(chan error, 1)
 	go func() {
-		sig := <-sc
-		log.Info(fmt.Sprintf("Got signal: %v", sig))
-		s.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				log.Info("Got signal, shutting down")
+				systemd.Notify("STOPPING=1")
+			case <-reload:
+				log.Info("Got signal, reloading configuration")
+				systemd.Notify("RELOADING=1")
+				s.Reload()
+				systemd.Notify("READY=1")
+				continue
+			case <-restart:
+				log.Info("Got signal, restarting")
+				h, err := s.Handoff()
+				if err != nil {
+					log.Error(fmt.Sprintf("Restart Server error: %v", err))
+					continue
+				}
+				systemd.Notify(fmt.Sprintf("MAINPID=%d", h.Pid()))
+				handoff = h
+			}
+			break
+		}
+		stop()
+		signal.Stop(restart)
+		signal.Stop(reload)
+		timeout := time.Duration(config.Current().ShutdownTimeout) * time.Second
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		shutdown <- s.Shutdown(shutdownCtx)
 	}()
 	log.Info(fmt.Sprintf("Server running!"))
 	s.Serve()
 
+	code := 0
+	if err := <-shutdown; err != nil {
+		log.Error(fmt.Sprintf("Shutdown Server error: %v", err))
+		code = 1
+	}
+	db.Close()
+	if handoff != nil {
+		if err := handoff.Release(); err != nil {
+			log.Error(fmt.Sprintf("Restart Server release error: %v", err))
+		}
+	}
+	db.UnlockDataDir()
 	log.Info("Close Service")
-	os.Exit(0)
+	log.CloseAll()
+	return code
 }
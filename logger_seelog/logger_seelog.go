@@ -34,6 +34,7 @@ var Log seelog.LoggerInterface
 var Logger *seelog.LoggerInterface
 var Loggers map[string]*seelog.LoggerInterface
 var Level map[string]string
+var loggerConfigs map[string]string
 
 func init() {
 	Level = make(map[string]string)
@@ -79,6 +80,7 @@ func Errorf(format string, params ...interface{}) {
 }
 
 func DisableLog() {
+	Log = seelog.Disabled
 	Logger = &seelog.Disabled
 }
 
@@ -116,6 +118,7 @@ func enableRolling(config, rolling_type, file_path, max_size, max_rolls string)
 func NewLogger(log_name, log_path, log_file, log_level, rolling_type, max_size, max_rolls string, console bool) (*seelog.LoggerInterface, error) {
 	if Loggers == nil {
 		Loggers = make(map[string]*seelog.LoggerInterface)
+		loggerConfigs = make(map[string]string)
 		fmt.Printf("make Loggers success\n")
 	}
 
@@ -132,11 +135,13 @@ func NewLogger(log_name, log_path, log_file, log_level, rolling_type, max_size,
 	}
 
 	file_path := filepath.Join(log_path, log_file)
-	Config := setLevel(ConfigTemp, log_level)
+	Config := ConfigTemp
 	if console {
 		Config = enableConsole(Config, console)
 	}
 	Config = enableRolling(Config, rolling_type, file_path, max_size, max_rolls)
+	loggerConfigs[log_name] = Config
+	Config = setLevel(Config, log_level)
 
 	logger, _ := seelog.LoggerFromConfigAsBytes([]byte(Config))
 	logger.Info("Init logger success")
@@ -147,6 +152,28 @@ func NewLogger(log_name, log_path, log_file, log_level, rolling_type, max_size,
 	return &logger, nil
 }
 
+// SetLevel replaces a logger by one with the same outputs and a new level
+func SetLevel(log_name, log_level string) error {
+	config, ok := loggerConfigs[log_name]
+	if !ok {
+		return errors.New(fmt.Sprintf("Logger(\"%s\") does not exist!", log_name))
+	}
+	if _, ok = Level[log_level]; !ok {
+		return errors.New(fmt.Sprintf("Log level \"%s\" does not exist!", log_level))
+	}
+	logger, err := seelog.LoggerFromConfigAsBytes([]byte(setLevel(config, log_level)))
+	if err != nil {
+		return err
+	}
+	old := Loggers[log_name]
+	Loggers[log_name] = &logger
+	if Log == *old {
+		Log = logger
+	}
+	(*old).Close()
+	return nil
+}
+
 func GetLogger(log_name string) (*seelog.LoggerInterface, error) {
 	if logger, ok := Loggers[log_name]; ok {
 		// seelog.UseLogger(*logger)
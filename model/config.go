@@ -14,11 +14,34 @@ type ServerConfig struct {
 	TransPort             string
 	ServerId              int
 	Nodes                 []map[string]string
+	ClusterSecret         string
 	HeartbeatTimeOut      int
 	HeartbeatTimeInterval int
+	Replication           string
+	ElectionTimeout       int
+	ReplicaOf             string
+	PromoteMargin         int64
+	Redirect              string
+	ClusterEnabled        string
+	SentinelMasterName    string
 	Threads               int
 	DataPath              string
 	BatchSize             int64
+	SharedStorage         string
+	Users                 []map[string]string
+	Keys                  []map[string]string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSCACertFile         string
+	TLSAuthClients        string
+	UnixSocket            string
+	UnixSocketPerm        uint32
+	MaxClients            int
+	MaxRequestArgs        int
+	MaxBulkLength         int
+	IdleTimeout           int
+	ReadTimeout           int
+	ShutdownTimeout       int
 }
 
 func (c *ServerConfig) Get(key string) (string, error) {
@@ -38,21 +61,166 @@ func (c *ServerConfig) Get(key string) (string, error) {
 	case "nodes":
 		nodes, _ := json.MarshalIndent(c.Nodes, "", "    ")
 		return string(nodes), nil
+	case "keys":
+		keys, _ := json.MarshalIndent(c.Keys, "", "    ")
+		return string(keys), nil
 	case "heartbeat_time_out":
 		return strconv.FormatInt(int64(c.HeartbeatTimeOut), 10), nil
 	case "heartbeat_time_interval":
 		return strconv.FormatInt(int64(c.HeartbeatTimeInterval), 10), nil
+	case "replication":
+		return c.Replication, nil
+	case "election_timeout":
+		return strconv.Itoa(c.ElectionTimeout), nil
+	case "replicaof":
+		return c.ReplicaOf, nil
+	case "promote_margin":
+		return strconv.FormatInt(c.PromoteMargin, 10), nil
+	case "redirect":
+		return c.Redirect, nil
+	case "cluster_enabled":
+		return c.ClusterEnabled, nil
+	case "sentinel_master_name":
+		return c.SentinelMasterName, nil
+	case "cluster_secret":
+		return c.ClusterSecret, nil
 	case "threads":
 		return strconv.FormatInt(int64(c.Threads), 10), nil
 	case "data_path":
 		return c.DataPath, nil
 	case "batch_size":
 		return strconv.FormatInt(c.BatchSize, 10), nil
+	case "shared_storage":
+		return c.SharedStorage, nil
+	case "unix_socket":
+		return c.UnixSocket, nil
+	case "unix_socket_perm":
+		return strconv.FormatUint(uint64(c.UnixSocketPerm), 8), nil
+	case "max_clients":
+		return strconv.Itoa(c.MaxClients), nil
+	case "max_request_args":
+		return strconv.Itoa(c.MaxRequestArgs), nil
+	case "max_bulk_length":
+		return strconv.Itoa(c.MaxBulkLength), nil
+	case "idle_timeout":
+		return strconv.Itoa(c.IdleTimeout), nil
+	case "read_timeout":
+		return strconv.Itoa(c.ReadTimeout), nil
+	case "shutdown_timeout":
+		return strconv.Itoa(c.ShutdownTimeout), nil
+	case "tls_cert_file":
+		return c.TLSCertFile, nil
+	case "tls_key_file":
+		return c.TLSKeyFile, nil
+	case "tls_ca_cert_file":
+		return c.TLSCACertFile, nil
+	case "tls_auth_clients":
+		return c.TLSAuthClients, nil
 	default:
 		return "", fmt.Errorf("cfg.key not found!")
 	}
 }
 
+// Set assigns a value in the format of Get, the value is validated by the
+// config schema before
+func (c *ServerConfig) Set(key, value string) error {
+	var err error
+	var number int64
+	switch key {
+	case "log_level":
+		c.LogLevel = value
+	case "log_path":
+		c.LogPath = value
+	case "server_host":
+		c.ServerHost = value
+	case "server_port":
+		c.ServerPort = value
+	case "trans_port":
+		c.TransPort = value
+	case "data_path":
+		c.DataPath = value
+	case "unix_socket":
+		c.UnixSocket = value
+	case "tls_cert_file":
+		c.TLSCertFile = value
+	case "tls_key_file":
+		c.TLSKeyFile = value
+	case "tls_ca_cert_file":
+		c.TLSCACertFile = value
+	case "tls_auth_clients":
+		c.TLSAuthClients = value
+	case "replication":
+		c.Replication = value
+	case "replicaof":
+		c.ReplicaOf = value
+	case "redirect":
+		c.Redirect = value
+	case "cluster_enabled":
+		c.ClusterEnabled = value
+	case "sentinel_master_name":
+		c.SentinelMasterName = value
+	case "cluster_secret":
+		c.ClusterSecret = value
+	case "shared_storage":
+		c.SharedStorage = value
+	case "nodes":
+		nodes := make([]map[string]string, 0)
+		if err = json.Unmarshal([]byte(value), &nodes); err == nil {
+			c.Nodes = nodes
+		}
+	case "users":
+		users := make([]map[string]string, 0)
+		if err = json.Unmarshal([]byte(value), &users); err == nil {
+			c.Users = users
+		}
+	case "keys":
+		keys := make([]map[string]string, 0)
+		if err = json.Unmarshal([]byte(value), &keys); err == nil {
+			c.Keys = keys
+		}
+	case "unix_socket_perm":
+		if number, err = strconv.ParseInt(value, 8, 32); err == nil {
+			c.UnixSocketPerm = uint32(number)
+		}
+	default:
+		number, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			break
+		}
+		switch key {
+		case "server_id":
+			c.ServerId = int(number)
+		case "heartbeat_time_out":
+			c.HeartbeatTimeOut = int(number)
+		case "heartbeat_time_interval":
+			c.HeartbeatTimeInterval = int(number)
+		case "election_timeout":
+			c.ElectionTimeout = int(number)
+		case "promote_margin":
+			c.PromoteMargin = number
+		case "threads":
+			c.Threads = int(number)
+		case "batch_size":
+			c.BatchSize = number
+		case "max_clients":
+			c.MaxClients = int(number)
+		case "max_request_args":
+			c.MaxRequestArgs = int(number)
+		case "max_bulk_length":
+			c.MaxBulkLength = int(number)
+		case "idle_timeout":
+			c.IdleTimeout = int(number)
+		case "read_timeout":
+			c.ReadTimeout = int(number)
+		case "shutdown_timeout":
+			c.ShutdownTimeout = int(number)
+		default:
+			return fmt.Errorf("cfg.key not found!")
+		}
+	}
+	return err
+}
+
 type ServerConfigDB struct {
 	LogLevel              string
 	LogPath               string
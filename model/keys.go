@@ -0,0 +1,102 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	KeyTypeSequence = "sequence" // stops at max
+	KeyTypeCycle    = "cycle"    // starts over at min after max
+)
+
+// KeySpec is a key declared in the keys section of configuration.yml, the
+// first id is Start and every next one is Step more, within [Min, Max]
+type KeySpec struct {
+	Name      string
+	Type      string
+	Start     int64
+	Step      int64
+	Min       int64
+	Max       int64
+	BatchSize int64 // 0 uses batch_size
+}
+
+// ParseKeySpec reads a key of the keys section, only name is required
+func ParseKeySpec(key map[string]string) (*KeySpec, error) {
+	spec := &KeySpec{
+		Name: key["name"],
+		Type: KeyTypeSequence,
+		Step: 1,
+		Max:  math.MaxInt64,
+	}
+	if spec.Name == "" {
+		return nil, fmt.Errorf("name is missing")
+	}
+	if key["type"] != "" {
+		spec.Type = key["type"]
+	}
+	if spec.Type != KeyTypeSequence && spec.Type != KeyTypeCycle {
+		return nil, fmt.Errorf("type '%s' is not one of %s, %s", spec.Type, KeyTypeSequence, KeyTypeCycle)
+	}
+
+	numbers := []struct {
+		name   string
+		target *int64
+	}{
+		{"start", &spec.Start},
+		{"step", &spec.Step},
+		{"min", &spec.Min},
+		{"max", &spec.Max},
+		{"batch_size", &spec.BatchSize},
+	}
+	spec.Start = 1
+	for _, n := range numbers {
+		value, ok := key[n.name]
+		if !ok || value == "" {
+			continue
+		}
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s '%s' is not an integer", n.name, value)
+		}
+		*n.target = number
+	}
+	if _, ok := key["min"]; !ok {
+		spec.Min = spec.Start
+	}
+
+	if spec.Step < 1 {
+		return nil, fmt.Errorf("step %d must be at least 1", spec.Step)
+	}
+	if spec.BatchSize < 0 {
+		return nil, fmt.Errorf("batch_size %d must not be negative", spec.BatchSize)
+	}
+	if spec.Min > spec.Max {
+		return nil, fmt.Errorf("min %d is greater than max %d", spec.Min, spec.Max)
+	}
+	if spec.Start < spec.Min || spec.Start > spec.Max {
+		return nil, fmt.Errorf("start %d is out of [%d, %d]", spec.Start, spec.Min, spec.Max)
+	}
+	if spec.Start < math.MinInt64+spec.Step {
+		return nil, fmt.Errorf("start %d leaves no room before the first id", spec.Start)
+	}
+	return spec, nil
+}
+
+// Initial is the value stored for a new key, the last id issued before Start
+func (k *KeySpec) Initial() int64 {
+	return k.Start - k.Step
+}
+
+// KeySpecs parses the keys section, it is validated by the config schema before
+func (c *ServerConfig) KeySpecs() []*KeySpec {
+	specs := make([]*KeySpec, 0, len(c.Keys))
+	for _, key := range c.Keys {
+		if spec, err := ParseKeySpec(key); err == nil {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
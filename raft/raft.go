@@ -0,0 +1,606 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Node is the raft state machine of one member. It does no io and keeps no
+// time: the owner calls Tick at a fixed interval, passes the messages of the
+// peers to Step, sends what ReadMessages returns and applies what
+// ReadCommitted returns, so it runs the same on a network and in Simulation.
+// It implements leader election, log replication, check quorum and log
+// compaction, membership is fixed. The applied entries but the last
+// KeepEntries are compacted, a follower missing some of them gets a snapshot
+// of the state from the Storage of the leader instead.
+
+const (
+	StateFollower  = "follower"
+	StateCandidate = "candidate"
+	StateLeader    = "leader"
+
+	MsgVote       = "vote"
+	MsgVoteResp   = "vote_resp"
+	MsgAppend     = "append"
+	MsgAppendResp = "append_resp"
+	MsgSnapshot   = "snapshot"
+
+	maxAppendEntries = 64
+)
+
+var ErrNotLeader = errors.New("not the leader")
+
+// Entry is a record of the log, an empty Data is the entry a new leader
+// appends to commit the entries of its predecessors
+type Entry struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// Snapshot is the state of the entries applied up to Index
+type Snapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+type Message struct {
+	Type     string    `json:"type"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Term     uint64    `json:"term"`
+	LogTerm  uint64    `json:"log_term"` // vote: of the last entry, append: of the entry before Entries
+	Index    uint64    `json:"index"`    // the same for the index
+	Entries  []Entry   `json:"entries,omitempty"`
+	Commit   uint64    `json:"commit"`
+	Reject   bool      `json:"reject,omitempty"`
+	Hint     uint64    `json:"hint,omitempty"` // last index of a follower rejecting an append
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+}
+
+// Storage keeps the term, the vote and the log across restarts, a Node saves
+// before it sends the messages depending on it. After a compaction the first
+// entry of the log is the last one compacted.
+type Storage interface {
+	InitialState() (term uint64, vote string, entries []Entry, err error)
+	SaveState(term uint64, vote string) error
+	// Append replaces the entries from entries[0].Index on
+	Append(entries []Entry) error
+	// Compact drops the entries before index, they are applied
+	Compact(index uint64) error
+	// Snapshot returns the state of the entries ReadCommitted returned so far
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with the snapshot and the log with an entry
+	// of its index and term, the index is applied
+	Restore(snapshot Snapshot) error
+}
+
+type Config struct {
+	Id             string
+	Peers          []string // every member, this one included
+	ElectionTicks  int      // a follower campaigns after between this and twice this ticks
+	HeartbeatTicks int
+	Storage        Storage
+	Applied        uint64 // last entry applied before a restart
+	KeepEntries    int    // applied entries kept for the followers a little behind, 0 never compacts
+	Rand           *rand.Rand
+}
+
+type Status struct {
+	Id        string
+	State     string
+	Term      uint64
+	Leader    string
+	Commit    uint64
+	Applied   uint64
+	LastIndex uint64
+}
+
+type Node struct {
+	id      string
+	peers   []string
+	state   string
+	term    uint64
+	vote    string
+	leader  string
+	log     []Entry // log[0] is the last entry compacted, or a placeholder for index 0
+	commit  uint64
+	applied uint64
+
+	electionTicks    int
+	heartbeatTicks   int
+	keepEntries      int
+	electionElapsed  int
+	heartbeatElapsed int
+	electionTimeout  int
+
+	votes        map[string]bool
+	next         map[string]uint64
+	match        map[string]uint64
+	recentActive map[string]bool
+
+	msgs    []Message
+	storage Storage
+	rand    *rand.Rand
+}
+
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ElectionTicks <= cfg.HeartbeatTicks || cfg.HeartbeatTicks < 1 {
+		return nil, fmt.Errorf("election ticks %d must be greater than heartbeat ticks %d", cfg.ElectionTicks, cfg.HeartbeatTicks)
+	}
+	found := false
+	for _, peer := range cfg.Peers {
+		found = found || peer == cfg.Id
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not one of the peers %v", cfg.Id, cfg.Peers)
+	}
+	term, vote, entries, err := cfg.Storage.InitialState()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		id:             cfg.Id,
+		peers:          append([]string(nil), cfg.Peers...),
+		term:           term,
+		vote:           vote,
+		log:            append([]Entry{{}}, entries...),
+		electionTicks:  cfg.ElectionTicks,
+		heartbeatTicks: cfg.HeartbeatTicks,
+		keepEntries:    cfg.KeepEntries,
+		storage:        cfg.Storage,
+		rand:           cfg.Rand,
+	}
+	if n.rand == nil {
+		n.rand = rand.New(rand.NewSource(rand.Int63()))
+	}
+	if len(entries) > 0 && entries[0].Index > 1 {
+		// compacted, the first entry is the last one applied before
+		n.log = entries
+	}
+	for i, entry := range n.log[1:] {
+		if entry.Index != n.log[0].Index+uint64(i+1) {
+			return nil, fmt.Errorf("log entry %d has index %d", n.log[0].Index+uint64(i+1), entry.Index)
+		}
+	}
+	if cfg.Applied > n.lastIndex() {
+		return nil, fmt.Errorf("applied %d is beyond the last entry %d", cfg.Applied, n.lastIndex())
+	}
+	n.applied, n.commit = cfg.Applied, cfg.Applied
+	if n.applied < n.log[0].Index {
+		// the owner applied the entries compacted, even if it failed to save it
+		n.applied, n.commit = n.log[0].Index, n.log[0].Index
+	}
+	n.becomeFollower(n.term, "")
+	return n, nil
+}
+
+func (n *Node) Status() Status {
+	return Status{
+		Id:        n.id,
+		State:     n.state,
+		Term:      n.term,
+		Leader:    n.leader,
+		Commit:    n.commit,
+		Applied:   n.applied,
+		LastIndex: n.lastIndex(),
+	}
+}
+
+func (n *Node) firstIndex() uint64 {
+	return n.log[0].Index
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.firstIndex() + uint64(len(n.log)-1)
+}
+
+// termAt is 0 for an index compacted or not in the log yet
+func (n *Node) termAt(index uint64) uint64 {
+	if index < n.firstIndex() || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.firstIndex()].Term
+}
+
+// entries returns a copy of the entries from from to before to
+func (n *Node) entries(from, to uint64) []Entry {
+	return append([]Entry(nil), n.log[from-n.firstIndex():to-n.firstIndex()]...)
+}
+
+func (n *Node) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+func (n *Node) send(m Message) {
+	m.From = n.id
+	m.Term = n.term
+	n.msgs = append(n.msgs, m)
+}
+
+// ReadMessages returns the messages to send since the last call
+func (n *Node) ReadMessages() []Message {
+	msgs := n.msgs
+	n.msgs = nil
+	return msgs
+}
+
+// ReadCommitted returns the entries committed since the last call, in order,
+// the caller applies them
+func (n *Node) ReadCommitted() []Entry {
+	if n.applied >= n.commit {
+		return nil
+	}
+	entries := n.entries(n.applied+1, n.commit+1)
+	n.applied = n.commit
+	return entries
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.electionTimeout = n.electionTicks + n.rand.Intn(n.electionTicks)
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) error {
+	if term != n.term {
+		n.term, n.vote = term, ""
+		if err := n.storage.SaveState(n.term, n.vote); err != nil {
+			return err
+		}
+	}
+	n.state = StateFollower
+	n.leader = leader
+	n.resetElectionTimeout()
+	return nil
+}
+
+func (n *Node) campaign() error {
+	n.state = StateCandidate
+	n.leader = ""
+	n.term++
+	n.vote = n.id
+	if err := n.storage.SaveState(n.term, n.vote); err != nil {
+		return err
+	}
+	n.resetElectionTimeout()
+	n.votes = map[string]bool{n.id: true}
+	if n.quorum() == 1 {
+		return n.becomeLeader()
+	}
+	for _, peer := range n.peers {
+		if peer != n.id {
+			n.send(Message{Type: MsgVote, To: peer, LogTerm: n.termAt(n.lastIndex()), Index: n.lastIndex()})
+		}
+	}
+	return nil
+}
+
+func (n *Node) becomeLeader() error {
+	n.state = StateLeader
+	n.leader = n.id
+	n.heartbeatElapsed = 0
+	n.electionElapsed = 0
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.recentActive = make(map[string]bool)
+	for _, peer := range n.peers {
+		n.next[peer] = n.lastIndex() + 1
+	}
+	_, err := n.appendEntry(nil)
+	return err
+}
+
+func (n *Node) appendEntry(data []byte) (uint64, error) {
+	entry := Entry{Term: n.term, Index: n.lastIndex() + 1, Data: data}
+	if err := n.storage.Append([]Entry{entry}); err != nil {
+		return 0, err
+	}
+	n.log = append(n.log, entry)
+	n.match[n.id] = entry.Index
+	n.maybeCommit()
+	return entry.Index, n.broadcastAppend()
+}
+
+// Propose appends data to the log of the leader, it is committed once a
+// quorum has it, unless leadership changes before. The index and term tell
+// which entry of ReadCommitted it is.
+func (n *Node) Propose(data []byte) (uint64, uint64, error) {
+	if n.state != StateLeader {
+		return 0, 0, ErrNotLeader
+	}
+	index, err := n.appendEntry(data)
+	return index, n.term, err
+}
+
+func (n *Node) Tick() error {
+	if err := n.compact(); err != nil {
+		return err
+	}
+	if n.state == StateLeader {
+		n.heartbeatElapsed++
+		n.electionElapsed++
+		if n.heartbeatElapsed >= n.heartbeatTicks {
+			n.heartbeatElapsed = 0
+			if err := n.broadcastAppend(); err != nil {
+				return err
+			}
+		}
+		// check quorum, a leader cut off from the majority steps down
+		if n.electionElapsed >= n.electionTicks {
+			n.electionElapsed = 0
+			active := 1
+			for peer := range n.recentActive {
+				if peer != n.id {
+					active++
+				}
+			}
+			n.recentActive = make(map[string]bool)
+			if active < n.quorum() {
+				return n.becomeFollower(n.term, "")
+			}
+		}
+		return nil
+	}
+	n.electionElapsed++
+	if n.electionElapsed >= n.electionTimeout {
+		return n.campaign()
+	}
+	return nil
+}
+
+func (n *Node) Step(m Message) error {
+	switch {
+	case m.Term > n.term:
+		// a node which hears from its leader ignores votes, so a node
+		// rejoining after a partition cannot disturb it
+		if m.Type == MsgVote && n.leader != "" && n.electionElapsed < n.electionTicks {
+			return nil
+		}
+		leader := ""
+		if m.Type == MsgAppend || m.Type == MsgSnapshot {
+			leader = m.From
+		}
+		if err := n.becomeFollower(m.Term, leader); err != nil {
+			return err
+		}
+	case m.Term < n.term:
+		// tell a stale leader or candidate about the new term
+		switch m.Type {
+		case MsgAppend, MsgSnapshot:
+			n.send(Message{Type: MsgAppendResp, To: m.From, Reject: true, Hint: n.lastIndex()})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		}
+		return nil
+	}
+
+	switch m.Type {
+	case MsgVote:
+		upToDate := m.LogTerm > n.termAt(n.lastIndex()) ||
+			(m.LogTerm == n.termAt(n.lastIndex()) && m.Index >= n.lastIndex())
+		grant := (n.vote == "" || n.vote == m.From) && upToDate && n.state != StateLeader
+		if grant {
+			n.vote = m.From
+			if err := n.storage.SaveState(n.term, n.vote); err != nil {
+				return err
+			}
+			n.resetElectionTimeout()
+		}
+		n.send(Message{Type: MsgVoteResp, To: m.From, Reject: !grant})
+	case MsgVoteResp:
+		if n.state != StateCandidate {
+			return nil
+		}
+		n.votes[m.From] = !m.Reject
+		granted, rejected := 0, 0
+		for _, vote := range n.votes {
+			if vote {
+				granted++
+			} else {
+				rejected++
+			}
+		}
+		if granted >= n.quorum() {
+			return n.becomeLeader()
+		}
+		if rejected >= n.quorum() {
+			return n.becomeFollower(n.term, "")
+		}
+	case MsgAppend:
+		if n.state != StateFollower || n.leader != m.From {
+			if err := n.becomeFollower(n.term, m.From); err != nil {
+				return err
+			}
+		}
+		n.electionElapsed = 0
+		return n.handleAppend(m)
+	case MsgSnapshot:
+		if n.state != StateFollower || n.leader != m.From {
+			if err := n.becomeFollower(n.term, m.From); err != nil {
+				return err
+			}
+		}
+		n.electionElapsed = 0
+		return n.handleSnapshot(m)
+	case MsgAppendResp:
+		if n.state != StateLeader {
+			return nil
+		}
+		n.recentActive[m.From] = true
+		if m.Reject {
+			next := n.next[m.From] - 1
+			if m.Hint+1 < next {
+				next = m.Hint + 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			n.next[m.From] = next
+			return n.sendAppend(m.From)
+		}
+		if m.Index > n.match[m.From] {
+			n.match[m.From] = m.Index
+		}
+		if m.Index+1 > n.next[m.From] {
+			n.next[m.From] = m.Index + 1
+		}
+		if n.maybeCommit() {
+			return n.broadcastAppend()
+		} else if n.next[m.From] <= n.lastIndex() {
+			return n.sendAppend(m.From)
+		}
+	}
+	return nil
+}
+
+func (n *Node) handleAppend(m Message) error {
+	if first := n.firstIndex(); m.Index < first {
+		// the entries up to the compacted ones are committed, as the leader has them
+		if m.Index+uint64(len(m.Entries)) <= first {
+			n.send(Message{Type: MsgAppendResp, To: m.From, Index: first})
+			return nil
+		}
+		m.Entries = m.Entries[first-m.Index:]
+		m.Index, m.LogTerm = first, n.log[0].Term
+	}
+	if m.Index > n.lastIndex() || n.termAt(m.Index) != m.LogTerm {
+		hint := n.lastIndex()
+		if m.Index <= hint && m.Index > 0 {
+			hint = m.Index - 1
+		}
+		n.send(Message{Type: MsgAppendResp, To: m.From, Reject: true, Hint: hint})
+		return nil
+	}
+	for i, entry := range m.Entries {
+		if entry.Index <= n.lastIndex() && n.termAt(entry.Index) == entry.Term {
+			continue
+		}
+		if entry.Index <= n.commit {
+			return fmt.Errorf("entry %d conflicts with a committed one", entry.Index)
+		}
+		// the first new or conflicting entry, the rest of the log goes
+		rest := m.Entries[i:]
+		if err := n.storage.Append(rest); err != nil {
+			return err
+		}
+		n.log = append(n.log[:entry.Index-n.firstIndex()], rest...)
+		break
+	}
+	last := m.Index + uint64(len(m.Entries))
+	if m.Commit > n.commit {
+		commit := m.Commit
+		if commit > last {
+			commit = last
+		}
+		if commit > n.commit {
+			n.commit = commit
+		}
+	}
+	n.send(Message{Type: MsgAppendResp, To: m.From, Index: last})
+	return nil
+}
+
+// handleSnapshot replaces the state and the log by the snapshot of the
+// leader, unless the log of this node has its last entry
+func (n *Node) handleSnapshot(m Message) error {
+	snapshot := m.Snapshot
+	if snapshot == nil {
+		return fmt.Errorf("snapshot message of %s without a snapshot", m.From)
+	}
+	if snapshot.Index <= n.commit {
+		n.send(Message{Type: MsgAppendResp, To: m.From, Index: n.commit})
+		return nil
+	}
+	if n.termAt(snapshot.Index) == snapshot.Term {
+		// the entries are applied as committed ones
+		n.commit = snapshot.Index
+		n.send(Message{Type: MsgAppendResp, To: m.From, Index: snapshot.Index})
+		return nil
+	}
+	if err := n.storage.Restore(*snapshot); err != nil {
+		return err
+	}
+	n.log = []Entry{{Term: snapshot.Term, Index: snapshot.Index}}
+	n.commit, n.applied = snapshot.Index, snapshot.Index
+	n.send(Message{Type: MsgAppendResp, To: m.From, Index: snapshot.Index})
+	return nil
+}
+
+// broadcastAppend sends to every peer, the first error is returned
+func (n *Node) broadcastAppend() error {
+	var first error
+	for _, peer := range n.peers {
+		if peer != n.id {
+			if err := n.sendAppend(peer); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (n *Node) sendAppend(to string) error {
+	next := n.next[to]
+	if next < 1 {
+		next = 1
+	}
+	if next <= n.firstIndex() {
+		return n.sendSnapshot(to)
+	}
+	prev := next - 1
+	end := n.lastIndex() + 1
+	if end-next > maxAppendEntries {
+		end = next + maxAppendEntries
+	}
+	var entries []Entry
+	if next < end {
+		entries = n.entries(next, end)
+	}
+	n.send(Message{Type: MsgAppend, To: to, LogTerm: n.termAt(prev), Index: prev, Entries: entries, Commit: n.commit})
+	return nil
+}
+
+// sendSnapshot sends the state applied to a follower which needs entries
+// compacted, the entries after it follow once it replied
+func (n *Node) sendSnapshot(to string) error {
+	data, err := n.storage.Snapshot()
+	if err != nil {
+		return err
+	}
+	snapshot := &Snapshot{Index: n.applied, Term: n.termAt(n.applied), Data: data}
+	n.send(Message{Type: MsgSnapshot, To: to, Snapshot: snapshot})
+	n.next[to] = snapshot.Index + 1
+	return nil
+}
+
+// compact drops the applied entries but the last keepEntries, once twice as
+// many are in the log. The owner applied them before this tick.
+func (n *Node) compact() error {
+	if n.keepEntries <= 0 || n.applied < n.firstIndex()+2*uint64(n.keepEntries) {
+		return nil
+	}
+	index := n.applied - uint64(n.keepEntries)
+	if err := n.storage.Compact(index); err != nil {
+		return err
+	}
+	n.log = n.entries(index, n.lastIndex()+1)
+	return nil
+}
+
+// maybeCommit commits the highest index a quorum has, of the current term
+func (n *Node) maybeCommit() bool {
+	matches := make([]uint64, 0, len(n.peers))
+	for _, peer := range n.peers {
+		matches = append(matches, n.match[peer])
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[n.quorum()-1]
+	if index > n.commit && n.termAt(index) == n.term {
+		n.commit = index
+		return true
+	}
+	return false
+}
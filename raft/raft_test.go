@@ -0,0 +1,591 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// simulation runs nodes on an in-process network driven by one seeded random
+// source, so a seed replays the same partitions, crashes and leader changes.
+// The nodes reserve batches of ids the way the server does and every step is
+// checked for overlapping ids, two leaders in a term and diverging logs.
+type simulation struct {
+	ids      []string
+	nodes    map[string]*Node          // nil while crashed
+	storages map[string]*MemoryStorage // with the data.db of each node
+	rand     *rand.Rand
+	inflight []Message
+	groups   map[string]int // partition of each node, same group talks
+	leaders  map[uint64]string
+	log      []Entry // the committed log all nodes must agree on
+	pending  map[string]map[uint64]proposal
+	issued   map[string][][2]int64
+
+	DropRate float64
+	report   simReport
+}
+
+type proposal struct {
+	term    uint64
+	command *Command
+}
+
+type simReport struct {
+	Seed          int64
+	Steps         int
+	LeaderChanges int
+	Partitions    int
+	Crashes       int
+	Committed     int
+	Reserved      int // batches handed out
+	Rejected      int // reservations lost to a conflict or a leader change
+	Snapshots     int // sent to followers missing compacted entries
+	Violations    []string
+}
+
+func (r *simReport) String() string {
+	return fmt.Sprintf("seed %d: %d steps, %d leader changes, %d partitions, %d crashes, %d entries committed, %d batches reserved, %d rejected, %d snapshots, %d violations",
+		r.Seed, r.Steps, r.LeaderChanges, r.Partitions, r.Crashes, r.Committed, r.Reserved, r.Rejected, r.Snapshots, len(r.Violations))
+}
+
+const (
+	simElectionTicks  = 10
+	simHeartbeatTicks = 2
+	simBatch          = 100
+	simKeepEntries    = 8
+)
+
+func newSimulation(size int, seed int64) (*simulation, error) {
+	s := &simulation{
+		nodes:    make(map[string]*Node),
+		storages: make(map[string]*MemoryStorage),
+		rand:     rand.New(rand.NewSource(seed)),
+		groups:   make(map[string]int),
+		leaders:  make(map[uint64]string),
+		pending:  make(map[string]map[uint64]proposal),
+		issued:   make(map[string][][2]int64),
+		report:   simReport{Seed: seed},
+	}
+	for i := 1; i <= size; i++ {
+		s.ids = append(s.ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range s.ids {
+		s.storages[id] = NewMemoryStorage()
+		if err := s.Restart(id); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Restart starts a crashed node again from its storage and applied state
+func (s *simulation) Restart(id string) error {
+	node, err := NewNode(Config{
+		Id:             id,
+		Peers:          s.ids,
+		ElectionTicks:  simElectionTicks,
+		HeartbeatTicks: simHeartbeatTicks,
+		Storage:        s.storages[id],
+		Applied:        s.storages[id].Applied,
+		KeepEntries:    simKeepEntries,
+		Rand:           rand.New(rand.NewSource(s.rand.Int63())),
+	})
+	if err != nil {
+		return err
+	}
+	s.nodes[id] = node
+	s.pending[id] = make(map[uint64]proposal)
+	return nil
+}
+
+func (s *simulation) Crash(id string) {
+	s.nodes[id] = nil
+	s.pending[id] = nil
+	s.report.Crashes++
+}
+
+// Partition splits the nodes in two groups which cannot talk to each other
+func (s *simulation) Partition(group []string) {
+	for _, id := range s.ids {
+		s.groups[id] = 0
+	}
+	for _, id := range group {
+		s.groups[id] = 1
+	}
+	s.report.Partitions++
+}
+
+func (s *simulation) Heal() {
+	for _, id := range s.ids {
+		s.groups[id] = 0
+	}
+}
+
+// Leaders returns the nodes which think they lead, more than one while an
+// old leader has not noticed the new one
+func (s *simulation) Leaders() []string {
+	leaders := make([]string, 0)
+	for _, id := range s.ids {
+		if node := s.nodes[id]; node != nil && node.Status().State == StateLeader {
+			leaders = append(leaders, id)
+		}
+	}
+	return leaders
+}
+
+// Reserve makes a leader propose the next batch of key, as a refill of
+// IdGenerator does, the ids count as issued once it applied the entry
+func (s *simulation) Reserve(id, key string) {
+	node := s.nodes[id]
+	if node == nil {
+		return
+	}
+	command := &Command{Op: OpSet, Key: key}
+	if current, ok := s.storages[id].State[key]; ok {
+		command = &Command{Op: OpReserve, Key: key, From: current, To: current + simBatch}
+	}
+	index, term, err := node.Propose(command.Encode())
+	if err != nil {
+		s.fail(id, err)
+		return
+	}
+	s.pending[id][index] = proposal{term: term, command: command}
+	s.collect(id)
+}
+
+// Step ticks every node once and delivers the messages in flight in a random
+// order, some are dropped and none crosses a partition
+func (s *simulation) Step() {
+	s.report.Steps++
+	for _, id := range s.ids {
+		if node := s.nodes[id]; node != nil {
+			if err := node.Tick(); err != nil {
+				s.fail(id, err)
+			}
+			s.collect(id)
+		}
+	}
+	msgs := s.inflight
+	s.inflight = nil
+	s.rand.Shuffle(len(msgs), func(i, j int) { msgs[i], msgs[j] = msgs[j], msgs[i] })
+	for _, m := range msgs {
+		node := s.nodes[m.To]
+		if node == nil || s.groups[m.From] != s.groups[m.To] || s.rand.Float64() < s.DropRate {
+			continue
+		}
+		if m.Type == MsgSnapshot {
+			s.report.Snapshots++
+		}
+		if err := node.Step(m); err != nil {
+			s.fail(m.To, err)
+		}
+		s.collect(m.To)
+	}
+}
+
+func (s *simulation) fail(id string, err error) {
+	if err != ErrNotLeader {
+		s.violation("%s: %v", id, err)
+	}
+}
+
+func (s *simulation) violation(format string, args ...interface{}) {
+	s.report.Violations = append(s.report.Violations, fmt.Sprintf("step %d: ", s.report.Steps)+fmt.Sprintf(format, args...))
+}
+
+func (s *simulation) collect(id string) {
+	node := s.nodes[id]
+	s.inflight = append(s.inflight, node.ReadMessages()...)
+
+	status := node.Status()
+	if status.State == StateLeader {
+		if leader, ok := s.leaders[status.Term]; !ok {
+			s.leaders[status.Term] = id
+			s.report.LeaderChanges++
+		} else if leader != id {
+			s.violation("two leaders in term %d: %s and %s", status.Term, leader, id)
+		}
+	}
+
+	for _, entry := range node.ReadCommitted() {
+		if entry.Index <= uint64(len(s.log)) {
+			committed := s.log[entry.Index-1]
+			if committed.Term != entry.Term || string(committed.Data) != string(entry.Data) {
+				s.violation("%s committed %d in term %d, others in term %d", id, entry.Index, entry.Term, committed.Term)
+			}
+		} else if entry.Index == uint64(len(s.log))+1 {
+			s.log = append(s.log, entry)
+			s.report.Committed++
+		} else {
+			s.violation("%s committed %d before %d", id, entry.Index, len(s.log)+1)
+		}
+		s.apply(id, entry)
+	}
+}
+
+func (s *simulation) apply(id string, entry Entry) {
+	var err error
+	var command *Command
+	if len(entry.Data) > 0 {
+		if command, err = DecodeCommand(entry.Data); err == nil {
+			err = s.storages[id].State.Apply(command)
+		}
+	}
+	s.storages[id].Applied = entry.Index
+
+	p, ok := s.pending[id][entry.Index]
+	if !ok {
+		return
+	}
+	delete(s.pending[id], entry.Index)
+	if p.term != entry.Term || err != nil {
+		s.report.Rejected++
+		return
+	}
+	if p.command.Op != OpReserve {
+		return
+	}
+	// the batch is this node's to hand out, no one else may have any of it
+	batch := [2]int64{p.command.From + 1, p.command.To}
+	for _, other := range s.issued[p.command.Key] {
+		if batch[0] <= other[1] && other[0] <= batch[1] {
+			s.violation("%s issued %s %d-%d, overlapping %d-%d", id, p.command.Key, batch[0], batch[1], other[0], other[1])
+		}
+	}
+	s.issued[p.command.Key] = append(s.issued[p.command.Key], batch)
+	s.report.Reserved++
+}
+
+// runSimulation drives a random workload of reservations, partitions, crashes and
+// restarts for the given steps, then heals everything and checks that all
+// nodes converge on the same high-water marks
+func runSimulation(size int, seed int64, steps int) *simReport {
+	s, err := newSimulation(size, seed)
+	if err != nil {
+		return &simReport{Seed: seed, Violations: []string{err.Error()}}
+	}
+	s.DropRate = 0.05
+	keys := []string{"order", "user", "ticket"}
+	for i := 0; i < steps; i++ {
+		switch r := s.rand.Float64(); {
+		case r < 0.25:
+			leaders := s.Leaders()
+			if len(leaders) > 0 {
+				s.Reserve(leaders[s.rand.Intn(len(leaders))], keys[s.rand.Intn(len(keys))])
+			}
+		case r < 0.27:
+			group := make([]string, 0)
+			for _, id := range s.ids {
+				if s.rand.Intn(2) == 0 {
+					group = append(group, id)
+				}
+			}
+			s.Partition(group)
+		case r < 0.29:
+			s.Heal()
+		case r < 0.30:
+			id := s.ids[s.rand.Intn(len(s.ids))]
+			if s.nodes[id] != nil {
+				s.Crash(id)
+			}
+		case r < 0.32:
+			id := s.ids[s.rand.Intn(len(s.ids))]
+			if s.nodes[id] == nil {
+				if err := s.Restart(id); err != nil {
+					s.violation("restart %s: %v", id, err)
+				}
+			}
+		}
+		s.Step()
+	}
+
+	s.Heal()
+	s.DropRate = 0
+	for _, id := range s.ids {
+		if s.nodes[id] == nil {
+			if err := s.Restart(id); err != nil {
+				s.violation("restart %s: %v", id, err)
+			}
+		}
+	}
+	for i := 0; i < 20*simElectionTicks && !s.converged(); i++ {
+		if leaders := s.Leaders(); len(leaders) == 1 && i%simElectionTicks == 0 {
+			// an entry of the current term commits whatever is left
+			s.Reserve(leaders[0], keys[0])
+		}
+		s.Step()
+	}
+	if !s.converged() {
+		s.violation("no convergence after healing: %v", s.statuses())
+	}
+	return &s.report
+}
+
+func (s *simulation) converged() bool {
+	leaders := s.Leaders()
+	if len(leaders) != 1 {
+		return false
+	}
+	want := s.nodes[leaders[0]].Status()
+	for _, id := range s.ids {
+		status := s.nodes[id].Status()
+		if status.Applied != want.LastIndex || status.Applied != want.Commit {
+			return false
+		}
+		if fmt.Sprint(sortedState(s.storages[id].State)) != fmt.Sprint(sortedState(s.storages[leaders[0]].State)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *simulation) statuses() []Status {
+	statuses := make([]Status, 0, len(s.ids))
+	for _, id := range s.ids {
+		if node := s.nodes[id]; node != nil {
+			statuses = append(statuses, node.Status())
+		}
+	}
+	return statuses
+}
+
+func sortedState(state Sequences) []string {
+	keys := make([]string, 0, len(state))
+	for key, value := range state {
+		keys = append(keys, fmt.Sprintf("%s=%d", key, value))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// elect steps until exactly one node of group leads and the whole group
+// follows it
+func elect(t *testing.T, s *simulation, group []string) string {
+	t.Helper()
+	for i := 0; i < 20*simElectionTicks; i++ {
+		s.Step()
+		leader := ""
+		for _, id := range group {
+			if status := s.nodes[id].Status(); status.State == StateLeader {
+				if leader != "" {
+					leader = ""
+					break
+				}
+				leader = id
+			}
+		}
+		followed := leader != ""
+		for _, id := range group {
+			if s.nodes[id].Status().Leader != leader {
+				followed = false
+			}
+		}
+		if followed {
+			return leader
+		}
+	}
+	t.Fatalf("no leader elected: %v", s.statuses())
+	return ""
+}
+
+// commit reserves a batch on the leader and steps until every node of its
+// group committed and applied it
+func commit(t *testing.T, s *simulation, leader, key string) uint64 {
+	t.Helper()
+	s.Reserve(leader, key)
+	index := s.nodes[leader].Status().LastIndex
+	for i := 0; i < 10*simElectionTicks; i++ {
+		s.Step()
+		done := true
+		for _, id := range s.ids {
+			if node := s.nodes[id]; node != nil && s.groups[id] == s.groups[leader] && node.Status().Applied < index {
+				done = false
+			}
+		}
+		if done {
+			return index
+		}
+	}
+	t.Fatalf("entry %d not committed: %v", index, s.statuses())
+	return 0
+}
+
+func checkReport(t *testing.T, r *simReport) {
+	t.Helper()
+	for _, violation := range r.Violations {
+		t.Errorf("seed %d: %s", r.Seed, violation)
+	}
+}
+
+func TestElection(t *testing.T) {
+	s, err := newSimulation(3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader := elect(t, s, s.ids)
+	term := s.nodes[leader].Status().Term
+	for _, id := range s.ids {
+		if status := s.nodes[id].Status(); status.Term != term {
+			t.Errorf("%s in term %d, the leader %s in %d", id, status.Term, leader, term)
+		}
+	}
+	if s.report.LeaderChanges != 1 {
+		t.Errorf("%d leader changes, want 1", s.report.LeaderChanges)
+	}
+
+	// a leader cut off from the others is replaced by the majority
+	others := make([]string, 0)
+	for _, id := range s.ids {
+		if id != leader {
+			others = append(others, id)
+		}
+	}
+	s.Partition(others)
+	if next := elect(t, s, others); next == leader {
+		t.Fatalf("the minority leader %s was not replaced", leader)
+	} else if status := s.nodes[next].Status(); status.Term <= term {
+		t.Errorf("new leader %s in term %d, not after %d", next, status.Term, term)
+	}
+	checkReport(t, &s.report)
+}
+
+func TestCommitIndex(t *testing.T) {
+	s, err := newSimulation(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader := elect(t, s, s.ids)
+	var index uint64
+	for i := 0; i < 5; i++ {
+		next := commit(t, s, leader, "order")
+		if next <= index {
+			t.Fatalf("entry %d after %d", next, index)
+		}
+		index = next
+	}
+	for _, id := range s.ids {
+		status := s.nodes[id].Status()
+		if status.Commit != index || status.Applied != index {
+			t.Errorf("%s commit %d applied %d, want %d", id, status.Commit, status.Applied, index)
+		}
+		// a set and four batches
+		if state := s.storages[id].State; state["order"] != 4*simBatch {
+			t.Errorf("%s order = %d, want %d", id, state["order"], 4*simBatch)
+		}
+	}
+
+	// the leader of a minority cannot commit, the majority can
+	others := make([]string, 0)
+	for _, id := range s.ids {
+		if id != leader {
+			others = append(others, id)
+		}
+	}
+	s.Partition(others)
+	s.Reserve(leader, "order")
+	stale := s.nodes[leader].Status().LastIndex
+	for i := 0; i < 5*simElectionTicks; i++ {
+		s.Step()
+	}
+	if status := s.nodes[leader].Status(); status.Commit >= stale {
+		t.Errorf("minority leader committed %d", stale)
+	}
+	next := elect(t, s, others)
+	commit(t, s, next, "order")
+
+	// once healed the old leader drops its entry and catches up
+	s.Heal()
+	for i := 0; i < 10*simElectionTicks && !s.converged(); i++ {
+		s.Step()
+	}
+	if !s.converged() {
+		t.Fatalf("no convergence after healing: %v", s.statuses())
+	}
+	if s.report.Reserved != 5 || s.report.Rejected != 1 {
+		t.Errorf("%d batches reserved, %d rejected, want 5 and 1", s.report.Reserved, s.report.Rejected)
+	}
+	checkReport(t, &s.report)
+}
+
+// random partitions, crashes and message loss never hand out an id twice,
+// the simulation checks every batch applied against the others
+func TestPartitionsNoDoubleReserve(t *testing.T) {
+	runs, steps := 20, 2000
+	if testing.Short() {
+		runs = 3
+	}
+	reserved, partitions, snapshots := 0, 0, 0
+	for seed := int64(1); seed <= int64(runs); seed++ {
+		r := runSimulation(3, seed, steps)
+		checkReport(t, r)
+		reserved += r.Reserved
+		partitions += r.Partitions
+		snapshots += r.Snapshots
+		if r.LeaderChanges < 2 {
+			t.Errorf("seed %d: %d leader changes, the leader was never lost", seed, r.LeaderChanges)
+		}
+	}
+	if reserved == 0 || partitions == 0 || snapshots == 0 {
+		t.Errorf("%d batches reserved with %d partitions and %d snapshots, nothing checked", reserved, partitions, snapshots)
+	}
+	r := runSimulation(5, 99, steps)
+	checkReport(t, r)
+}
+
+// the log of a node keeps few entries, a follower cut off while the others
+// compact catches up from a snapshot, also after a restart
+func TestSnapshot(t *testing.T) {
+	s, err := newSimulation(3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader := elect(t, s, s.ids)
+	behind, others := "", make([]string, 0)
+	for _, id := range s.ids {
+		if id != leader && behind == "" {
+			behind = id
+		} else {
+			others = append(others, id)
+		}
+	}
+	s.Partition([]string{behind})
+	for i := 0; i < 10*simKeepEntries; i++ {
+		commit(t, s, leader, "order")
+		s.Step()
+	}
+	for _, id := range others {
+		if n := len(s.nodes[id].log); n > 2*simKeepEntries+1 {
+			t.Errorf("%s keeps %d entries, want at most %d", id, n, 2*simKeepEntries+1)
+		}
+		if first := s.nodes[id].firstIndex(); first == 0 {
+			t.Errorf("%s never compacted", id)
+		}
+	}
+
+	s.Heal()
+	for i := 0; i < 10*simElectionTicks && !s.converged(); i++ {
+		s.Step()
+	}
+	if !s.converged() {
+		t.Fatalf("no convergence after healing: %v", s.statuses())
+	}
+	if s.report.Snapshots == 0 {
+		t.Errorf("%s caught up without a snapshot", behind)
+	}
+
+	// a restart starts from the compacted log
+	for _, id := range s.ids {
+		s.Crash(id)
+		if err := s.Restart(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader = elect(t, s, s.ids)
+	commit(t, s, leader, "order")
+	if got := s.storages[behind].State["order"]; got != 10*simKeepEntries*simBatch {
+		t.Errorf("%s order = %d, want %d", behind, got, 10*simKeepEntries*simBatch)
+	}
+	checkReport(t, &s.report)
+}
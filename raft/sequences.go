@@ -0,0 +1,63 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// The replicated state of didgen is the high-water mark of every key, the
+// last id reserved for it. The leader reserves a batch by committing a
+// Command before it hands out any id of it.
+
+const (
+	OpReserve = "reserve" // move the high-water from From to To, only if it is at From
+	OpSet     = "set"     // create the key or set its high-water, SET
+	OpAdvance = "advance" // create the key or move it forward to To, never backwards
+	OpDel     = "del"
+)
+
+var ErrConflict = errors.New("high-water moved since it was read")
+
+type Command struct {
+	Op   string `json:"op"`
+	Key  string `json:"key"`
+	From int64  `json:"from,omitempty"`
+	To   int64  `json:"to"`
+}
+
+func (c *Command) Encode() []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
+
+func DecodeCommand(data []byte) (*Command, error) {
+	c := new(Command)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Sequences applies the commands to high-water marks in memory, the server
+// applies them to data.db instead, the result is the same
+type Sequences map[string]int64
+
+func (s Sequences) Apply(c *Command) error {
+	current, ok := s[c.Key]
+	switch c.Op {
+	case OpReserve:
+		if !ok || current != c.From {
+			return ErrConflict
+		}
+		s[c.Key] = c.To
+	case OpSet:
+		s[c.Key] = c.To
+	case OpAdvance:
+		if !ok || current < c.To {
+			s[c.Key] = c.To
+		}
+	case OpDel:
+		delete(s, c.Key)
+	}
+	return nil
+}
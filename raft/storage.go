@@ -0,0 +1,89 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MemoryStorage keeps the state in memory, it survives a restart of the Node
+// but not of the process, for Simulation. State is the data.db of the node,
+// the owner applies the committed entries to it and sets Applied.
+type MemoryStorage struct {
+	State   Sequences
+	Applied uint64
+
+	term    uint64
+	vote    string
+	entries []Entry
+
+	lock sync.Mutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{State: make(Sequences)}
+}
+
+func (s *MemoryStorage) InitialState() (uint64, string, []Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.term, s.vote, append([]Entry(nil), s.entries...), nil
+}
+
+func (s *MemoryStorage) SaveState(term uint64, vote string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.term, s.vote = term, vote
+	return nil
+}
+
+// offset is the index of the first entry kept
+func (s *MemoryStorage) offset() uint64 {
+	if len(s.entries) == 0 {
+		return 1
+	}
+	return s.entries[0].Index
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	first, offset := entries[0].Index, s.offset()
+	if first < offset || first > offset+uint64(len(s.entries)) {
+		return fmt.Errorf("append at %d leaves a gap after %d", first, offset+uint64(len(s.entries))-1)
+	}
+	s.entries = append(s.entries[:first-offset], entries...)
+	return nil
+}
+
+func (s *MemoryStorage) Compact(index uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	offset := s.offset()
+	if index < offset || index >= offset+uint64(len(s.entries)) {
+		return fmt.Errorf("compact at %d, the log has %d to %d", index, offset, offset+uint64(len(s.entries))-1)
+	}
+	s.entries = append([]Entry(nil), s.entries[index-offset:]...)
+	return nil
+}
+
+func (s *MemoryStorage) Snapshot() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return json.Marshal(s.State)
+}
+
+func (s *MemoryStorage) Restore(snapshot Snapshot) error {
+	state := make(Sequences)
+	if err := json.Unmarshal(snapshot.Data, &state); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.State, s.Applied = state, snapshot.Index
+	s.entries = []Entry{{Term: snapshot.Term, Index: snapshot.Index}}
+	return nil
+}
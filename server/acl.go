@@ -0,0 +1,556 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"Didgen/db"
+	log "Didgen/logger_seelog"
+)
+
+const (
+	// DefaultUser is the user of AUTH <password> without a user name
+	DefaultUser = "default"
+
+	passwordHashPrefix = "sha256:"
+)
+
+// User is an ACL user, Commands are rules applied in order, the last rule
+// matching a command decides, Keys are glob patterns
+type User struct {
+	Name     string
+	Password string // sha256 hex digest, empty means no password
+	Enabled  bool
+	Commands []string
+	Keys     []string
+}
+
+// ACL holds the users of configuration.yml merged with the users of
+// configuration.db, it is disabled when there is no user at all
+type ACL struct {
+	users map[string]*User
+	lock  sync.RWMutex
+}
+
+func NewACL(configUsers []map[string]string, dbUsers []map[string]string) *ACL {
+	acl := new(ACL)
+	acl.Load(configUsers, dbUsers)
+	return acl
+}
+
+// Load replaces all users, clients of a removed user lose their session on
+// their next command
+func (a *ACL) Load(configUsers []map[string]string, dbUsers []map[string]string) {
+	users := make(map[string]*User)
+	for _, list := range [][]map[string]string{configUsers, dbUsers} {
+		for _, u := range list {
+			user := NewUser(u)
+			if user.Name == "" {
+				continue
+			}
+			users[user.Name] = user
+		}
+	}
+	a.lock.Lock()
+	a.users = users
+	a.lock.Unlock()
+}
+
+func NewUser(u map[string]string) *User {
+	user := new(User)
+	user.Name = u["name"]
+	user.Enabled = u["enabled"] != "off"
+	user.Password = hashPassword(u["password"])
+	user.Commands = strings.Fields(u["commands"])
+	for _, pattern := range strings.Fields(u["keys"]) {
+		user.Keys = append(user.Keys, strings.TrimPrefix(pattern, "~"))
+	}
+	return user
+}
+
+func hashPassword(password string) string {
+	if password == "" {
+		return ""
+	}
+	if strings.HasPrefix(password, passwordHashPrefix) {
+		return strings.ToLower(password[len(passwordHashPrefix):])
+	}
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Map is the form stored in configuration.db
+func (u *User) Map() map[string]string {
+	enabled := "on"
+	if !u.Enabled {
+		enabled = "off"
+	}
+	password := ""
+	if u.Password != "" {
+		password = passwordHashPrefix + u.Password
+	}
+	return map[string]string{
+		"name":     u.Name,
+		"password": password,
+		"commands": strings.Join(u.Commands, " "),
+		"keys":     strings.Join(u.Keys, " "),
+		"enabled":  enabled,
+	}
+}
+
+// Describe formats the user the way ACL LIST does
+func (u *User) Describe() string {
+	parts := []string{"user", u.Name}
+	if u.Enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.Password == "" {
+		parts = append(parts, "nopass")
+	} else {
+		parts = append(parts, "#"+u.Password)
+	}
+	for _, pattern := range u.Keys {
+		parts = append(parts, "~"+pattern)
+	}
+	if len(u.Commands) == 0 {
+		parts = append(parts, "-@all")
+	}
+	parts = append(parts, u.Commands...)
+	return strings.Join(parts, " ")
+}
+
+func (u *User) checkPassword(password string) bool {
+	if u.Password == "" {
+		return true
+	}
+	sum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(u.Password)) == 1
+}
+
+// CanRun checks the command rules and the key patterns of the user, reason
+// is the error message when the request is denied
+func (u *User) CanRun(cmd *Command, r *Request) (bool, string) {
+	sub := ""
+	categories := cmd.Categories
+	if len(cmd.SubCommands) > 0 && r.HasArgument(0) {
+		sub = strings.ToLower(string(r.Arguments[0]))
+		for _, subCmd := range cmd.SubCommands {
+			if subCmd.Name == cmd.Name+"|"+sub {
+				categories = subCmd.Categories
+			}
+		}
+	}
+	if !u.commandAllowed(cmd.Name, sub, categories) {
+		name := cmd.Name
+		if sub != "" {
+			name += "|" + sub
+		}
+		return false, fmt.Sprintf("User %s has no permissions to run the '%s' command", u.Name, name)
+	}
+
+	for _, key := range cmd.Keys(r) {
+		if !u.keyAllowed(key) {
+			return false, "No permissions to access a key"
+		}
+	}
+	return true, ""
+}
+
+func (u *User) commandAllowed(name, sub string, categories []string) bool {
+	allowed := false
+	for _, rule := range u.Commands {
+		switch strings.ToLower(rule) {
+		case "allcommands":
+			allowed = true
+			continue
+		case "nocommands":
+			allowed = false
+			continue
+		}
+		if len(rule) < 2 || (rule[0] != '+' && rule[0] != '-') {
+			continue
+		}
+		target := strings.ToLower(rule[1:])
+		match := false
+		switch {
+		case target == "@all":
+			match = true
+		case strings.HasPrefix(target, "@"):
+			for _, category := range categories {
+				if category == target {
+					match = true
+				}
+			}
+		case strings.Contains(target, "|"):
+			match = target == name+"|"+sub
+		default:
+			match = target == name
+		}
+		if match {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+func (u *User) keyAllowed(key string) bool {
+	for _, pattern := range u.Keys {
+		if pattern == "allkeys" || globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys returns the key arguments of the request according to the key
+// positions of the command
+func (c *Command) Keys(r *Request) []string {
+	keys := make([]string, 0)
+	if c.FirstKey <= 0 || c.Step <= 0 {
+		return keys
+	}
+	last := c.LastKey
+	if last < 0 {
+		last = len(r.Arguments) + 1 + last
+	}
+	for i := c.FirstKey; i <= last && i-1 < len(r.Arguments); i += c.Step {
+		keys = append(keys, string(r.Arguments[i-1]))
+	}
+	return keys
+}
+
+// globMatch matches redis style patterns, * ? [abc] [^a-z] and \ escapes
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return pattern == s
+			}
+			class := pattern[1 : end+1]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			match := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					if s[0] >= class[i] && s[0] <= class[i+2] {
+						match = true
+					}
+					i += 2
+				} else if class[i] == s[0] {
+					match = true
+				}
+			}
+			if match == negate {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[end+2:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+func (a *ACL) Enabled() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return len(a.users) > 0
+}
+
+func (a *ACL) User(name string) (*User, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	user, ok := a.users[name]
+	return user, ok
+}
+
+func (a *ACL) Authenticate(name, password string) (*User, bool) {
+	user, ok := a.User(name)
+	if !ok || !user.Enabled || !user.checkPassword(password) {
+		return nil, false
+	}
+	return user, true
+}
+
+func (a *ACL) Users() []*User {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	users := make([]*User, 0, len(names))
+	for _, name := range names {
+		users = append(users, a.users[name])
+	}
+	return users
+}
+
+// SetUser applies ACL SETUSER rules to a copy of the user and persists it
+func (a *ACL) SetUser(name string, rules []string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	user := &User{
+		Name: name,
+	}
+	if old, ok := a.users[name]; ok {
+		copied := *old
+		copied.Commands = append([]string{}, old.Commands...)
+		copied.Keys = append([]string{}, old.Keys...)
+		user = &copied
+	}
+	for _, rule := range rules {
+		lower := strings.ToLower(rule)
+		switch {
+		case lower == "on":
+			user.Enabled = true
+		case lower == "off":
+			user.Enabled = false
+		case lower == "nopass", lower == "resetpass":
+			user.Password = ""
+		case strings.HasPrefix(rule, ">"):
+			user.Password = hashPassword(rule[1:])
+		case strings.HasPrefix(rule, "#"):
+			user.Password = strings.ToLower(rule[1:])
+		case lower == "allkeys":
+			user.Keys = []string{"*"}
+		case lower == "resetkeys":
+			user.Keys = []string{}
+		case strings.HasPrefix(rule, "~"):
+			user.Keys = append(user.Keys, rule[1:])
+		case lower == "allcommands", lower == "nocommands":
+			user.Commands = []string{lower}
+		case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+			user.Commands = append(user.Commands, lower)
+		case lower == "reset":
+			user = &User{Name: name}
+		default:
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
+		}
+	}
+	if err := db.CONFIG.SetUser(user.Map()); err != nil {
+		return err
+	}
+	a.users[name] = user
+	log.Info(fmt.Sprintf("ACL user '%s' updated", name))
+	return nil
+}
+
+func (a *ACL) DelUser(name string) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.users[name]; !ok {
+		return false, nil
+	}
+	if err := db.CONFIG.DeleteUser(name); err != nil {
+		return false, err
+	}
+	delete(a.users, name)
+	log.Info(fmt.Sprintf("ACL user '%s' deleted", name))
+	return true, nil
+}
+
+// checkAccess is called for every request, it returns nil when the client
+// may run the command
+func (s *Server) checkAccess(cmd *Command, r *Request) *ErrorReply {
+	if r.Client == nil || !s.acl.Enabled() {
+		return nil
+	}
+	userName, authenticated := r.Client.User()
+	if !authenticated {
+		if cmd.hasFlag("no-auth") {
+			return nil
+		}
+		return NewErrorReply(ErrPrefixNoAuth, "Authentication required.")
+	}
+	user, ok := s.acl.User(userName)
+	if !ok || !user.Enabled {
+		// the user was deleted or disabled after authentication
+		r.Client.SetUser("", false)
+		return NewErrorReply(ErrPrefixNoAuth, "Authentication required.")
+	}
+	if ok, reason := user.CanRun(cmd, r); !ok {
+		return NewErrorReply(ErrPrefixNoPerm, "%s", reason)
+	}
+	return nil
+}
+
+func (s *Server) authenticate(client *Client, name, password string) *ErrorReply {
+	if !s.acl.Enabled() {
+		return NewErrorReply(ErrPrefixErr, "AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	if _, ok := s.acl.Authenticate(name, password); !ok {
+		log.Warn(fmt.Sprintf("Server auth failed, user: '%s', client: %s", name, client.Addr))
+		return NewErrorReply(ErrPrefixWrongPass, "invalid username-password pair or user is disabled.")
+	}
+	client.SetUser(name, true)
+	return nil
+}
+
+// redis command(auth [username] password)
+func (s *Server) handleAuth(r *Request) Reply {
+	if len(r.Arguments) > 2 {
+		return ErrSyntax
+	}
+	name, password := DefaultUser, string(r.Arguments[0])
+	if len(r.Arguments) == 2 {
+		name, password = string(r.Arguments[0]), string(r.Arguments[1])
+	}
+	if errReply := s.authenticate(r.Client, name, password); errReply != nil {
+		return errReply
+	}
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+func (s *Server) handleAcl(r *Request) Reply {
+	sub := strings.ToUpper(string(r.Arguments[0]))
+	switch sub {
+	case "WHOAMI":
+		name, _ := r.Client.User()
+		if name == "" {
+			name = DefaultUser
+		}
+		return &BulkReply{
+			value: []byte(name),
+		}
+	case "USERS":
+		values := make([]Reply, 0)
+		for _, user := range s.acl.Users() {
+			values = append(values, &BulkReply{value: []byte(user.Name)})
+		}
+		return &ArrayReply{
+			values: values,
+		}
+	case "LIST":
+		values := make([]Reply, 0)
+		for _, user := range s.acl.Users() {
+			values = append(values, &BulkReply{value: []byte(user.Describe())})
+		}
+		return &ArrayReply{
+			values: values,
+		}
+	case "CAT":
+		values := make([]Reply, 0)
+		if r.HasArgument(1) {
+			category := "@" + strings.TrimPrefix(strings.ToLower(string(r.Arguments[1])), "@")
+			for _, name := range sortedCommandNames() {
+				for _, c := range commandTable[name].Categories {
+					if c == category {
+						values = append(values, &BulkReply{value: []byte(name)})
+					}
+				}
+			}
+		} else {
+			for _, category := range commandCategories() {
+				values = append(values, &BulkReply{value: []byte(category[1:])})
+			}
+		}
+		return &ArrayReply{
+			values: values,
+		}
+	case "SETUSER":
+		if !r.HasArgument(1) {
+			return ErrWrongArgs("acl|setuser")
+		}
+		rules := make([]string, 0, len(r.Arguments)-2)
+		for _, arg := range r.Arguments[2:] {
+			rules = append(rules, string(arg))
+		}
+		if err := s.acl.SetUser(string(r.Arguments[1]), rules); err != nil {
+			return &ErrorReply{
+				message: err.Error(),
+			}
+		}
+	case "DELUSER":
+		if !r.HasArgument(1) {
+			return ErrWrongArgs("acl|deluser")
+		}
+		var count int64
+		for _, arg := range r.Arguments[1:] {
+			deleted, err := s.acl.DelUser(string(arg))
+			if err != nil {
+				return &ErrorReply{
+					message: err.Error(),
+				}
+			}
+			if deleted {
+				count++
+			}
+		}
+		return &IntReply{
+			number: count,
+		}
+	default:
+		return NewErrorReply(ErrPrefixErr, "unknown subcommand '%s'. Try ACL HELP.", r.Arguments[0])
+	}
+
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+func commandCategories() []string {
+	seen := make(map[string]bool)
+	for _, cmd := range commandTable {
+		for _, category := range cmd.Categories {
+			seen[category] = true
+		}
+		for _, sub := range cmd.SubCommands {
+			for _, category := range sub.Categories {
+				seen[category] = true
+			}
+		}
+	}
+	categories := make([]string, 0, len(seen))
+	for category := range seen {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
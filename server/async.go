@@ -0,0 +1,423 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"Didgen/config"
+	"Didgen/db"
+	log "Didgen/logger_seelog"
+	"Didgen/raft"
+)
+
+// With replication async the primary serves the clients and a standby, a
+// node with replicaof, keeps a copy of its keys. The standby pulls over
+// trans_port: it asks for the changes after its offset and the primary
+// answers as soon as there is one, or after a second without, so a change
+// reaches the standby within a round trip. A standby of another run of the
+// primary, or behind the backlog, first gets all keys. The copy lags, so
+// PROMOTE moves every key of the standby ahead by promote_margin, past the
+// ids the primary may have handed out without the standby knowing.
+
+const (
+	MessageSync = "sync"
+
+	asyncBacklogSize    = 10000
+	asyncMaxRecords     = 1000
+	asyncPollTimeout    = time.Second
+	asyncRetryInterval  = time.Second
+	asyncStandbyTimeout = 5 * time.Second // a standby which did not sync for this long is offline
+)
+
+// asyncRecord is a change of the primary, a SET of the value the key has
+// after it or a DEL, applying it twice changes nothing
+type asyncRecord struct {
+	Offset  int64         `json:"offset"`
+	Command *raft.Command `json:"command"`
+}
+
+type syncRequest struct {
+	ReplId string `json:"repl_id"`
+	Offset int64  `json:"offset"`
+	Addr   string `json:"addr"` // host:server_port of the standby
+}
+
+type syncReply struct {
+	ReplId        string           `json:"repl_id"`
+	Offset        int64            `json:"offset"`         // of the last record
+	PrimaryOffset int64            `json:"primary_offset"` // of the last change of the primary
+	Addr          string           `json:"addr"`           // host:server_port of the primary
+	Full          bool             `json:"full,omitempty"`
+	Keys          map[string]int64 `json:"keys,omitempty"`
+	Records       []asyncRecord    `json:"records,omitempty"`
+}
+
+type standbyState struct {
+	addr   string
+	offset int64
+	seen   time.Time
+}
+
+type asyncReplication struct {
+	replId   string
+	offset   int64
+	backlog  []asyncRecord
+	changed  chan struct{} // closed by feed
+	standbys map[string]*standbyState
+
+	// of a standby, replicaOf is empty once promoted
+	replicaOf     string
+	primary       string // host:server_port of the primary for MOVED
+	linked        bool
+	lastIO        time.Time
+	primaryOffset int64
+	fullSyncs     int64
+	promoted      time.Time
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	promote sync.Mutex
+	wait    sync.WaitGroup
+	lock    sync.Mutex
+}
+
+func newReplId() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// startAsync serves the standbys, or syncs from the primary with replicaof,
+// on the transport of the cluster
+func (s *Server) startAsync() {
+	a := &asyncReplication{
+		replId:    newReplId(),
+		changed:   make(chan struct{}),
+		standbys:  make(map[string]*standbyState),
+		replicaOf: config.Current().ReplicaOf,
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	s.cluster.Transport().Handle(MessageSync, a.handleSync)
+	s.async = a
+	db.HIGHWATER = asyncHighWater{a}
+	if a.replicaOf != "" {
+		a.startSync(s)
+		log.Info(fmt.Sprintf("Server replication async, standby of %s", a.replicaOf))
+	} else {
+		log.Info(fmt.Sprintf("Server replication async, primary, replid %s", a.replId))
+	}
+}
+
+func (a *asyncReplication) startSync(s *Server) {
+	a.wait.Add(1)
+	go a.syncLoop(s)
+}
+
+func (a *asyncReplication) stop() {
+	a.cancel()
+	a.wait.Wait()
+}
+
+// isPrimary is true when this node serves the clients
+func (a *asyncReplication) isPrimary() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.replicaOf == ""
+}
+
+// owner is the primary of a standby, the host:trans_port of replicaof and the
+// host:server_port it reported, confirmed while the link is up
+func (a *asyncReplication) owner() (string, string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.replicaOf, a.primary, a.linked
+}
+
+// feed adds a change of the primary to the backlog and wakes the standbys
+func (a *asyncReplication) feed(command *raft.Command) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.replicaOf != "" {
+		return
+	}
+	a.offset++
+	a.backlog = append(a.backlog, asyncRecord{Offset: a.offset, Command: command})
+	if len(a.backlog) > asyncBacklogSize {
+		a.backlog = append([]asyncRecord(nil), a.backlog[len(a.backlog)-asyncBacklogSize:]...)
+	}
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+func (a *asyncReplication) handleSync(from string, payload json.RawMessage) (interface{}, error) {
+	var request syncRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.replicaOf != "" {
+		return nil, fmt.Errorf("not a primary, standby of %s", a.replicaOf)
+	}
+	standby, ok := a.standbys[from]
+	if !ok {
+		standby = new(standbyState)
+		a.standbys[from] = standby
+		log.Info(fmt.Sprintf("Server replication async, standby %s connected", request.Addr))
+	}
+	standby.addr, standby.seen = request.Addr, time.Now()
+
+	reply := &syncReply{
+		ReplId: a.replId,
+		Addr:   net.JoinHostPort(config.Current().ServerHost, config.Current().ServerPort),
+	}
+	behind := len(a.backlog) == 0 || request.Offset < a.backlog[0].Offset-1
+	if request.ReplId != a.replId || request.Offset > a.offset || (request.Offset < a.offset && behind) {
+		// the values are read under the lock, no change is fed meanwhile
+		keys, err := db.DATA.KeyValues()
+		if err != nil {
+			return nil, err
+		}
+		reply.Full, reply.Keys = true, keys
+		reply.Offset, reply.PrimaryOffset = a.offset, a.offset
+		standby.offset = 0
+		log.Info(fmt.Sprintf("Server replication async, full sync of %s, %d keys at offset %d", request.Addr, len(keys), a.offset))
+		return reply, nil
+	}
+	standby.offset = request.Offset
+
+	if request.Offset == a.offset {
+		changed, done := a.changed, a.ctx.Done()
+		a.lock.Unlock()
+		timer := time.NewTimer(asyncPollTimeout)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-done:
+		}
+		timer.Stop()
+		a.lock.Lock()
+	}
+	reply.Offset, reply.PrimaryOffset = request.Offset, a.offset
+	for _, record := range a.backlog {
+		if record.Offset > request.Offset && len(reply.Records) < asyncMaxRecords {
+			reply.Records = append(reply.Records, record)
+			reply.Offset = record.Offset
+		}
+	}
+	return reply, nil
+}
+
+func (a *asyncReplication) syncLoop(s *Server) {
+	defer a.wait.Done()
+	self := net.JoinHostPort(config.Current().ServerHost, config.Current().ServerPort)
+	for a.ctx.Err() == nil {
+		a.lock.Lock()
+		request := syncRequest{ReplId: a.replId, Offset: a.offset, Addr: self}
+		a.lock.Unlock()
+		var reply syncReply
+		ctx, cancel := context.WithTimeout(a.ctx, asyncPollTimeout+asyncStandbyTimeout)
+		err := s.cluster.Transport().Call(ctx, a.replicaOf, MessageSync, request, &reply)
+		cancel()
+		if err == nil {
+			err = a.apply(s, &reply)
+		}
+		if err != nil {
+			if a.ctx.Err() != nil {
+				return
+			}
+			a.setLinked(false, err)
+			select {
+			case <-a.ctx.Done():
+			case <-time.After(asyncRetryInterval):
+			}
+			continue
+		}
+		a.setLinked(true, nil)
+	}
+}
+
+func (a *asyncReplication) setLinked(linked bool, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if linked {
+		a.lastIO = time.Now()
+	}
+	if linked == a.linked {
+		return
+	}
+	a.linked = linked
+	if linked {
+		log.Info(fmt.Sprintf("Server replication async, link to primary %s up", a.replicaOf))
+	} else {
+		log.Warn(fmt.Sprintf("Server replication async, link to primary %s down: %v", a.replicaOf, err))
+	}
+}
+
+// apply makes the keys of the standby those of the primary, a full sync
+// deletes the keys the primary does not have
+func (a *asyncReplication) apply(s *Server, reply *syncReply) error {
+	if reply.Full {
+		if err := s.replaceKeys(reply.Keys); err != nil {
+			return err
+		}
+	}
+	for _, record := range reply.Records {
+		if err := s.applyCommand(record.Command); err != nil {
+			return err
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if reply.Full {
+		a.fullSyncs++
+	}
+	a.replId, a.offset = reply.ReplId, reply.Offset
+	a.primaryOffset, a.primary = reply.PrimaryOffset, reply.Addr
+	return nil
+}
+
+// asyncHighWater feeds every batch the primary reserves to the standbys
+type asyncHighWater struct {
+	a *asyncReplication
+}
+
+func (h asyncHighWater) Reserve(key string, from, to int64) error {
+	if err := db.DATA.Reserve(key, from, to); err != nil {
+		return err
+	}
+	h.a.feed(&raft.Command{Op: raft.OpSet, Key: key, To: to})
+	return nil
+}
+
+func (h asyncHighWater) Release(key string, batchMax, cur int64) (bool, error) {
+	released, err := db.DATA.ReleaseKey(key, batchMax, cur)
+	if released {
+		h.a.feed(&raft.Command{Op: raft.OpSet, Key: key, To: cur})
+	}
+	return released, err
+}
+
+// propagate feeds a change of a key to the standbys, when a primary
+func (s *Server) propagate(command *raft.Command) {
+	if s.async != nil {
+		s.async.feed(command)
+	}
+}
+
+// redis command(promote)
+func (s *Server) handlePromote(r *Request) Reply {
+	if s.async == nil {
+		return NewErrorReply(ErrPrefixErr, "PROMOTE needs replication async")
+	}
+	a := s.async
+	a.promote.Lock()
+	defer a.promote.Unlock()
+	if a.isPrimary() {
+		return NewErrorReply(ErrPrefixErr, "This instance is already a primary")
+	}
+	// no record of the primary may move a key back once it is ahead
+	a.stop()
+
+	margin := config.Current().PromoteMargin
+	values, err := db.DATA.KeyValues()
+	if err == nil {
+		for key, value := range values {
+			if err = s.applyCommand(&raft.Command{Op: raft.OpSet, Key: key, To: s.promotedValue(key, value, margin)}); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		// still a standby, it syncs from the primary again
+		log.Error(fmt.Sprintf("Server replication async, promote error: %v", err))
+		a.lock.Lock()
+		a.ctx, a.cancel = context.WithCancel(context.Background())
+		a.lock.Unlock()
+		a.startSync(s)
+		return NewErrorReply(ErrPrefixErr, "%v", err)
+	}
+
+	a.lock.Lock()
+	log.Warn(fmt.Sprintf("Server replication async, promoted to primary, was the standby of %s at offset %d of %d, %d keys moved ahead by %d",
+		a.replicaOf, a.offset, a.primaryOffset, len(values), margin))
+	a.replicaOf, a.primary = "", ""
+	a.replId, a.offset, a.backlog = newReplId(), 0, nil
+	a.linked, a.promoted = false, time.Now()
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	a.lock.Unlock()
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+// promotedValue moves value ahead by margin, whole steps of a declared key
+// and never past its max
+func (s *Server) promotedValue(key string, value, margin int64) int64 {
+	max, step := int64(math.MaxInt64), int64(1)
+	s.RLock()
+	if spec := s.keySpecs[key]; spec != nil {
+		max, step = spec.Max, spec.Step
+	}
+	s.RUnlock()
+	margin = (margin + step - 1) / step * step
+	if value > max-margin {
+		return max
+	}
+	return value + margin
+}
+
+func (s *Server) infoAsync() []string {
+	a := s.async
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	lines := []string{infoLine("replication", "async")}
+	if a.replicaOf == "" {
+		online := make([]string, 0)
+		for _, standby := range a.standbys {
+			if time.Since(standby.seen) > asyncStandbyTimeout {
+				continue
+			}
+			host, port, _ := net.SplitHostPort(standby.addr)
+			online = append(online, fmt.Sprintf("ip=%s,port=%s,state=online,offset=%d,lag=%d",
+				host, port, standby.offset, int64(time.Since(standby.seen)/time.Second)))
+		}
+		lines = append(lines, infoLine("role", "master"), infoLine("connected_slaves", len(online)))
+		for i, standby := range online {
+			lines = append(lines, infoLine(fmt.Sprintf("slave%d", i), standby))
+		}
+		lines = append(lines, infoLine("master_replid", a.replId), infoLine("master_repl_offset", a.offset))
+		if !a.promoted.IsZero() {
+			lines = append(lines, infoLine("promoted_seconds_ago", int64(time.Since(a.promoted)/time.Second)))
+		}
+		return lines
+	}
+	host, port, _ := net.SplitHostPort(a.replicaOf)
+	status, lastIO := "down", int64(-1)
+	if a.linked {
+		status = "up"
+	}
+	if !a.lastIO.IsZero() {
+		lastIO = int64(time.Since(a.lastIO) / time.Second)
+	}
+	return append(lines,
+		infoLine("role", "slave"),
+		infoLine("master_host", host),
+		infoLine("master_port", port),
+		infoLine("master_link_status", status),
+		infoLine("master_last_io_seconds_ago", lastIO),
+		infoLine("master_replid", a.replId),
+		infoLine("master_repl_offset", a.primaryOffset),
+		infoLine("slave_repl_offset", a.offset),
+		infoLine("slave_repl_lag", a.primaryOffset-a.offset),
+		infoLine("slave_full_syncs", a.fullSyncs),
+		infoLine("promote_margin", config.Current().PromoteMargin),
+	)
+}
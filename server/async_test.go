@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"Didgen/cluster"
+	"Didgen/db"
+	"Didgen/model"
+	"Didgen/raft"
+)
+
+// newAsyncServer runs a node of replication async with trans_port trans,
+// other is the host:trans_port of the node on the other side, played by a
+// transport of the test
+func newAsyncServer(t *testing.T, trans, other, replicaOf string, setup func(c *model.ServerConfig)) *Server {
+	t.Helper()
+	_, otherPort, _ := net.SplitHostPort(other)
+	return newTestServer(t, func(c *model.ServerConfig) {
+		c.Replication = "async"
+		c.TransPort = trans
+		c.ClusterSecret = "s3cret"
+		c.ReplicaOf = replicaOf
+		c.Nodes = []map[string]string{
+			{"server_host": "127.0.0.1", "server_port": "0", "trans_port": trans},
+			{"server_host": "127.0.0.1", "server_port": "0", "trans_port": otherPort},
+		}
+		if setup != nil {
+			setup(c)
+		}
+	})
+}
+
+func newPeerTransport(t *testing.T, addr, node string) *cluster.Transport {
+	t.Helper()
+	tr := cluster.NewTransport(addr, "s3cret", []string{node})
+	if err := tr.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tr.Close)
+	return tr
+}
+
+func keyValue(t *testing.T, key string) int64 {
+	t.Helper()
+	values, err := db.DATA.KeyValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return -1
+	}
+	return value
+}
+
+// the standby takes a full sync then the records, reports its lag and moves
+// its keys ahead by promote_margin on PROMOTE
+func TestAsyncStandby(t *testing.T) {
+	trans, primary := freePort(t), "127.0.0.1:"+freePort(t)
+	s := newAsyncServer(t, trans, primary, primary, func(c *model.ServerConfig) {
+		c.PromoteMargin = 1000
+	})
+	// a key the primary does not have, dropped by the full sync
+	if err := s.applyCommand(&raft.Command{Op: raft.OpSet, Key: "stale", To: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	syncs := scriptedPrimary(t, primary, "127.0.0.1:"+trans)
+	if err := s.startCluster(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := s.testConn(t)
+	waitFor(t, "the records", func() bool {
+		return strings.Contains(c.do("INFO", "replication"), "slave_repl_offset:11\r\n")
+	})
+	fields := infoFields(c.do("INFO", "replication"))
+	want := map[string]string{
+		"replication":        "async",
+		"role":               "slave",
+		"master_port":        primary[len("127.0.0.1:"):],
+		"master_link_status": "up",
+		"master_repl_offset": "15",
+		"slave_repl_lag":     "4",
+		"slave_full_syncs":   "1",
+		"promote_margin":     "1000",
+	}
+	for key, value := range want {
+		if fields[key] != value {
+			t.Errorf("%s:%s, want %s", key, fields[key], value)
+		}
+	}
+	for key, value := range map[string]int64{"a": 200, "b": 5, "stale": -1} {
+		if got := keyValue(t, key); got != value {
+			t.Errorf("%s = %d on the standby, want %d", key, got, value)
+		}
+	}
+
+	if got := c.do("PROMOTE"); got != "+OK\r\n" {
+		t.Fatalf("PROMOTE = %q", got)
+	}
+	for key, value := range map[string]int64{"a": 1200, "b": 1005} {
+		if got := keyValue(t, key); got != value {
+			t.Errorf("%s = %d after PROMOTE, want %d", key, got, value)
+		}
+	}
+	fields = infoFields(c.do("INFO", "replication"))
+	if fields["role"] != "master" || fields["master_repl_offset"] != "0" || fields["promoted_seconds_ago"] == "" {
+		t.Errorf("INFO replication after PROMOTE: %v", fields)
+	}
+	if got := c.do("GET", "a"); got != bulk("1201") {
+		t.Errorf("GET a after PROMOTE = %q", got)
+	}
+	if got := c.do("PROMOTE"); !strings.HasPrefix(got, "-ERR ") {
+		t.Errorf("PROMOTE of a primary = %q", got)
+	}
+	n := atomic.LoadInt32(syncs)
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(syncs) != n {
+		t.Error("the promoted node still syncs from the primary")
+	}
+}
+
+// a PROMOTE which fails leaves a standby which syncs on
+func TestAsyncPromoteError(t *testing.T) {
+	trans, primary := freePort(t), "127.0.0.1:"+freePort(t)
+	s := newAsyncServer(t, trans, primary, primary, nil)
+	syncs := scriptedPrimary(t, primary, "127.0.0.1:"+trans)
+	if err := s.startCluster(); err != nil {
+		t.Fatal(err)
+	}
+	c := s.testConn(t)
+	waitFor(t, "the records", func() bool {
+		return strings.Contains(c.do("INFO", "replication"), "slave_repl_offset:11\r\n")
+	})
+	// a key of __idgen__ without its table, the keys can not be read
+	if err := db.DATA.DeleteKeyTable("b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do("PROMOTE"); !strings.HasPrefix(got, "-ERR ") {
+		t.Fatalf("PROMOTE = %q, want an error", got)
+	}
+	fields := infoFields(c.do("INFO", "replication"))
+	if fields["role"] != "slave" || fields["promoted_seconds_ago"] != "" {
+		t.Errorf("INFO replication after a failed PROMOTE: %v", fields)
+	}
+	n := atomic.LoadInt32(syncs)
+	waitFor(t, "a sync after the failed PROMOTE", func() bool { return atomic.LoadInt32(syncs) > n+1 })
+	waitFor(t, "the link", func() bool {
+		return strings.Contains(c.do("INFO", "replication"), "master_link_status:up\r\n")
+	})
+}
+
+// scriptedPrimary answers the syncs of standby at addr: all keys at offset
+// 10, then one record, then nothing new, and counts the syncs
+func scriptedPrimary(t *testing.T, addr, standby string) *int32 {
+	syncs := new(int32)
+	tr := newPeerTransport(t, addr, standby)
+	tr.Handle(MessageSync, func(from string, payload json.RawMessage) (interface{}, error) {
+		atomic.AddInt32(syncs, 1)
+		var request syncRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, err
+		}
+		reply := &syncReply{ReplId: "primary", Addr: "127.0.0.1:6379", Offset: request.Offset, PrimaryOffset: 15}
+		switch {
+		case request.ReplId != "primary":
+			reply.Full, reply.Keys = true, map[string]int64{"a": 100, "b": 5}
+			reply.Offset, reply.PrimaryOffset = 10, 10
+		case request.Offset == 10:
+			reply.Records = []asyncRecord{{Offset: 11, Command: &raft.Command{Op: raft.OpSet, Key: "a", To: 200}}}
+			reply.Offset = 11
+		default:
+			// nothing new, as the primary after asyncPollTimeout
+			time.Sleep(20 * time.Millisecond)
+		}
+		return reply, nil
+	})
+	return syncs
+}
+
+// the primary answers a standby with all keys, then with the changes after
+// its offset
+func TestAsyncPrimary(t *testing.T) {
+	trans, standby := freePort(t), "127.0.0.1:"+freePort(t)
+	s := newAsyncServer(t, trans, standby, "", func(c *model.ServerConfig) {
+		c.BatchSize = 100
+	})
+	if err := s.startCluster(); err != nil {
+		t.Fatal(err)
+	}
+	c := s.testConn(t)
+	if got := c.do("SET", "k", "10"); got != "+OK\r\n" {
+		t.Fatalf("SET k 10 = %q", got)
+	}
+
+	tr := newPeerTransport(t, standby, "127.0.0.1:"+trans)
+	sync := func(request syncRequest) *syncReply {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		reply := new(syncReply)
+		if err := tr.Call(ctx, "127.0.0.1:"+trans, MessageSync, request, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	reply := sync(syncRequest{Addr: "127.0.0.1:7000"})
+	if !reply.Full || reply.Keys["k"] != 10 || reply.Offset != 1 || reply.ReplId == "" {
+		t.Fatalf("first sync %+v, want all keys at offset 1", reply)
+	}
+
+	if got := c.do("GET", "k"); got != bulk("11") {
+		t.Fatalf("GET k = %q", got)
+	}
+	next := sync(syncRequest{ReplId: reply.ReplId, Offset: reply.Offset, Addr: "127.0.0.1:7000"})
+	if next.Full || len(next.Records) != 1 || next.Offset != 2 {
+		t.Fatalf("second sync %+v, want the reserved batch", next)
+	}
+	if command := next.Records[0].Command; command.Op != raft.OpSet || command.Key != "k" || command.To != 110 {
+		t.Errorf("record %+v, want the high-water of the batch", command)
+	}
+
+	fields := infoFields(c.do("INFO", "replication"))
+	if fields["role"] != "master" || fields["connected_slaves"] != "1" || fields["master_repl_offset"] != "2" {
+		t.Errorf("INFO replication %v", fields)
+	}
+	if !strings.HasPrefix(fields["slave0"], "ip=127.0.0.1,port=7000,state=online,offset=1,") {
+		t.Errorf("slave0:%s", fields["slave0"])
+	}
+
+	// a standby of another run of the primary starts over
+	if again := sync(syncRequest{ReplId: "other", Offset: 2, Addr: "127.0.0.1:7000"}); !again.Full || again.Keys["k"] != 110 {
+		t.Errorf("sync with another replid %+v, want a full sync", again)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client is the state of one connection, set by HELLO, CLIENT and friends
+type Client struct {
+	Id         int64
+	Name       string
+	LibName    string
+	LibVer     string
+	Addr       string
+	LocalAddr  string
+	Db         int
+	CreateTime time.Time
+	LastActive time.Time
+	LastCmd    string
+
+	userName      string
+	authenticated bool
+
+	conn     net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	protocol int32 // RESP2 or RESP3, switched by HELLO
+	closing  bool  // set by QUIT, the connection is closed after the reply
+
+	inRequest int32 // a request is being served, Shutdown lets it finish
+
+	lock      sync.Mutex
+	writeLock sync.Mutex
+}
+
+func (s *Server) newClient(conn net.Conn) *Client {
+	c := new(Client)
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.writer = bufio.NewWriter(conn)
+	c.protocol = RESP2
+	c.Addr = conn.RemoteAddr().String()
+	if conn.RemoteAddr().Network() == "unix" {
+		// unix socket peers have no address, show the socket like redis does
+		c.Addr = conn.LocalAddr().String() + ":0"
+	}
+	c.LocalAddr = conn.LocalAddr().String()
+	c.CreateTime = time.Now()
+	c.LastActive = c.CreateTime
+
+	s.clientsLock.Lock()
+	s.nextClientId++
+	c.Id = s.nextClientId
+	s.clients[c.Id] = c
+	s.clientsLock.Unlock()
+	return c
+}
+
+func (s *Server) removeClient(c *Client) {
+	s.clientsLock.Lock()
+	delete(s.clients, c.Id)
+	s.clientsLock.Unlock()
+}
+
+func (s *Server) ClientsCount() int {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	return len(s.clients)
+}
+
+func (s *Server) Clients() []*Client {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	result := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		result = append(result, c)
+	}
+	return result
+}
+
+func (c *Client) Protocol() int {
+	return int(atomic.LoadInt32(&c.protocol))
+}
+
+func (c *Client) SetProtocol(protocol int) {
+	atomic.StoreInt32(&c.protocol, int32(protocol))
+}
+
+// Write buffers reply data, it is only called from WriteReply
+func (c *Client) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// WriteReply writes a whole reply at once, replies and pushes sent from other
+// goroutines never interleave
+func (c *Client) WriteReply(reply Reply) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := reply.WriteTo(c); err != nil {
+		c.writer.Reset(c.conn)
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// Push sends an out of band message such as a notification to the client
+func (c *Client) Push(values ...Reply) error {
+	return c.WriteReply(&PushReply{
+		values: values,
+	})
+}
+
+// User is the ACL user of the connection, set by AUTH or HELLO AUTH
+func (c *Client) User() (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.userName, c.authenticated
+}
+
+func (c *Client) SetUser(name string, authenticated bool) {
+	c.lock.Lock()
+	c.userName = name
+	c.authenticated = authenticated
+	c.lock.Unlock()
+}
+
+func (c *Client) touch(command string) {
+	c.lock.Lock()
+	c.LastActive = time.Now()
+	c.LastCmd = strings.ToLower(command)
+	c.lock.Unlock()
+}
+
+// Info formats the client the way CLIENT LIST and CLIENT INFO do
+func (c *Client) Info() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d db=%d cmd=%s lib-name=%s lib-ver=%s resp=%d user=%s",
+		c.Id,
+		c.Addr,
+		c.LocalAddr,
+		c.Name,
+		int64(now.Sub(c.CreateTime).Seconds()),
+		int64(now.Sub(c.LastActive).Seconds()),
+		c.Db,
+		c.LastCmd,
+		c.LibName,
+		c.LibVer,
+		c.Protocol(),
+		c.userName)
+}
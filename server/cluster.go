@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"Didgen/cluster"
+	"Didgen/config"
+	log "Didgen/logger_seelog"
+	"Didgen/model"
+)
+
+// ClusterConfig takes the node of cfg and its peers, the entry of nodes
+// which is this node itself is left out
+func ClusterConfig(cfg *model.ServerConfig) cluster.Config {
+	c := cluster.Config{
+		ServerId:   cfg.ServerId,
+		Host:       cfg.ServerHost,
+		ServerPort: cfg.ServerPort,
+		TransPort:  cfg.TransPort,
+		Node:       net.JoinHostPort(cfg.ServerHost, cfg.TransPort),
+		Secret:     cfg.ClusterSecret,
+		Interval:   time.Duration(cfg.HeartbeatTimeInterval) * time.Second,
+		Timeout:    time.Duration(cfg.HeartbeatTimeOut) * time.Second,
+	}
+	for _, node := range cfg.Nodes {
+		peer := cluster.PeerConfig{
+			Host:       node["server_host"],
+			ServerPort: node["server_port"],
+			TransPort:  node["trans_port"],
+		}
+		if peer.TransPort == cfg.TransPort && peer.ServerPort == cfg.ServerPort && isLocalHost(peer.Host, cfg.ServerHost) {
+			// the peers know this node by its entry
+			c.Node = net.JoinHostPort(peer.Host, peer.TransPort)
+			continue
+		}
+		c.Peers = append(c.Peers, peer)
+	}
+	return c
+}
+
+func isLocalHost(host, serverHost string) bool {
+	if host == serverHost || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// startCluster starts the membership when nodes lists other nodes, a single
+// node does not listen on trans_port unless it replicates or shards
+func (s *Server) startCluster() error {
+	cfg := ClusterConfig(config.Current())
+	if len(cfg.Peers) == 0 && config.Current().Replication == "none" && s.slots == nil {
+		return nil
+	}
+	s.cluster = cluster.New(cfg)
+	s.cluster.Transport().Handle(MessageProxy, s.handleProxy)
+	if s.slots != nil {
+		s.startSlots()
+	}
+	switch config.Current().Replication {
+	case "raft":
+		if err := s.startRaft(); err != nil {
+			return err
+		}
+	case "async":
+		s.startAsync()
+	}
+	return s.cluster.Start()
+}
+
+func (s *Server) closeCluster() {
+	if s.raft != nil {
+		s.raft.stop()
+		log.Info("Server replication stopped")
+	}
+	if s.async != nil {
+		s.async.stop()
+	}
+	if s.slots != nil && s.cluster != nil {
+		s.slots.stop()
+	}
+	if s.cluster != nil {
+		s.cluster.Close()
+		log.Info("Server cluster transport closed")
+	}
+}
+
+// redis command(cluster nodes|myid|slots|shards|info|keyslot|countkeysinslot|
+// getkeysinslot|migrate)
+func (s *Server) handleCluster(r *Request) Reply {
+	if s.cluster == nil {
+		return NewErrorReply(ErrPrefixErr, "This instance has cluster support disabled")
+	}
+	sub := strings.ToUpper(string(r.Arguments[0]))
+	switch sub {
+	case "MYID":
+		return &BulkReply{
+			value: []byte(s.cluster.Self().Id),
+		}
+	case "NODES":
+		return &VerbatimReply{
+			format: "txt",
+			value:  []byte(s.clusterNodes()),
+		}
+	}
+	if reply := s.handleClusterSlots(sub, r); reply != nil {
+		return reply
+	}
+	return NewErrorReply(ErrPrefixErr, "unknown subcommand '%s'. Try CLUSTER HELP.", r.Arguments[0])
+}
+
+// clusterNodes is the CLUSTER NODES text, one line per node:
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slots>
+func (s *Server) clusterNodes() string {
+	self := s.cluster.Self()
+	selfAddr := ""
+	if s.slots != nil {
+		selfAddr = s.slots.self
+	}
+	lines := []string{
+		fmt.Sprintf("%s %s:%s@%s myself,master - 0 0 0 connected%s", self.Id, self.Host, self.ServerPort, self.TransPort, s.nodeSlots(selfAddr)),
+	}
+	for _, peer := range s.cluster.Peers() {
+		id := peer.Info.Id
+		if id == "" {
+			id = strings.Repeat("0", 40)
+		}
+		flags := "master"
+		switch peer.State {
+		case cluster.StateUnknown:
+			flags = "handshake"
+		case cluster.StateSuspect:
+			flags = "master,fail?"
+		case cluster.StateDead:
+			flags = "master,fail"
+		}
+		link := "disconnected"
+		if peer.Linked {
+			link = "connected"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s:%s@%s %s - %d %d 0 %s%s",
+			id, peer.Config.Host, peer.Config.ServerPort, peer.Config.TransPort, flags,
+			unixMilli(peer.PingSent), unixMilli(peer.PongRecv), link,
+			s.nodeSlots(net.JoinHostPort(peer.Config.Host, peer.Config.ServerPort))))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// nodeSlots is the slots column of a node in CLUSTER NODES
+func (s *Server) nodeSlots(addr string) string {
+	if s.slots == nil {
+		return ""
+	}
+	ranges := s.slots.ranges(addr)
+	if len(ranges) == 0 {
+		return ""
+	}
+	return " " + cluster.FormatSlots(ranges)
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// infoCluster reports cluster_enabled:1 with cluster_enabled yes only, as
+// clients take it for CLUSTER SLOTS support, the membership of other nodes
+// has fields of its own
+func (s *Server) infoCluster() []string {
+	lines := []string{infoLine("cluster_enabled", 0)}
+	if s.slots != nil {
+		lines[0] = infoLine("cluster_enabled", 1)
+	}
+	if s.cluster != nil {
+		states := make(map[string]int)
+		peers := s.cluster.Peers()
+		for _, peer := range peers {
+			states[peer.State]++
+		}
+		lines = append(lines,
+			infoLine("cluster_known_nodes", len(peers)+1),
+			infoLine("cluster_nodes_alive", states[cluster.StateAlive]),
+			infoLine("cluster_nodes_suspect", states[cluster.StateSuspect]),
+			infoLine("cluster_nodes_dead", states[cluster.StateDead]))
+	}
+	if s.slots != nil {
+		owned := 0
+		for _, r := range s.slots.ranges(s.slots.self) {
+			owned += r.End - r.Start + 1
+		}
+		lines = append(lines,
+			infoLine("cluster_slots_served", owned),
+			infoLine("cluster_current_epoch", s.slots.epoch()))
+	}
+	return lines
+}
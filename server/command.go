@@ -1,11 +1,8 @@
 package server
 
 import (
-	"strconv"
-	"strings"
-
-	"Didgen/config"
 	"Didgen/db"
+	"Didgen/raft"
 )
 
 func (s *Server) handleGet(r *Request) Reply {
@@ -13,7 +10,6 @@ func (s *Server) handleGet(r *Request) Reply {
 	var ok bool
 	var id int64
 	var err error
-	var idStr string
 
 	if r.HasArgument(0) == false {
 		return ErrNotEnoughArgs
@@ -23,45 +19,40 @@ func (s *Server) handleGet(r *Request) Reply {
 	if len(key) == 0 {
 		return ErrNoKey
 	}
+	if reply := s.redirect(r); reply != nil {
+		return reply
+	}
 
-	if strings.HasPrefix(key, db.ConfigPrefix) {
-		k := key[len(db.ConfigPrefix):]
-		idStr, err = config.Config.Get(k)
-		if err != nil {
+	s.Lock()
+	idgen, ok = s.keyGeneratorMap[key]
+	s.Unlock()
+
+	if ok == false {
+		if idgen = s.sharedKey(key); idgen == nil {
 			return &BulkReply{
 				value: nil,
 			}
 		}
-		return &StatusReply{
-			code: idStr,
-		}
-	} else {
-		s.Lock()
-		idgen, ok = s.keyGeneratorMap[key]
+	}
 
-		if ok == false {
-			s.Unlock()
+	id, err = idgen.Next()
+	if err != nil {
+		if s.sharedKeyDeleted(key, idgen) {
 			return &BulkReply{
 				value: nil,
 			}
 		}
-
-		s.Unlock()
-		id, err = idgen.Next()
-		if err != nil {
-			return &ErrorReply{
-				message: err.Error(),
-			}
+		return &ErrorReply{
+			message: err.Error(),
 		}
-		idStr = strconv.FormatInt(id, 10)
 	}
 
-	return &BulkReply{
-		value: []byte(idStr),
+	return &IdReply{
+		id: id,
 	}
 }
 
-//redis command(set abc 12)
+// redis command(set abc 12)
 func (s *Server) handleSet(r *Request) Reply {
 	var idgen *db.IdGenerator
 	var ok bool
@@ -76,120 +67,151 @@ func (s *Server) handleSet(r *Request) Reply {
 		return ErrNoKey
 	}
 
-	if strings.HasPrefix(key, db.ConfigPrefix) {
-		k := key[len(db.ConfigPrefix):]
-		value, errReply := r.GetString(1)
-		if errReply != nil {
-			return errReply
-		}
-		err = db.CONFIG.Set(k, value)
+	value, errReply := r.GetInt(1)
+	if errReply != nil {
+		return errReply
+	}
+	if reply := s.redirect(r); reply != nil {
+		return reply
+	}
+	if replicated, err := s.replicate(&raft.Command{Op: raft.OpSet, Key: key, To: value}); replicated {
 		if err != nil {
 			return &ErrorReply{
 				message: err.Error(),
 			}
 		}
-	} else {
-		value, errReply := r.GetInt(1)
-		if errReply != nil {
-			return errReply
-		}
-
-		s.Lock()
-		idgen, ok = s.keyGeneratorMap[key]
-		if ok == false {
-			idgen, err = db.NewIdGenerator(key)
-			if err != nil {
-				s.Unlock()
-				return &ErrorReply{
-					message: err.Error(),
-				}
-			}
-			s.keyGeneratorMap[key] = idgen
+		return &StatusReply{
+			code: "OK",
 		}
+	}
 
-		s.Unlock()
-		err = s.SetKey(key)
+	s.Lock()
+	idgen, ok = s.keyGeneratorMap[key]
+	if ok == false {
+		idgen, err = db.NewIdGenerator(key)
 		if err != nil {
+			s.Unlock()
 			return &ErrorReply{
 				message: err.Error(),
 			}
 		}
+		idgen.SetSpec(s.keySpecs[key])
+		s.keyGeneratorMap[key] = idgen
+	}
 
-		err = idgen.Reset(value, false)
-		if err != nil {
-			return &ErrorReply{
-				message: err.Error(),
-			}
+	s.Unlock()
+	err = s.SetKey(key)
+	if err != nil {
+		return &ErrorReply{
+			message: err.Error(),
 		}
 	}
 
+	err = idgen.Reset(value, false)
+	if err != nil {
+		return &ErrorReply{
+			message: err.Error(),
+		}
+	}
+	s.propagate(&raft.Command{Op: raft.OpSet, Key: key, To: value})
+
 	return &StatusReply{
 		code: "OK",
 	}
 }
 
+// redis command(exists key [key ...])
 func (s *Server) handleExists(r *Request) Reply {
 	var ok bool
-	var id int64
+	var count int64
 
 	if r.HasArgument(0) == false {
 		return ErrNotEnoughArgs
 	}
-
-	key := string(r.Arguments[0])
-	if len(key) == 0 {
-		return ErrNoKey
+	if reply := s.slotRedirect(r); reply != nil {
+		return reply
 	}
-	s.Lock()
-	_, ok = s.keyGeneratorMap[key]
-	s.Unlock()
-	if ok {
-		id = 1
+
+	for _, arg := range r.Arguments {
+		key := string(arg)
+		if len(key) == 0 {
+			return ErrNoKey
+		}
+		s.Lock()
+		_, ok = s.keyGeneratorMap[key]
+		s.Unlock()
+		if ok || s.sharedKey(key) != nil {
+			count++
+		}
 	}
 
 	return &IntReply{
-		number: id,
+		number: count,
 	}
 }
 
+// redis command(del key [key ...])
 func (s *Server) handleDel(r *Request) Reply {
-	var idgen *db.IdGenerator
-	var ok bool
-	var id int64 = 0
+	var count int64 = 0
 
 	if r.HasArgument(0) == false {
 		return ErrNotEnoughArgs
 	}
-
-	key := string(r.Arguments[0])
-	if len(key) == 0 {
-		return ErrNoKey
-	}
-	s.Lock()
-	idgen, ok = s.keyGeneratorMap[key]
-	if ok {
-		delete(s.keyGeneratorMap, key)
+	if reply := s.redirect(r); reply != nil {
+		return reply
 	}
-	s.Unlock()
-	if ok {
-		err := idgen.Delete()
-		if err != nil {
-			return &ErrorReply{
-				message: err.Error(),
-			}
+
+	for _, arg := range r.Arguments {
+		key := string(arg)
+		if len(key) == 0 {
+			return ErrNoKey
 		}
-		err = s.DelKey(key)
+		deleted, err := s.delKey(key)
 		if err != nil {
 			return &ErrorReply{
 				message: err.Error(),
 			}
 		}
-		id = 1
+		if deleted {
+			count++
+		}
 	}
 
 	return &IntReply{
-		number: id,
+		number: count,
+	}
+}
+
+func (s *Server) delKey(key string) (bool, error) {
+	if s.replicated() {
+		s.RLock()
+		_, ok := s.keyGeneratorMap[key]
+		s.RUnlock()
+		if !ok {
+			return false, nil
+		}
+		_, err := s.replicate(&raft.Command{Op: raft.OpDel, Key: key})
+		return err == nil, err
+	}
+	s.Lock()
+	idgen, ok := s.keyGeneratorMap[key]
+	if ok {
+		delete(s.keyGeneratorMap, key)
+	}
+	s.Unlock()
+	if !ok {
+		return false, nil
+	}
+	err := idgen.Delete()
+	if err != nil {
+		return false, err
+	}
+	err = s.DelKey(key)
+	if err != nil {
+		return false, err
 	}
+	s.propagate(&raft.Command{Op: raft.OpDel, Key: key})
+	return true, nil
 }
 
 func (s *Server) handleSelect(r *Request) Reply {
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"Didgen/config"
+	"Didgen/db"
+	log "Didgen/logger_seelog"
+	"Didgen/model"
+)
+
+// redis command(config get|set|resetstat|rewrite ...), history and rollback
+// are didgen's own
+func (s *Server) handleConfig(r *Request) Reply {
+	sub := strings.ToUpper(string(r.Arguments[0]))
+	switch sub {
+	case "GET":
+		if len(r.Arguments) < 2 {
+			return ErrWrongArgs("config|get")
+		}
+		return s.configGet(r.Arguments[1:])
+	case "SET":
+		if len(r.Arguments) < 3 || len(r.Arguments)%2 == 0 {
+			return ErrWrongArgs("config|set")
+		}
+		return s.configSet(r.Arguments[1:], clientIdentity(r.Client))
+	case "HISTORY":
+		count := int64(10)
+		if r.HasArgument(1) {
+			var errReply *ErrorReply
+			count, errReply = r.GetInt(1)
+			if errReply != nil || count < 1 {
+				return NewErrorReply(ErrPrefixErr, "count is not a positive integer")
+			}
+		}
+		return s.configHistory(count)
+	case "ROLLBACK":
+		revision, errReply := r.GetInt(1)
+		if errReply != nil {
+			return NewErrorReply(ErrPrefixErr, "revision is not an integer")
+		}
+		return s.configRollback(revision, clientIdentity(r.Client))
+	case "RESETSTAT":
+		s.stats.Reset()
+		db.Stats.ResetStats()
+		return &StatusReply{
+			code: "OK",
+		}
+	case "REWRITE":
+		if err := s.configRewrite(); err != nil {
+			return NewErrorReply(ErrPrefixErr, "Rewriting config file: %v", err)
+		}
+		return &StatusReply{
+			code: "OK",
+		}
+	}
+	return NewErrorReply(ErrPrefixErr, "unknown subcommand '%s'. Try CONFIG HELP.", r.Arguments[0])
+}
+
+// configGet replies the keys matching any of the glob patterns, users and
+// cluster_secret are left out as they hold passwords
+func (s *Server) configGet(patterns [][]byte) Reply {
+	reply := NewMapReply()
+	for _, f := range config.Schema {
+		if f.Type == config.TypeUsers || f.Type == config.TypeSecret {
+			continue
+		}
+		for _, pattern := range patterns {
+			if !globMatch(strings.ToLower(string(pattern)), f.Key) {
+				continue
+			}
+			value, _ := config.Current().Get(f.Key)
+			if f.Type == config.TypeNodes || f.Type == config.TypeKeys {
+				compact := new(bytes.Buffer)
+				json.Compact(compact, []byte(value))
+				value = compact.String()
+			}
+			reply.Add(f.Key, &BulkReply{value: []byte(value)})
+			break
+		}
+	}
+	return reply
+}
+
+// configSet checks every pair before applying any, the values are kept in
+// configuration.db and override configuration.yml until CONFIG REWRITE
+func (s *Server) configSet(args [][]byte, client string) Reply {
+	values := make(map[string]string)
+	keys := make([]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		key := strings.ToLower(string(args[i]))
+		field, ok := config.LookupField(key)
+		if !ok {
+			return NewErrorReply(ErrPrefixErr, "Unknown option or number of arguments for CONFIG SET - '%s'", args[i])
+		}
+		if !reloadable[key] || field.Type == config.TypeUsers || field.Type == config.TypeKeys {
+			return NewErrorReply(ErrPrefixErr, "CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", key)
+		}
+		if _, ok := values[key]; ok {
+			return NewErrorReply(ErrPrefixErr, "CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", key)
+		}
+		value, err := field.Validate(string(args[i+1]))
+		if err != nil {
+			return NewErrorReply(ErrPrefixErr, "CONFIG SET failed (possibly related to argument '%s') - %v", key, err)
+		}
+		values[key] = value
+		keys = append(keys, key)
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	if err := s.setConfig(values, keys, "set", client); err != nil {
+		return NewErrorReply(ErrPrefixErr, "CONFIG SET failed - %v", err)
+	}
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+// setConfig keeps the values in configuration.db, records them as a revision
+// of the history and applies them
+func (s *Server) setConfig(values map[string]string, keys []string, action, client string) error {
+	changes := make([]db.ConfigChange, 0, len(keys))
+	for _, key := range keys {
+		oldValue, _ := config.Current().Get(key)
+		changes = append(changes, db.ConfigChange{Key: key, Old: oldValue, New: values[key]})
+	}
+	revision, err := db.CONFIG.Commit(action, client, changes)
+	if err != nil {
+		return err
+	}
+	config.Update(func(c *model.ServerConfig) {
+		for _, change := range changes {
+			c.Set(change.Key, change.New)
+		}
+	})
+	for _, change := range changes {
+		config.SetSource(change.Key, "db")
+		log.Info(fmt.Sprintf("Server config %s %s: '%s' -> '%s', revision %d by %s", action, change.Key, change.Old, change.New, revision, client))
+	}
+	s.applyConfig(keys)
+	return nil
+}
+
+// configHistory replies the changes of the last count revisions, newest first
+func (s *Server) configHistory(count int64) Reply {
+	changes, err := db.CONFIG.History(count)
+	if err != nil {
+		return NewErrorReply(ErrPrefixErr, "%v", err)
+	}
+	values := make([]Reply, 0, len(changes))
+	for _, change := range changes {
+		values = append(values, NewMapReply().
+			Add("revision", &IntReply{number: change.Revision}).
+			Add("time", &IntReply{number: change.Time.Unix()}).
+			Add("action", &BulkReply{value: []byte(change.Action)}).
+			Add("client", &BulkReply{value: []byte(change.Client)}).
+			Add("key", &BulkReply{value: []byte(change.Key)}).
+			Add("old", &BulkReply{value: []byte(change.Old)}).
+			Add("new", &BulkReply{value: []byte(change.New)}))
+	}
+	return &ArrayReply{
+		values: values,
+	}
+}
+
+// configRollback sets the keys changed after revision back to the values they
+// had then, as a new revision, so a rollback can be rolled back too
+func (s *Server) configRollback(revision int64, client string) Reply {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	values, err := db.CONFIG.RollbackValues(revision)
+	if err != nil {
+		return NewErrorReply(ErrPrefixErr, "CONFIG ROLLBACK failed - %v", err)
+	}
+	keys := make([]string, 0, len(values))
+	for _, f := range config.Schema {
+		if _, ok := values[f.Key]; !ok {
+			continue
+		}
+		if !reloadable[f.Key] || f.Type == config.TypeUsers || f.Type == config.TypeKeys {
+			return NewErrorReply(ErrPrefixErr, "CONFIG ROLLBACK failed (possibly related to argument '%s') - can't set immutable config", f.Key)
+		}
+		value, err := f.Validate(values[f.Key])
+		if err != nil {
+			return NewErrorReply(ErrPrefixErr, "CONFIG ROLLBACK failed (possibly related to argument '%s') - %v", f.Key, err)
+		}
+		if current, _ := config.Current().Get(f.Key); current == value {
+			continue
+		}
+		values[f.Key] = value
+		keys = append(keys, f.Key)
+	}
+	if err = s.setConfig(values, keys, fmt.Sprintf("rollback to %d", revision), client); err != nil {
+		return NewErrorReply(ErrPrefixErr, "CONFIG ROLLBACK failed - %v", err)
+	}
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+// clientIdentity names the client in the history, user and address
+func clientIdentity(client *Client) string {
+	if client == nil {
+		return "internal"
+	}
+	name, _ := client.User()
+	if name == "" {
+		name = DefaultUser
+	}
+	return fmt.Sprintf("%s@%s", name, client.Addr)
+}
+
+// configRewrite writes the values set by CONFIG SET into the config file and
+// removes them from configuration.db, the file wins from then on
+func (s *Server) configRewrite() error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	if config.ConfigPath == "" {
+		return fmt.Errorf("the server is running without a config file")
+	}
+	overrides, err := db.CONFIG.Overrides()
+	if err != nil {
+		return err
+	}
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(config.ConfigPath)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	written := make(map[string]bool)
+	for i, line := range lines {
+		for key, value := range overrides {
+			if strings.HasPrefix(line, key+":") {
+				lines[i] = fmt.Sprintf("%s: %s", key, value)
+				written[key] = true
+			}
+		}
+	}
+	for _, f := range config.Schema {
+		if value, ok := overrides[f.Key]; ok && !written[f.Key] {
+			lines = append(lines, fmt.Sprintf("%s: %s", f.Key, value))
+		}
+	}
+
+	info, err := os.Stat(config.ConfigPath)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(config.ConfigPath), ".configuration.yml.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(strings.Join(lines, "\n") + "\n"); err == nil {
+		err = tmp.Chmod(info.Mode())
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), config.ConfigPath); err != nil {
+		return err
+	}
+
+	for key := range overrides {
+		if err = db.CONFIG.DeleteOverride(key); err != nil {
+			return err
+		}
+		config.SetSource(key, "file")
+	}
+	log.Info(fmt.Sprintf("Server config rewrite %s, %d keys", config.ConfigPath, len(overrides)))
+	return nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"strings"
+)
+
+func (s *Server) handlePing(r *Request) Reply {
+	if len(r.Arguments) > 1 {
+		return ErrWrongArgs(r.Command)
+	}
+	if r.HasArgument(0) {
+		return &BulkReply{
+			value: r.Arguments[0],
+		}
+	}
+	return &StatusReply{
+		code: "PONG",
+	}
+}
+
+func (s *Server) handleEcho(r *Request) Reply {
+	return &BulkReply{
+		value: r.Arguments[0],
+	}
+}
+
+func (s *Server) handleQuit(r *Request) Reply {
+	if r.Client != nil {
+		r.Client.closing = true
+	}
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+// redis command(hello [protover [auth username password] [setname clientname]])
+func (s *Server) handleHello(r *Request) Reply {
+	protocol := RESP2
+	if r.Client != nil {
+		protocol = r.Client.Protocol()
+	}
+	if r.HasArgument(0) {
+		protover, errReply := r.GetInt(0)
+		if errReply != nil {
+			return NewErrorReply(ErrPrefixErr, "Protocol version is not an integer or out of range")
+		}
+		if protover != RESP2 && protover != RESP3 {
+			return NewErrorReply(ErrPrefixNoProto, "unsupported protocol version")
+		}
+		protocol = int(protover)
+	}
+
+	authenticated := true
+	if r.Client != nil && s.acl.Enabled() {
+		_, authenticated = r.Client.User()
+	}
+	for i := 1; i < len(r.Arguments); i++ {
+		option := strings.ToUpper(string(r.Arguments[i]))
+		switch {
+		case option == "AUTH" && i+2 < len(r.Arguments):
+			if r.Client != nil {
+				if errReply := s.authenticate(r.Client, string(r.Arguments[i+1]), string(r.Arguments[i+2])); errReply != nil {
+					return errReply
+				}
+			}
+			authenticated = true
+			i += 2
+		case option == "SETNAME" && i+1 < len(r.Arguments):
+			name := string(r.Arguments[i+1])
+			if !validClientName(name) {
+				return NewErrorReply(ErrPrefixErr, "Client names cannot contain spaces, newlines or special characters.")
+			}
+			if r.Client != nil {
+				r.Client.lock.Lock()
+				r.Client.Name = name
+				r.Client.lock.Unlock()
+			}
+			i++
+		default:
+			return NewErrorReply(ErrPrefixErr, "Syntax error in HELLO option '%s'", r.Arguments[i])
+		}
+	}
+
+	if !authenticated {
+		return NewErrorReply(ErrPrefixNoAuth, "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+
+	// the reply already uses the negotiated protocol
+	var id int64
+	if r.Client != nil {
+		r.Client.SetProtocol(protocol)
+		id = r.Client.Id
+	}
+	return NewMapReply().
+		Add("server", &BulkReply{value: []byte("redis")}).
+		Add("version", &BulkReply{value: []byte(RedisVersion)}).
+		Add("proto", &IntReply{number: int64(protocol)}).
+		Add("id", &IntReply{number: id}).
+		Add("mode", &BulkReply{value: []byte("standalone")}).
+		Add("role", &BulkReply{value: []byte(s.role())}).
+		Add("modules", &ArrayReply{values: []Reply{}})
+}
+
+func validClientName(name string) bool {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleClient(r *Request) Reply {
+	sub := strings.ToUpper(string(r.Arguments[0]))
+	client := r.Client
+	if client == nil {
+		return NewErrorReply(ErrPrefixErr, "CLIENT %s needs a connection", sub)
+	}
+
+	switch sub {
+	case "ID":
+		return &IntReply{
+			number: client.Id,
+		}
+	case "GETNAME":
+		client.lock.Lock()
+		name := client.Name
+		client.lock.Unlock()
+		if name == "" {
+			return &BulkReply{
+				value: nil,
+			}
+		}
+		return &BulkReply{
+			value: []byte(name),
+		}
+	case "SETNAME":
+		if len(r.Arguments) != 2 {
+			return ErrWrongArgs("client|setname")
+		}
+		name := string(r.Arguments[1])
+		if !validClientName(name) {
+			return NewErrorReply(ErrPrefixErr, "Client names cannot contain spaces, newlines or special characters.")
+		}
+		client.lock.Lock()
+		client.Name = name
+		client.lock.Unlock()
+	case "SETINFO":
+		if len(r.Arguments) != 3 {
+			return ErrWrongArgs("client|setinfo")
+		}
+		value := string(r.Arguments[2])
+		if !validClientName(value) {
+			return NewErrorReply(ErrPrefixErr, "%s cannot contain spaces, newlines or special characters.", r.Arguments[1])
+		}
+		client.lock.Lock()
+		defer client.lock.Unlock()
+		switch strings.ToUpper(string(r.Arguments[1])) {
+		case "LIB-NAME":
+			client.LibName = value
+		case "LIB-VER":
+			client.LibVer = value
+		default:
+			return NewErrorReply(ErrPrefixErr, "Unrecognized option '%s'", r.Arguments[1])
+		}
+	case "INFO":
+		return &VerbatimReply{
+			format: "txt",
+			value:  []byte(client.Info() + "\n"),
+		}
+	case "LIST":
+		lines := make([]string, 0)
+		for _, c := range s.Clients() {
+			lines = append(lines, c.Info()+"\n")
+		}
+		return &VerbatimReply{
+			format: "txt",
+			value:  []byte(strings.Join(lines, "")),
+		}
+	default:
+		return NewErrorReply(ErrPrefixErr, "unknown subcommand '%s'. Try CLIENT HELP.", r.Arguments[0])
+	}
+
+	return &StatusReply{
+		code: "OK",
+	}
+}
+
+func (s *Server) handleCommand(r *Request) Reply {
+	if !r.HasArgument(0) {
+		values := make([]Reply, 0, len(commandTable))
+		for _, name := range sortedCommandNames() {
+			values = append(values, commandTable[name].Reply())
+		}
+		return &ArrayReply{
+			values: values,
+		}
+	}
+
+	sub := strings.ToUpper(string(r.Arguments[0]))
+	switch sub {
+	case "COUNT":
+		return &IntReply{
+			number: int64(len(commandTable)),
+		}
+	case "LIST":
+		values := make([]Reply, 0, len(commandTable))
+		for _, name := range sortedCommandNames() {
+			values = append(values, &BulkReply{value: []byte(name)})
+		}
+		return &ArrayReply{
+			values: values,
+		}
+	case "INFO":
+		values := make([]Reply, 0, len(r.Arguments)-1)
+		for _, name := range r.Arguments[1:] {
+			if cmd, ok := lookupCommand(string(name)); ok {
+				values = append(values, cmd.Reply())
+			} else {
+				values = append(values, &BulkReply{value: nil})
+			}
+		}
+		return &ArrayReply{
+			values: values,
+		}
+	case "DOCS":
+		// no docs are shipped, clients treat an empty reply as "nothing to show"
+		return NewMapReply()
+	default:
+		return NewErrorReply(ErrPrefixErr, "unknown subcommand '%s'. Try COMMAND HELP.", r.Arguments[0])
+	}
+}
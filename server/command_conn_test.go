@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"Didgen/model"
+)
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func TestPingEcho(t *testing.T) {
+	c := newTestServer(t, nil).testConn(t)
+	for _, protocol := range []string{"2", "3"} {
+		c.do("HELLO", protocol)
+		cases := []struct {
+			args []string
+			want string
+		}{
+			{[]string{"PING"}, "+PONG\r\n"},
+			{[]string{"ping", "hello"}, bulk("hello")},
+			{[]string{"PING", "a", "b"}, "-ERR wrong number of arguments for 'ping' command\r\n"},
+			{[]string{"ECHO", "hello world"}, bulk("hello world")},
+			{[]string{"ECHO", ""}, "$0\r\n\r\n"},
+			{[]string{"ECHO"}, "-ERR wrong number of arguments for 'echo' command\r\n"},
+			{[]string{"NOSUCH", "x"}, "-ERR unknown command 'nosuch', with args beginning with: 'x'\r\n"},
+		}
+		for _, tc := range cases {
+			if got := c.do(tc.args...); got != tc.want {
+				t.Errorf("RESP%s %v = %q, want %q", protocol, tc.args, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	s := newTestServer(t, nil)
+	c := s.testConn(t)
+	id := c.do("CLIENT", "ID")
+	fields := func(n string) string {
+		return bulk("server") + bulk("redis") +
+			bulk("version") + bulk(RedisVersion) +
+			bulk("proto") + ":" + n + "\r\n" +
+			bulk("id") + strings.TrimSuffix(id, "\r\n") + "\r\n" +
+			bulk("mode") + bulk("standalone") +
+			bulk("role") + bulk("master") +
+			bulk("modules") + "*0\r\n"
+	}
+	if got, want := c.do("HELLO", "3"), "%7\r\n"+fields("3"); got != want {
+		t.Errorf("HELLO 3 = %q, want %q", got, want)
+	}
+	// the protocol stays RESP3 without a version
+	if got, want := c.do("HELLO"), "%7\r\n"+fields("3"); got != want {
+		t.Errorf("HELLO = %q, want %q", got, want)
+	}
+	if got, want := c.do("HELLO", "2"), "*14\r\n"+fields("2"); got != want {
+		t.Errorf("HELLO 2 = %q, want %q", got, want)
+	}
+	if got, want := c.do("HELLO", "4"), "-NOPROTO unsupported protocol version\r\n"; got != want {
+		t.Errorf("HELLO 4 = %q, want %q", got, want)
+	}
+	if got, want := c.do("HELLO", "3", "SETNAME", "a b"), "-ERR Client names cannot contain spaces, newlines or special characters.\r\n"; got != want {
+		t.Errorf("HELLO 3 SETNAME = %q, want %q", got, want)
+	}
+	// a failed HELLO keeps RESP2
+	if got := c.do("CLIENT", "GETNAME"); got != "$-1\r\n" {
+		t.Errorf("CLIENT GETNAME after failed HELLO = %q, want $-1", got)
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := newTestServer(t, nil)
+	c := s.testConn(t)
+	other := s.testConn(t)
+	id := c.do("CLIENT", "ID")
+	if id == other.do("CLIENT", "ID") || !strings.HasPrefix(id, ":") {
+		t.Fatalf("CLIENT ID = %q", id)
+	}
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CLIENT", "GETNAME"}, "$-1\r\n"},
+		{[]string{"CLIENT", "SETNAME", "worker-1"}, "+OK\r\n"},
+		{[]string{"CLIENT", "GETNAME"}, bulk("worker-1")},
+		{[]string{"CLIENT", "SETNAME", "bad name"}, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n"},
+		{[]string{"CLIENT", "SETINFO", "LIB-NAME", "go-redis"}, "+OK\r\n"},
+		{[]string{"CLIENT", "SETINFO", "LIB-VER", "9.0.5"}, "+OK\r\n"},
+		{[]string{"CLIENT", "SETINFO", "COLOR", "red"}, "-ERR Unrecognized option 'COLOR'\r\n"},
+		{[]string{"CLIENT", "NOSUCH"}, "-ERR unknown subcommand 'NOSUCH'. Try CLIENT HELP.\r\n"},
+		{[]string{"HELLO", "3"}, ""},
+		{[]string{"CLIENT", "GETNAME"}, bulk("worker-1")},
+	}
+	for _, tc := range cases {
+		got := c.do(tc.args...)
+		if tc.want != "" && got != tc.want {
+			t.Errorf("%v = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+
+	info := c.do("CLIENT", "INFO")
+	if !strings.HasPrefix(info, "=") || !strings.Contains(info, "txt:id="+strings.TrimSuffix(id[1:], "\r\n")+" ") {
+		t.Errorf("CLIENT INFO = %q", info)
+	}
+	for _, field := range []string{" name=worker-1 ", " lib-name=go-redis ", " lib-ver=9.0.5 ", " resp=3 "} {
+		if !strings.Contains(info, field) {
+			t.Errorf("CLIENT INFO = %q, no%s", info, field)
+		}
+	}
+	list := other.do("CLIENT", "LIST")
+	if !strings.HasPrefix(list, "$") || strings.Count(list, " addr=") != 2 {
+		t.Errorf("CLIENT LIST = %q, want two clients", list)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	c := newTestServer(t, nil).testConn(t)
+	count := fmt.Sprintf(":%d\r\n", len(commandTable))
+	if got := c.do("COMMAND", "COUNT"); got != count {
+		t.Errorf("COMMAND COUNT = %q, want %q", got, count)
+	}
+	get := "*10\r\n" + bulk("get") + ":2\r\n" +
+		"*2\r\n+write\r\n+fast\r\n" +
+		":1\r\n:1\r\n:1\r\n" +
+		"*4\r\n+@write\r\n+@string\r\n+@fast\r\n+@allocate\r\n" +
+		"*0\r\n*0\r\n*0\r\n"
+	for protocol, null := range map[string]string{"2": "$-1\r\n", "3": "_\r\n"} {
+		c.do("HELLO", protocol)
+		if got, want := c.do("COMMAND", "INFO", "GET", "nosuch"), "*2\r\n"+get+null; got != want {
+			t.Errorf("RESP%s COMMAND INFO = %q, want %q", protocol, got, want)
+		}
+	}
+	c.do("HELLO", "3")
+	all := c.do("COMMAND")
+	if !strings.HasPrefix(all, "*"+strconv.Itoa(len(commandTable))+"\r\n") || !strings.Contains(all, get) {
+		t.Errorf("COMMAND does not list %d commands with get", len(commandTable))
+	}
+	list := c.do("COMMAND", "LIST")
+	if !strings.HasPrefix(list, "*"+strconv.Itoa(len(commandTable))+"\r\n") || !strings.Contains(list, bulk("ping")) {
+		t.Errorf("COMMAND LIST = %q", list)
+	}
+	if got := c.do("COMMAND", "DOCS"); got != "%0\r\n" {
+		t.Errorf("RESP3 COMMAND DOCS = %q, want an empty map", got)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	c := newTestServer(t, nil).testConn(t)
+	for _, protocol := range []string{"2", "3"} {
+		c.do("HELLO", protocol)
+		got := c.do("INFO", "server")
+		header, body, _ := strings.Cut(got, "\r\n")
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || len(body) != size+2 {
+			t.Fatalf("RESP%s INFO server = %q, length does not match", protocol, got)
+		}
+		prefix := "$"
+		if protocol == "3" {
+			prefix, body = "=", strings.TrimPrefix(body, "txt:")
+		}
+		if !strings.HasPrefix(header, prefix) || !strings.HasPrefix(body, "# Server\r\n") {
+			t.Errorf("RESP%s INFO server = %q", protocol, got)
+		}
+		if !strings.Contains(body, "redis_version:"+RedisVersion+"\r\n") {
+			t.Errorf("RESP%s INFO server has no redis_version", protocol)
+		}
+		if strings.Contains(body, "# Clients") {
+			t.Errorf("RESP%s INFO server has other sections", protocol)
+		}
+	}
+	all := c.do("INFO")
+	for _, section := range []string{"# Server\r\n", "# Clients\r\n", "# Memory\r\n", "# Stats\r\n", "# Replication\r\n", "# Keyspace\r\n"} {
+		if !strings.Contains(all, section) {
+			t.Errorf("INFO has no %q", section)
+		}
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	s := newTestServer(t, func(c *model.ServerConfig) {
+		c.Users = []map[string]string{{"name": "default", "password": "secret", "commands": "+@all"}}
+	})
+	c := s.testConn(t)
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "-NOAUTH Authentication required.\r\n"},
+		{[]string{"HELLO", "3"}, "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n"},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{[]string{"AUTH", "secret"}, "+OK\r\n"},
+		{[]string{"PING"}, "+PONG\r\n"},
+	}
+	for _, tc := range cases {
+		if got := c.do(tc.args...); got != tc.want {
+			t.Errorf("%v = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"sort"
+	"strings"
+)
+
+// Command describes a command the way redis COMMAND reports it
+type Command struct {
+	Name    string
+	Handler func(s *Server, r *Request) Reply
+	// Arity counts the command name, negative means at least -Arity
+	Arity       int
+	Flags       []string
+	FirstKey    int
+	LastKey     int
+	Step        int
+	Categories  []string
+	SubCommands []*Command
+
+	stats commandStats
+}
+
+var commandTable map[string]*Command
+
+func init() {
+	commandTable = make(map[string]*Command)
+	for _, cmd := range []*Command{
+		{Name: "get", Handler: (*Server).handleGet, Arity: 2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Categories: []string{"@write", "@string", "@fast", "@allocate"}},
+		{Name: "set", Handler: (*Server).handleSet, Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, Step: 1, Categories: []string{"@write", "@string", "@slow"}},
+		{Name: "exists", Handler: (*Server).handleExists, Arity: -2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: -1, Step: 1, Categories: []string{"@keyspace", "@read", "@fast"}},
+		{Name: "del", Handler: (*Server).handleDel, Arity: -2, Flags: []string{"write"}, FirstKey: 1, LastKey: -1, Step: 1, Categories: []string{"@keyspace", "@write", "@slow"}},
+		{Name: "select", Handler: (*Server).handleSelect, Arity: 2, Flags: []string{"loading", "stale", "fast"}, Categories: []string{"@keyspace", "@fast"}},
+		{Name: "ping", Handler: (*Server).handlePing, Arity: -1, Flags: []string{"fast", "stale"}, Categories: []string{"@fast", "@connection"}},
+		{Name: "echo", Handler: (*Server).handleEcho, Arity: 2, Flags: []string{"fast", "stale"}, Categories: []string{"@fast", "@connection"}},
+		{Name: "quit", Handler: (*Server).handleQuit, Arity: -1, Flags: []string{"fast", "stale"}, Categories: []string{"@fast", "@connection"}},
+		{Name: "auth", Handler: (*Server).handleAuth, Arity: -2, Flags: []string{"fast", "stale", "no-auth"}, Categories: []string{"@fast", "@connection"}},
+		{Name: "hello", Handler: (*Server).handleHello, Arity: -1, Flags: []string{"fast", "stale", "no-auth"}, Categories: []string{"@fast", "@connection"}},
+		{Name: "acl", Handler: (*Server).handleAcl, Arity: -2, Categories: []string{"@slow"},
+			SubCommands: []*Command{
+				{Name: "acl|cat", Arity: -2, Categories: []string{"@slow"}},
+				{Name: "acl|deluser", Arity: -3, Flags: []string{"admin"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "acl|list", Arity: 2, Flags: []string{"admin"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "acl|setuser", Arity: -3, Flags: []string{"admin"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "acl|users", Arity: 2, Flags: []string{"admin"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "acl|whoami", Arity: 2, Categories: []string{"@fast", "@connection"}},
+			}},
+		{Name: "promote", Handler: (*Server).handlePromote, Arity: 1, Flags: []string{"admin", "noscript", "loading", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+		{Name: "info", Handler: (*Server).handleInfo, Arity: -1, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@dangerous"}},
+		{Name: "command", Handler: (*Server).handleCommand, Arity: -1, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"},
+			SubCommands: []*Command{
+				{Name: "command|count", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+				{Name: "command|docs", Arity: -2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+				{Name: "command|info", Arity: -2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+				{Name: "command|list", Arity: -2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+			}},
+		{Name: "cluster", Handler: (*Server).handleCluster, Arity: -2, Categories: []string{"@slow"},
+			SubCommands: []*Command{
+				{Name: "cluster|countkeysinslot", Arity: 3, Flags: []string{"stale"}, Categories: []string{"@slow"}},
+				{Name: "cluster|getkeysinslot", Arity: 4, Flags: []string{"stale"}, Categories: []string{"@slow"}},
+				{Name: "cluster|info", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "cluster|keyslot", Arity: 3, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "cluster|migrate", Arity: 4, Flags: []string{"admin", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "cluster|myid", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "cluster|nodes", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "cluster|shards", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "cluster|slots", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+			}},
+		{Name: "asking", Handler: (*Server).handleAsking, Arity: 1, Flags: []string{"fast"}, Categories: []string{"@fast", "@connection"}},
+		{Name: "readonly", Handler: (*Server).handleAsking, Arity: 1, Flags: []string{"loading", "stale", "fast"}, Categories: []string{"@fast", "@connection"}},
+		{Name: "readwrite", Handler: (*Server).handleAsking, Arity: 1, Flags: []string{"loading", "stale", "fast"}, Categories: []string{"@fast", "@connection"}},
+		{Name: "role", Handler: (*Server).handleRole, Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast"}, Categories: []string{"@admin", "@fast", "@dangerous"}},
+		{Name: "sentinel", Handler: (*Server).handleSentinel, Arity: -2, Categories: []string{"@slow"},
+			SubCommands: []*Command{
+				{Name: "sentinel|get-master-addr-by-name", Arity: 3, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "sentinel|master", Arity: 3, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "sentinel|masters", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "sentinel|myid", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "sentinel|replicas", Arity: 3, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "sentinel|sentinels", Arity: 3, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+				{Name: "sentinel|slaves", Arity: 3, Flags: []string{"loading", "stale"}, Categories: []string{"@slow"}},
+			}},
+		{Name: "config", Handler: (*Server).handleConfig, Arity: -2, Categories: []string{"@slow"},
+			SubCommands: []*Command{
+				{Name: "config|get", Arity: -3, Flags: []string{"admin", "loading", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "config|history", Arity: -2, Flags: []string{"admin", "loading", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "config|resetstat", Arity: 2, Flags: []string{"admin", "loading", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "config|rewrite", Arity: 2, Flags: []string{"admin", "loading", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "config|rollback", Arity: 3, Flags: []string{"admin", "loading", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+				{Name: "config|set", Arity: -4, Flags: []string{"admin", "loading", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous"}},
+			}},
+		{Name: "client", Handler: (*Server).handleClient, Arity: -2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"},
+			SubCommands: []*Command{
+				{Name: "client|getname", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+				{Name: "client|id", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+				{Name: "client|info", Arity: 2, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+				{Name: "client|list", Arity: -2, Flags: []string{"admin", "loading", "stale"}, Categories: []string{"@admin", "@slow", "@dangerous", "@connection"}},
+				{Name: "client|setinfo", Arity: 4, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+				{Name: "client|setname", Arity: 3, Flags: []string{"loading", "stale"}, Categories: []string{"@slow", "@connection"}},
+			}},
+	} {
+		commandTable[cmd.Name] = cmd
+	}
+}
+
+func lookupCommand(name string) (*Command, bool) {
+	cmd, ok := commandTable[strings.ToLower(name)]
+	return cmd, ok
+}
+
+func (c *Command) checkArity(r *Request) bool {
+	argc := len(r.Arguments) + 1
+	if c.Arity > 0 {
+		return argc == c.Arity
+	}
+	return argc >= -c.Arity
+}
+
+func (c *Command) hasFlag(flag string) bool {
+	for _, f := range c.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Command) hasCategory(category string) bool {
+	for _, cat := range c.Categories {
+		if cat == category {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commandTable))
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reply formats the command as one COMMAND INFO entry
+func (c *Command) Reply() Reply {
+	flags := make([]Reply, 0, len(c.Flags))
+	for _, flag := range c.Flags {
+		flags = append(flags, &StatusReply{code: flag})
+	}
+	categories := make([]Reply, 0, len(c.Categories))
+	for _, category := range c.Categories {
+		categories = append(categories, &StatusReply{code: category})
+	}
+	subCommands := make([]Reply, 0, len(c.SubCommands))
+	for _, sub := range c.SubCommands {
+		subCommands = append(subCommands, sub.Reply())
+	}
+	return &ArrayReply{
+		values: []Reply{
+			&BulkReply{value: []byte(c.Name)},
+			&IntReply{number: int64(c.Arity)},
+			&ArrayReply{values: flags},
+			&IntReply{number: int64(c.FirstKey)},
+			&IntReply{number: int64(c.LastKey)},
+			&IntReply{number: int64(c.Step)},
+			&ArrayReply{values: categories},
+			&ArrayReply{values: []Reply{}}, // tips
+			&ArrayReply{values: []Reply{}}, // key specs
+			&ArrayReply{values: subCommands},
+		},
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"Didgen/db"
+	log "Didgen/logger_seelog"
+)
+
+// A restart hands the listening sockets to a new process of the same binary.
+// Both processes share data.db, so the new process serves connections at once
+// but holds back every command writing data.db until the old process has
+// drained its connections, given its unused ids back and closed data.db:
+//
+//	new -> old: ready     listeners are accepting, the old ones can close
+//	old -> new: released  data.db is flushed and closed, ids may be issued
+const (
+	envHandoffFd        = "DIDGEN_HANDOFF_FD"
+	envHandoffListeners = "DIDGEN_HANDOFF_LISTENERS"
+
+	handoffReady    = "ready"
+	handoffReleased = "released"
+
+	handoffReadyTimeout = 30 * time.Second
+	// handoffReleaseWait is how long a write command waits for the old process
+	handoffReleaseWait = 30 * time.Second
+)
+
+// Handoff is the old process side of a restart
+type Handoff struct {
+	conn net.Conn
+	cmd  *exec.Cmd
+}
+
+// Handoff starts a new process with the listeners of the server and waits
+// until it accepts connections. The server keeps running when it fails, on
+// success it has to be shut down and Release called once data.db is closed
+func (s *Server) Handoff() (*Handoff, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "handoff")
+	remote := os.NewFile(uintptr(fds[1]), "handoff-remote")
+	defer remote.Close()
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*os.File{remote}
+	names := make([]string, 0, len(s.listeners))
+	listenerFiles := make([]*os.File, 0, len(s.listeners))
+	defer func() {
+		for _, f := range listenerFiles {
+			f.Close()
+		}
+	}()
+	for _, l := range s.listeners {
+		f, err := l.File()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		listenerFiles = append(listenerFiles, f)
+		names = append(names, l.Network+":"+l.Address)
+	}
+	files = append(files, listenerFiles...)
+	env := handoffEnviron()
+	// the data path lock is shared with the new process, not released
+	if lockFile := db.LockFile(); lockFile != nil {
+		files = append(files, lockFile)
+		env = append(env, fmt.Sprintf("%s=%d", db.EnvHandoffLockFd, 3+len(files)-1))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	// ExtraFiles start at fd 3 in the new process
+	cmd.Env = append(env,
+		fmt.Sprintf("%s=%d", envHandoffFd, 3),
+		fmt.Sprintf("%s=%s", envHandoffListeners, strings.Join(names, ",")))
+	if err = cmd.Start(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Info(fmt.Sprintf("Server handoff, started %s pid %d with %d listeners", executable, cmd.Process.Pid, len(names)))
+
+	conn.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != handoffReady {
+		conn.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err == nil {
+			err = fmt.Errorf("unexpected handoff message %q", line)
+		}
+		return nil, fmt.Errorf("new process did not get ready: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// the unix socket file now belongs to the new process
+	for _, l := range s.listeners {
+		if unixListener, ok := l.Listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	return &Handoff{conn: conn, cmd: cmd}, nil
+}
+
+// Pid is the process id of the new process
+func (h *Handoff) Pid() int {
+	return h.cmd.Process.Pid
+}
+
+// Release lets the new process issue ids, call it after data.db is closed
+func (h *Handoff) Release() error {
+	defer h.conn.Close()
+	_, err := h.conn.Write([]byte(handoffReleased + "\n"))
+	if err == nil {
+		log.Info(fmt.Sprintf("Server handoff, released data.db to pid %d", h.cmd.Process.Pid))
+	}
+	return err
+}
+
+func handoffEnviron() []string {
+	env := make([]string, 0)
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, envHandoffFd+"=") || strings.HasPrefix(e, envHandoffListeners+"=") || strings.HasPrefix(e, db.EnvHandoffLockFd+"=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	return env
+}
+
+// inheritedListeners are the listeners handed over by the old process, nil
+// when the process was not started by a handoff
+func inheritedListeners() ([]*Listener, net.Conn, error) {
+	names := os.Getenv(envHandoffListeners)
+	fdValue := os.Getenv(envHandoffFd)
+	if fdValue == "" {
+		return nil, nil, nil
+	}
+	os.Unsetenv(envHandoffFd)
+	os.Unsetenv(envHandoffListeners)
+
+	fd, err := strconv.Atoi(fdValue)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %s", envHandoffFd, fdValue)
+	}
+	f := os.NewFile(uintptr(fd), "handoff")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listeners := make([]*Listener, 0)
+	for i, name := range strings.Split(names, ",") {
+		if name == "" {
+			continue
+		}
+		parts := strings.SplitN(name, ":", 2)
+		if len(parts) != 2 {
+			conn.Close()
+			return nil, nil, fmt.Errorf("invalid %s: %s", envHandoffListeners, names)
+		}
+		f := os.NewFile(uintptr(fd+1+i), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		listeners = append(listeners, &Listener{
+			Listener: listener,
+			Network:  parts[0],
+			Address:  parts[1],
+		})
+	}
+	return listeners, conn, nil
+}
+
+// startHandoff tells the old process the listeners are accepting and waits in
+// the background for it to release data.db
+func (s *Server) startHandoff() {
+	if s.handoff == nil {
+		return
+	}
+	if _, err := s.handoff.Write([]byte(handoffReady + "\n")); err != nil {
+		log.Error(fmt.Sprintf("Server handoff, ready error: %v", err))
+	}
+	go func() {
+		defer s.handoff.Close()
+		line, err := bufio.NewReader(s.handoff).ReadString('\n')
+		switch {
+		case err == nil && strings.TrimSpace(line) == handoffReleased:
+			log.Info("Server handoff, data.db released by the old process")
+		case err != nil:
+			// the old process is gone, its batches are lost but never reissued
+			log.Warn(fmt.Sprintf("Server handoff, old process went away: %v", err))
+		default:
+			log.Warn(fmt.Sprintf("Server handoff, unexpected message %q", line))
+		}
+		// writes to data.db wait on released, the ones of start up go first
+		if err := s.prepareData(); err != nil {
+			log.Error(fmt.Sprintf("Server handoff, prepare data.db error: %v", err))
+		}
+		if err := s.startCluster(); err != nil {
+			log.Error(fmt.Sprintf("Server cluster start error: %v", err))
+		}
+		atomic.StoreInt32(&s.loading, 0)
+		close(s.released)
+	}()
+}
+
+// waitReleased holds a command writing data.db back until the old process of
+// a restart has released it
+func (s *Server) waitReleased() bool {
+	if atomic.LoadInt32(&s.loading) == 0 {
+		return true
+	}
+	select {
+	case <-s.released:
+		return true
+	case <-time.After(handoffReleaseWait):
+		return false
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"Didgen/config"
+	"Didgen/db"
+	"Didgen/model"
+)
+
+// a restarted server provisions the keys section only once the old process
+// released data.db
+func TestHandoffProvisionAfterRelease(t *testing.T) {
+	s := newTestServer(t, nil)
+	config.Update(func(c *model.ServerConfig) {
+		c.Keys = []map[string]string{{"name": "orders", "start": "1000"}}
+	})
+	old, conn := net.Pipe()
+	defer old.Close()
+	s.handoff, s.loading, s.released = conn, 1, make(chan struct{})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	values, err := db.DATA.KeyValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["orders"]; ok {
+		t.Fatal("orders provisioned before data.db was released")
+	}
+
+	go s.startHandoff()
+	line, err := bufio.NewReader(old).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != handoffReady {
+		t.Fatalf("handoff message %q, %v, want %s", line, err, handoffReady)
+	}
+	if _, err = old.Write([]byte(handoffReleased + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.waitReleased() {
+		t.Fatal("not released")
+	}
+	if values, err = db.DATA.KeyValues(); err != nil {
+		t.Fatal(err)
+	}
+	if values["orders"] != 999 {
+		t.Errorf("orders = %d after the release, want 999, the id before start", values["orders"])
+	}
+}
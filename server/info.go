@@ -0,0 +1,252 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"Didgen/config"
+	"Didgen/db"
+)
+
+type infoSection struct {
+	name    string
+	inAll   bool // part of INFO without arguments
+	collect func(s *Server) []string
+}
+
+var infoSections = []infoSection{
+	{"server", true, (*Server).infoServer},
+	{"config", true, (*Server).infoConfig},
+	{"clients", true, (*Server).infoClients},
+	{"memory", true, (*Server).infoMemory},
+	{"persistence", true, (*Server).infoPersistence},
+	{"stats", true, (*Server).infoStats},
+	{"commandstats", false, (*Server).infoCommandStats},
+	{"replication", true, (*Server).infoReplication},
+	{"cluster", true, (*Server).infoCluster},
+	{"keyspace", true, (*Server).infoKeyspace},
+}
+
+// redis command(info [section [section ...]])
+func (s *Server) handleInfo(r *Request) Reply {
+	wanted := make(map[string]bool)
+	for _, arg := range r.Arguments {
+		wanted[strings.ToLower(string(arg))] = true
+	}
+	if len(wanted) == 0 {
+		wanted["default"] = true
+	}
+
+	sections := make([]string, 0)
+	for _, section := range infoSections {
+		include := wanted[section.name] || wanted["all"] || wanted["everything"]
+		if section.inAll && wanted["default"] {
+			include = true
+		}
+		if !include {
+			continue
+		}
+		lines := section.collect(s)
+		title := strings.ToUpper(section.name[:1]) + section.name[1:]
+		if section.name == "commandstats" {
+			title = "Commandstats"
+		}
+		sections = append(sections, "# "+title+"\r\n"+strings.Join(lines, ""))
+	}
+
+	return &VerbatimReply{
+		format: "txt",
+		value:  []byte(strings.Join(sections, "\r\n")),
+	}
+}
+
+func infoLine(key string, value interface{}) string {
+	return fmt.Sprintf("%s:%v\r\n", key, value)
+}
+
+func (s *Server) infoServer() []string {
+	uptime := int64(time.Since(s.startTime).Seconds())
+	configFile, _ := filepath.Abs(config.ConfigPath)
+	executable, _ := os.Executable()
+	return []string{
+		infoLine("redis_version", RedisVersion),
+		infoLine("didgen_version", Version),
+		infoLine("redis_mode", "standalone"),
+		infoLine("os", runtime.GOOS+" "+runtime.GOARCH),
+		infoLine("go_version", runtime.Version()),
+		infoLine("process_id", os.Getpid()),
+		infoLine("server_id", config.Current().ServerId),
+		infoLine("tcp_port", config.Current().ServerPort),
+		infoLine("unix_socket", s.UnixSocket()),
+		infoLine("uptime_in_seconds", uptime),
+		infoLine("uptime_in_days", uptime/86400),
+		infoLine("executable", executable),
+		infoLine("config_file", configFile),
+	}
+}
+
+func (s *Server) infoConfig() []string {
+	return append([]string{
+		infoLine("log_level", config.Current().LogLevel),
+		infoLine("log_path", config.Current().LogPath),
+		infoLine("server_host", config.Current().ServerHost),
+		infoLine("server_port", config.Current().ServerPort),
+		infoLine("trans_port", config.Current().TransPort),
+		infoLine("nodes", len(config.Current().Nodes)),
+		infoLine("threads", config.Current().Threads),
+		infoLine("data_path", config.Current().DataPath),
+		infoLine("batch_size", config.Current().BatchSize),
+		infoLine("tls_enabled", boolInt(s.tlsConfig != nil)),
+		infoLine("tls_auth_clients", config.Current().TLSAuthClients),
+	}, s.reload.info()...)
+}
+
+func (s *Server) infoClients() []string {
+	return []string{
+		infoLine("connected_clients", s.ClientsCount()),
+		infoLine("maxclients", s.Limits().MaxClients),
+	}
+}
+
+func (s *Server) infoMemory() []string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	peak := s.stats.samplePeak(m.HeapAlloc)
+	lines := []string{
+		infoLine("used_memory", m.HeapAlloc),
+		infoLine("used_memory_human", humanBytes(m.HeapAlloc)),
+		infoLine("used_memory_peak", peak),
+		infoLine("used_memory_peak_human", humanBytes(peak)),
+	}
+	// left out where /proc is not there
+	if rss, ok := residentBytes(); ok {
+		lines = append(lines,
+			infoLine("used_memory_rss", rss),
+			infoLine("used_memory_rss_human", humanBytes(rss)))
+	}
+	return append(lines,
+		infoLine("go_heap_sys", m.HeapSys),
+		infoLine("go_sys", m.Sys),
+		infoLine("go_heap_objects", m.HeapObjects),
+		infoLine("go_goroutines", runtime.NumGoroutine()),
+		infoLine("go_gc_count", m.NumGC),
+		infoLine("go_gc_pause_total_usec", m.PauseTotalNs/1000),
+	)
+}
+
+// residentBytes is the resident set size, the second field of
+// /proc/self/statm in pages
+func residentBytes() (uint64, bool) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * uint64(os.Getpagesize()), true
+}
+
+func (s *Server) infoPersistence() []string {
+	lastError, _ := db.Stats.LastSqliteError.Load().(string)
+	return []string{
+		infoLine("loading", atomic.LoadInt32(&s.loading)),
+		infoLine("data_db_size", fileSize(filepath.Join(config.Current().DataPath, "data.db"))),
+		infoLine("configuration_db_size", fileSize(filepath.Join(config.Current().DataPath, "configuration.db"))),
+		infoLine("sqlite_errors", atomic.LoadInt64(&db.Stats.SqliteErrors)),
+		infoLine("sqlite_last_error_time", atomic.LoadInt64(&db.Stats.LastSqliteErrorT)),
+		infoLine("sqlite_last_error", strings.Replace(lastError, "\n", " ", -1)),
+	}
+}
+
+func (s *Server) infoStats() []string {
+	refills := atomic.LoadInt64(&db.Stats.Refills)
+	refillTime := atomic.LoadInt64(&db.Stats.RefillTimeUsec)
+	var refillAvg float64
+	if refills > 0 {
+		refillAvg = float64(refillTime) / float64(refills)
+	}
+	return []string{
+		infoLine("total_connections_received", atomic.LoadInt64(&s.stats.TotalConnections)),
+		infoLine("total_commands_processed", atomic.LoadInt64(&s.stats.TotalCommands)),
+		infoLine("instantaneous_ops_per_sec", s.stats.OpsPerSec()),
+		infoLine("total_error_replies", atomic.LoadInt64(&s.stats.ErrorReplies)),
+		infoLine("rejected_connections", atomic.LoadInt64(&s.stats.RejectedConnections)),
+		infoLine("timedout_connections", atomic.LoadInt64(&s.stats.TimedoutConnections)),
+		infoLine("total_protocol_errors", atomic.LoadInt64(&s.stats.ProtocolErrors)),
+		infoLine("total_limit_violations", atomic.LoadInt64(&s.stats.LimitViolations)),
+		infoLine("total_redirections", atomic.LoadInt64(&s.stats.Redirections)),
+		infoLine("total_proxied_commands", atomic.LoadInt64(&s.stats.ProxiedCommands)),
+		infoLine("total_proxy_errors", atomic.LoadInt64(&s.stats.ProxyErrors)),
+		infoLine("total_refills", refills),
+		infoLine("refill_usec", refillTime),
+		infoLine("refill_avg_usec", fmt.Sprintf("%.2f", refillAvg)),
+		infoLine("refill_max_usec", atomic.LoadInt64(&db.Stats.RefillMaxUsec)),
+		infoLine("refill_last_usec", atomic.LoadInt64(&db.Stats.RefillLastUsec)),
+		infoLine("refill_conflicts", atomic.LoadInt64(&db.Stats.RefillConflicts)),
+	}
+}
+
+func (s *Server) infoCommandStats() []string {
+	lines := make([]string, 0)
+	for _, name := range sortedCommandNames() {
+		cmd := commandTable[name]
+		calls := atomic.LoadInt64(&cmd.stats.calls)
+		if calls == 0 {
+			continue
+		}
+		usec := atomic.LoadInt64(&cmd.stats.usec)
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=0,failed_calls=%d\r\n",
+			name, calls, usec, float64(usec)/float64(calls), atomic.LoadInt64(&cmd.stats.failedCalls)))
+	}
+	return lines
+}
+
+func (s *Server) infoKeyspace() []string {
+	s.RLock()
+	keys := len(s.keyGeneratorMap)
+	s.RUnlock()
+	if keys == 0 {
+		return []string{}
+	}
+	return []string{
+		fmt.Sprintf("db0:keys=%d,expires=0,avg_ttl=0\r\n", keys),
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func humanBytes(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.2f%s", value, units[i])
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"Didgen/model"
+)
+
+func infoFields(reply string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(reply, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+func TestInfoMemory(t *testing.T) {
+	s := newTestServer(t, nil)
+	c := s.testConn(t)
+	s.stats.samplePeak(1 << 40)
+	fields := infoFields(c.do("INFO", "memory"))
+	used, err := strconv.ParseUint(fields["used_memory"], 10, 64)
+	if err != nil || used == 0 {
+		t.Fatalf("used_memory = %q", fields["used_memory"])
+	}
+	if fields["used_memory_peak"] != strconv.FormatUint(1<<40, 10) {
+		t.Errorf("used_memory_peak = %q, want the sampled peak", fields["used_memory_peak"])
+	}
+
+	s.stats.PeakMemory = 0
+	fields = infoFields(c.do("INFO", "memory"))
+	peak, _ := strconv.ParseUint(fields["used_memory_peak"], 10, 64)
+	if used, _ = strconv.ParseUint(fields["used_memory"], 10, 64); peak != used {
+		t.Errorf("used_memory_peak %d, want used_memory %d after a reset", peak, used)
+	}
+	rss, ok := residentBytes()
+	if !ok {
+		t.Skip("no /proc/self/statm")
+	}
+	reported, err := strconv.ParseUint(fields["used_memory_rss"], 10, 64)
+	if err != nil || reported == 0 || reported > 2*rss || rss > 2*reported {
+		t.Errorf("used_memory_rss = %q, resident %d", fields["used_memory_rss"], rss)
+	}
+}
+
+// other nodes alone are no cluster mode, CLUSTER SLOTS answers with
+// cluster_enabled yes only
+func TestInfoClusterEnabled(t *testing.T) {
+	for _, enabled := range []string{"no", "yes"} {
+		trans := freePort(t)
+		s := newTestServer(t, func(c *model.ServerConfig) {
+			c.TransPort = trans
+			c.ClusterSecret = "s3cret"
+			c.ClusterEnabled = enabled
+			c.Nodes = []map[string]string{
+				{"server_host": "127.0.0.1", "server_port": "0", "trans_port": trans, "slots": "0-8191"},
+				{"server_host": "127.0.0.1", "server_port": "1", "trans_port": freePort(t), "slots": "8192-16383"},
+			}
+		})
+		if err := s.startCluster(); err != nil {
+			t.Fatal(err)
+		}
+		c := s.testConn(t)
+		fields := infoFields(c.do("INFO", "cluster"))
+		want := map[string]string{"no": "0", "yes": "1"}[enabled]
+		if fields["cluster_enabled"] != want || fields["cluster_known_nodes"] != "2" {
+			t.Errorf("cluster_enabled %s: INFO cluster %v", enabled, fields)
+		}
+		slots := c.do("CLUSTER", "SLOTS")
+		if (enabled == "yes") != !strings.HasPrefix(slots, "-") {
+			t.Errorf("cluster_enabled %s: CLUSTER SLOTS = %q", enabled, slots)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"time"
+
+	"Didgen/model"
+)
+
+// Limits are the connection limits of the config, they can be replaced while
+// the server runs
+type Limits struct {
+	MaxClients  int
+	IdleTimeout time.Duration
+	Request     RequestLimits
+}
+
+func LimitsFromConfig(c *model.ServerConfig) *Limits {
+	return &Limits{
+		MaxClients:  c.MaxClients,
+		IdleTimeout: time.Duration(c.IdleTimeout) * time.Second,
+		Request: RequestLimits{
+			MaxArgs:       c.MaxRequestArgs,
+			MaxBulkLength: c.MaxBulkLength,
+			ReadTimeout:   time.Duration(c.ReadTimeout) * time.Second,
+		},
+	}
+}
+
+func (s *Server) Limits() *Limits {
+	return s.limits.Load().(*Limits)
+}
+
+func (s *Server) SetLimits(limits *Limits) {
+	s.limits.Store(limits)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	log "Didgen/logger_seelog"
+	"Didgen/systemd"
+)
+
+// acceptRetryDelay avoids a busy loop when Accept keeps failing, for example
+// when the process runs out of file descriptors
+const acceptRetryDelay = 100 * time.Millisecond
+
+// Listener is one socket clients connect to, every listener feeds onConn
+type Listener struct {
+	net.Listener
+	Network   string // tcp or unix
+	Address   string
+	tlsConfig *tls.Config
+}
+
+// File duplicates the listening socket, for handing it to a new process
+func (l *Listener) File() (*os.File, error) {
+	filer, ok := l.Listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("%s listener %s can not be handed over", l.Network, l.Address)
+	}
+	return filer.File()
+}
+
+func ListenTCP(host, port string) (*Listener, error) {
+	tcpaddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%s", host, port))
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP("tcp", tcpaddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		Listener: listener,
+		Network:  "tcp",
+		Address:  listener.Addr().String(),
+	}, nil
+}
+
+// ListenUnix listens on a unix socket path, a socket file left behind by a
+// crashed process is removed first
+func ListenUnix(path string, perm os.FileMode) (*Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("unix socket path %s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	unixaddr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", unixaddr)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &Listener{
+		Listener: listener,
+		Network:  "unix",
+		Address:  path,
+	}, nil
+}
+
+// systemdListeners are the sockets of systemd socket activation, they replace
+// server_port and unix_socket
+func systemdListeners(tlsConfig *tls.Config) ([]*Listener, error) {
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	listeners := make([]*Listener, 0, len(activated))
+	for _, l := range activated {
+		listener := &Listener{
+			Listener: l.Listener,
+			Network:  l.Addr().Network(),
+			Address:  l.Addr().String(),
+		}
+		if listener.Network == "tcp" {
+			listener.tlsConfig = tlsConfig
+		}
+		listeners = append(listeners, listener)
+		log.Info(fmt.Sprintf("NewServer systemd %s listener %s (%s)", listener.Network, listener.Address, l.Name))
+	}
+	return listeners, nil
+}
+
+// acceptLoop runs until the listener is closed by Close or Shutdown
+func (s *Server) acceptLoop(l *Listener) {
+	defer s.listenersWait.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !s.IsRunning() {
+				return
+			}
+			log.Error(fmt.Sprintf("Server Run %s error: %v", l.Network, err))
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		s.connWait.Add(1)
+		go s.onConn(wrapTLS(conn, l.tlsConfig))
+	}
+}
+
+func (s *Server) UnixSocket() string {
+	for _, l := range s.listeners {
+		if l.Network == "unix" {
+			return l.Address
+		}
+	}
+	return ""
+}
@@ -4,9 +4,10 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Request struct {
@@ -14,6 +15,10 @@ type Request struct {
 	Arguments     [][]byte
 	RemoteAddress string
 	Connection    io.ReadCloser
+	Client        *Client
+
+	proxied bool // by another node, see redirect
+	allowed bool // passed checkAccess, only such a request is proxied
 }
 
 func (r *Request) HasArgument(index int) bool {
@@ -46,106 +51,321 @@ func (r *Request) GetString(index int) (string, *ErrorReply) {
 	return v, nil
 }
 
-func NewRequest(conn io.ReadCloser) (*Request, error) {
-	reader := bufio.NewReader(conn)
-
-	// *<number of arguments>CRLF
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+// NewRequest reads one request from the connection's reader, the reader must
+// live as long as the connection, otherwise pipelined requests are lost.
+// Both the multi bulk format (*<count>) and the inline format (space separated
+// words, as sent by telnet or a health check) are accepted. Malformed input is
+// reported as a *ProtocolError which should be replied before closing.
+// limits may be nil, then only the inline size is limited.
+func NewRequest(reader *bufio.Reader, conn io.ReadCloser, limits *RequestLimits) (*Request, error) {
+	if limits == nil {
+		limits = new(RequestLimits)
 	}
+	for {
+		// *<number of arguments>CRLF
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
 
-	var argCount int
-	if line[0] == '*' {
-		if _, err := fmt.Sscanf(line, "*%d\r\n", &argCount); err != nil {
-			return nil, Malformed("*<#Arguments>", line)
+		// the rest of a started request has to arrive in time
+		if deadlineConn, ok := conn.(net.Conn); ok && limits.ReadTimeout > 0 {
+			deadlineConn.SetReadDeadline(time.Now().Add(limits.ReadTimeout))
 		}
 
-		// $<number of bytes of argument 1>CRLF
-		// <argument data>CRLF
-		command, err := readArgument(reader)
+		var arguments [][]byte
+		if line[0] == '*' {
+			arguments, err = readMultiBulk(reader, line, limits)
+		} else {
+			arguments, err = readInline(line)
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		arguments := make([][]byte, argCount-1)
-		for i := 0; i < argCount-1; i++ {
-			if arguments[i], err = readArgument(reader); err != nil {
-				return nil, err
-			}
+		// empty lines and *0 are skipped like redis does
+		if len(arguments) == 0 {
+			continue
 		}
 
 		return &Request{
-			Command:    strings.ToUpper(string(command)),
-			Arguments:  arguments,
+			Command:    strings.ToUpper(string(arguments[0])),
+			Arguments:  arguments[1:],
 			Connection: conn,
 		}, nil
 	}
+}
 
-	return nil, fmt.Errorf("new request error")
+// RequestLimits protect the server from clients sending huge requests, a zero
+// value means no limit
+type RequestLimits struct {
+	MaxArgs       int
+	MaxBulkLength int
+	ReadTimeout   time.Duration
 }
 
-func readArgument(reader *bufio.Reader) ([]byte, error) {
-	line, err := reader.ReadString('\n')
+// maxInlineSize limits inline requests and the length lines of multi bulk
+// requests, like redis does
+const maxInlineSize = 64 * 1024
+
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			return string(line), nil
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+		if len(line) > maxInlineSize {
+			return "", LimitErr("too big inline request")
+		}
+	}
+}
+
+func readMultiBulk(reader *bufio.Reader, line string, limits *RequestLimits) ([][]byte, error) {
+	argCount, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
 	if err != nil {
-		return nil, Malformed("$<ArgumentLength>", line)
+		return nil, ProtocolErr("invalid multibulk length")
+	}
+	if argCount <= 0 {
+		return nil, nil
+	}
+	if limits.MaxArgs > 0 && argCount > limits.MaxArgs {
+		return nil, LimitErr("too many arguments, %d exceeds the limit of %d", argCount, limits.MaxArgs)
 	}
 
-	var argLength int
-	if _, err := fmt.Sscanf(line, "$%d\r\n", &argLength); err != nil {
-		return nil, Malformed("$<ArgumentLength>", line)
+	// $<number of bytes of argument 1>CRLF
+	// <argument data>CRLF
+	arguments := make([][]byte, argCount)
+	for i := 0; i < argCount; i++ {
+		if arguments[i], err = readArgument(reader, limits); err != nil {
+			return nil, err
+		}
 	}
+	return arguments, nil
+}
 
-	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(argLength)))
+func readArgument(reader *bufio.Reader, limits *RequestLimits) ([]byte, error) {
+	line, err := readLine(reader)
 	if err != nil {
 		return nil, err
 	}
-	if len(data) != argLength {
-		return nil, MalformedLength(argLength, len(data))
+
+	if line[0] != '$' {
+		return nil, ProtocolErr("expected '$', got '%c'", line[0])
 	}
-	if b, err := reader.ReadByte(); err != nil || b != '\r' {
-		return nil, MalformedMissingCRLF()
+	argLength, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+	if err != nil || argLength < 0 {
+		return nil, ProtocolErr("invalid bulk length")
+	}
+	if limits.MaxBulkLength > 0 && argLength > limits.MaxBulkLength {
+		return nil, LimitErr("bulk length %d exceeds the limit of %d", argLength, limits.MaxBulkLength)
+	}
+
+	data := make([]byte, argLength+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
 	}
-	if b, err := reader.ReadByte(); err != nil || b != '\n' {
+	if data[argLength] != '\r' || data[argLength+1] != '\n' {
 		return nil, MalformedMissingCRLF()
 	}
 
-	return data, nil
+	return data[:argLength], nil
+}
+
+// readInline splits an inline command the way redis-cli quotes arguments:
+// "double quoted" strings support \n \r \t \b \a \\ \" and \xHH escapes,
+// 'single quoted' strings only support \'
+func readInline(line string) ([][]byte, error) {
+	line = strings.TrimRight(line, "\r\n")
+	arguments := make([][]byte, 0)
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return arguments, nil
+		}
+
+		current := make([]byte, 0)
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			if inDouble {
+				if i >= len(line) {
+					return nil, ProtocolErr("unbalanced quotes in request")
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(b))
+					i += 3
+				} else if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				} else if line[i] == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ProtocolErr("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current = append(current, line[i])
+				}
+			} else if inSingle {
+				if i >= len(line) {
+					return nil, ProtocolErr("unbalanced quotes in request")
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					current = append(current, '\'')
+					i++
+				} else if line[i] == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ProtocolErr("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current = append(current, line[i])
+				}
+			} else {
+				if i >= len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\t', '\n', '\r', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					current = append(current, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		arguments = append(arguments, current)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == 0
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// ProtocolError is a malformed request, the client gets the error reply and
+// the connection is closed since the stream can not be resynchronized
+type ProtocolError struct {
+	*ErrorReply
+	Limit bool // the request broke one of the RequestLimits
+}
+
+func ProtocolErr(format string, args ...interface{}) error {
+	return &ProtocolError{
+		ErrorReply: NewErrorReply(ErrPrefixErr, "Protocol error: "+format, args...),
+	}
+}
+
+func LimitErr(format string, args ...interface{}) error {
+	return &ProtocolError{
+		ErrorReply: NewErrorReply(ErrPrefixErr, "Protocol error: "+format, args...),
+		Limit:      true,
+	}
 }
 
 func Malformed(expected string, got string) error {
-	return fmt.Errorf("Mailformed request: %s does not match %s", got, expected)
+	return ProtocolErr("%s does not match %s", strings.TrimRight(got, "\r\n"), expected)
 }
 
 func MalformedLength(expected int, got int) error {
-	return fmt.Errorf("Mailformed request: argument length %d does not match %d", got, expected)
+	return ProtocolErr("argument length %d does not match %d", got, expected)
 }
 
 func MalformedMissingCRLF() error {
-	return fmt.Errorf("Mailformed request: line should end with CRLF")
+	return ProtocolErr("line should end with CRLF")
 }
 
 type Reply io.WriterTo
 
 var (
-	ErrMethodNotSupported   = &ErrorReply{"Method is not supported"}
-	ErrNotEnoughArgs        = &ErrorReply{"Not enough arguments for the command"}
-	ErrTooMuchArgs          = &ErrorReply{"Too many arguments for the command"}
-	ErrWrongArgsNumber      = &ErrorReply{"Wrong number of arguments"}
-	ErrExpectInteger        = &ErrorReply{"Expected integer"}
-	ErrExpectPositivInteger = &ErrorReply{"Expected positive integer"}
-	ErrExpectMorePair       = &ErrorReply{"Expected at least one key val pair"}
-	ErrExpectEvenPair       = &ErrorReply{"Got uneven number of key val pairs"}
-
-	ErrNoKey = &ErrorReply{"no key for set"}
+	ErrMethodNotSupported   = &ErrorReply{message: "Method is not supported"}
+	ErrNotEnoughArgs        = &ErrorReply{message: "Not enough arguments for the command"}
+	ErrTooMuchArgs          = &ErrorReply{message: "Too many arguments for the command"}
+	ErrWrongArgsNumber      = &ErrorReply{message: "Wrong number of arguments"}
+	ErrExpectInteger        = &ErrorReply{message: "value is not an integer or out of range"}
+	ErrExpectPositivInteger = &ErrorReply{message: "value is out of range, must be positive"}
+	ErrExpectMorePair       = &ErrorReply{message: "Expected at least one key val pair"}
+	ErrExpectEvenPair       = &ErrorReply{message: "Got uneven number of key val pairs"}
+	ErrSyntax               = &ErrorReply{message: "syntax error"}
+
+	ErrNoKey = &ErrorReply{message: "no key for set"}
+)
+
+// error prefixes understood by redis clients, the first word of an error reply
+const (
+	ErrPrefixErr       = "ERR"
+	ErrPrefixWrongType = "WRONGTYPE"
+	ErrPrefixNoAuth    = "NOAUTH"
+	ErrPrefixNoProto   = "NOPROTO"
+	ErrPrefixNoPerm    = "NOPERM"
+	ErrPrefixWrongPass = "WRONGPASS"
+	ErrPrefixLoading   = "LOADING"
+	ErrPrefixMoved     = "MOVED"
+	ErrPrefixAsk       = "ASK"
+	ErrPrefixCrossSlot = "CROSSSLOT"
+	ErrPrefixDown      = "CLUSTERDOWN"
 )
 
 type ErrorReply struct {
+	prefix  string
 	message string
 }
 
+func NewErrorReply(prefix string, format string, args ...interface{}) *ErrorReply {
+	return &ErrorReply{
+		prefix:  prefix,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+func ErrUnknownCommand(r *Request) *ErrorReply {
+	args := make([]string, 0, len(r.Arguments))
+	for _, arg := range r.Arguments {
+		args = append(args, fmt.Sprintf("'%s'", arg))
+	}
+	return NewErrorReply(ErrPrefixErr, "unknown command '%s', with args beginning with: %s", strings.ToLower(r.Command), strings.Join(args, " "))
+}
+
+func ErrWrongArgs(command string) *ErrorReply {
+	return NewErrorReply(ErrPrefixErr, "wrong number of arguments for '%s' command", strings.ToLower(command))
+}
+
 func (er *ErrorReply) WriteTo(w io.Writer) (int64, error) {
-	n, err := w.Write([]byte("-ERROR " + er.message + "\r\n"))
+	prefix := er.prefix
+	if prefix == "" {
+		prefix = ErrPrefixErr
+	}
+	n, err := w.Write([]byte("-" + prefix + " " + er.message + "\r\n"))
 	return int64(n), err
 }
 
@@ -202,7 +422,33 @@ func (r *MultiBulkReply) WriteTo(w io.Writer) (int64, error) {
 	}
 }
 
+// ArrayReply is a multi bulk reply whose elements can be any reply, including
+// nested arrays, as used by COMMAND, HELLO and CLIENT
+type ArrayReply struct {
+	values []Reply
+}
+
+func (r *ArrayReply) WriteTo(w io.Writer) (int64, error) {
+	wrote, err := w.Write([]byte("*" + strconv.Itoa(len(r.values)) + "\r\n"))
+	total := int64(wrote)
+	if err != nil {
+		return total, err
+	}
+	for _, value := range r.values {
+		wroteData, err := value.WriteTo(w)
+		total += wroteData
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
 func writeNullBytes(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		n, err := w.Write([]byte("_\r\n"))
+		return int64(n), err
+	}
 	n, err := w.Write([]byte("$-1\r\n"))
 	return int64(n), err
 }
@@ -213,7 +459,7 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 	}
 	switch v := value.(type) {
 	case []byte:
-		if len(v) == 0 {
+		if v == nil {
 			return writeNullBytes(w)
 		}
 		buf := []byte("$" + strconv.Itoa(len(v)) + "\r\n")
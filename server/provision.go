@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+
+	"Didgen/config"
+	"Didgen/db"
+	log "Didgen/logger_seelog"
+	"Didgen/model"
+	"Didgen/raft"
+)
+
+// provisionKeys reconciles the keys section with __idgen__: missing keys are
+// created, keys behind their start moved forward and drift is logged
+func (s *Server) provisionKeys() error {
+	specs := config.Current().KeySpecs()
+	current, err := db.DATA.KeyValues()
+	if err != nil {
+		return err
+	}
+	keySpecs := make(map[string]*model.KeySpec)
+	for _, spec := range specs {
+		keySpecs[spec.Name] = spec
+	}
+	s.Lock()
+	s.keySpecs = keySpecs
+	s.Unlock()
+	if !s.writable() {
+		// the leader or the primary provisions the keys of every node
+		s.applySpecs(keySpecs)
+		return nil
+	}
+
+	if s.slots != nil {
+		// a node provisions the keys of its slots only
+		served := make([]*model.KeySpec, 0, len(specs))
+		for _, spec := range specs {
+			if s.servesKey(spec.Name) {
+				served = append(served, spec)
+			}
+		}
+		specs = served
+	}
+
+	drift := 0
+	replicated := false
+	for _, change := range db.PlanKeys(specs, current) {
+		// a key created meanwhile by another leader is only moved forward
+		advance := &raft.Command{Op: raft.OpAdvance, Key: change.Key, To: change.To}
+		switch change.Action {
+		case db.KeyCreate:
+			if replicated, err = s.replicate(advance); !replicated {
+				err = s.createKey(change.Key, change.To)
+			}
+			if err != nil {
+				return err
+			}
+			log.Info(fmt.Sprintf("Server keys %s created, next id %d", change.Key, keySpecs[change.Key].Start))
+		case db.KeyAdvance:
+			s.RLock()
+			idgen, ok := s.keyGeneratorMap[change.Key]
+			s.RUnlock()
+			if !ok {
+				continue
+			}
+			if replicated, err = s.replicate(advance); !replicated {
+				var advanced bool
+				if advanced, err = idgen.Advance(change.To); advanced {
+					s.propagate(&raft.Command{Op: raft.OpSet, Key: change.Key, To: change.To})
+				}
+			}
+			if err != nil {
+				return err
+			}
+			log.Info(fmt.Sprintf("Server keys %s advanced from %d to %d", change.Key, change.From, change.To))
+		case db.KeyDrift:
+			drift++
+			log.Warn(fmt.Sprintf("Server keys %s drift: %s", change.Key, change.Reason))
+		}
+	}
+
+	s.applySpecs(keySpecs)
+	log.Info(fmt.Sprintf("Server keys reconciled, %d declared, %d drift", len(specs), drift))
+	return nil
+}
+
+func (s *Server) applySpecs(keySpecs map[string]*model.KeySpec) {
+	s.RLock()
+	for key, idgen := range s.keyGeneratorMap {
+		idgen.SetSpec(keySpecs[key])
+	}
+	s.RUnlock()
+}
+
+func (s *Server) createKey(key string, value int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.keyGeneratorMap[key]; ok {
+		return nil
+	}
+	idgen, err := db.NewIdGenerator(key)
+	if err != nil {
+		return err
+	}
+	if err = s.SetKey(key); err != nil {
+		return err
+	}
+	if err = idgen.Create(value); err != nil {
+		return err
+	}
+	s.keyGeneratorMap[key] = idgen
+	s.propagate(&raft.Command{Op: raft.OpSet, Key: key, To: value})
+	return nil
+}
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Didgen/cluster"
+	"Didgen/config"
+	"Didgen/db"
+	log "Didgen/logger_seelog"
+	"Didgen/model"
+	"Didgen/raft"
+)
+
+// With replication raft the nodes of the config elect a leader. Only the
+// leader serves GET, SET and DEL, every batch it reserves and every key it
+// sets or deletes is committed to the raft log on a majority first and
+// applied to data.db of each node in log order. The log keeps the last
+// raftKeepEntries applied, a node further behind gets the keys of the leader
+// instead. The raft id of a node is host:trans_port as listed in nodes.
+
+const (
+	MessageRaft = "raft"
+
+	raftElectionTicks  = 10
+	raftHeartbeatTicks = 2
+	raftInboxSize      = 1024
+	raftOutboxSize     = 256
+	raftKeepEntries    = 1000
+)
+
+var (
+	errRaftTimeout = fmt.Errorf("replication timeout, no quorum to commit")
+	errRaftStopped = fmt.Errorf("replication stopped, server is shutting down")
+	errRaftDropped = fmt.Errorf("replication dropped the change, the leader changed")
+)
+
+type replication struct {
+	node      *raft.Node
+	storage   *db.RaftLog
+	self      string
+	addrs     map[string]string // raft id to the host:server_port for clients
+	transport *cluster.Transport
+	tick      time.Duration
+
+	inbox    chan raft.Message
+	proposed chan *proposal
+	outboxes map[string]chan raft.Message
+	waiters  map[uint64]*proposal
+	status   atomic.Value // raft.Status
+	leader   atomic.Value // the last leader heard of, kept during an election
+	done     chan struct{}
+
+	wait sync.WaitGroup
+}
+
+type proposal struct {
+	command *raft.Command
+	index   uint64
+	term    uint64
+	result  chan error
+}
+
+// raftPeers takes the raft ids from nodes, the entry of this node included
+func raftPeers(cfg *model.ServerConfig) (string, []string, map[string]string, error) {
+	self := ""
+	peers := make([]string, 0, len(cfg.Nodes))
+	addrs := make(map[string]string)
+	for _, node := range cfg.Nodes {
+		id := net.JoinHostPort(node["server_host"], node["trans_port"])
+		peers = append(peers, id)
+		addrs[id] = net.JoinHostPort(node["server_host"], node["server_port"])
+		if node["trans_port"] == cfg.TransPort && node["server_port"] == cfg.ServerPort && isLocalHost(node["server_host"], cfg.ServerHost) {
+			self = id
+		}
+	}
+	if self == "" {
+		return "", nil, nil, fmt.Errorf("replication raft: nodes does not list this node, server_port %s trans_port %s", cfg.ServerPort, cfg.TransPort)
+	}
+	return self, peers, addrs, nil
+}
+
+// startRaft starts the replication on the transport of the cluster, before
+// the cluster listens so no message of a peer is missed
+func (s *Server) startRaft() error {
+	self, peers, addrs, err := raftPeers(config.Current())
+	if err != nil {
+		return err
+	}
+	storage, err := db.DATA.RaftLog()
+	if err != nil {
+		return err
+	}
+	applied, err := storage.Applied()
+	if err != nil {
+		return err
+	}
+	node, err := raft.NewNode(raft.Config{
+		Id:             self,
+		Peers:          peers,
+		ElectionTicks:  raftElectionTicks,
+		HeartbeatTicks: raftHeartbeatTicks,
+		Storage:        raftStorage{storage, s},
+		Applied:        applied,
+		KeepEntries:    raftKeepEntries,
+	})
+	if err != nil {
+		return err
+	}
+	r := &replication{
+		node:      node,
+		storage:   storage,
+		self:      self,
+		addrs:     addrs,
+		transport: s.cluster.Transport(),
+		tick:      time.Duration(config.Current().ElectionTimeout) * time.Millisecond / raftElectionTicks,
+		inbox:     make(chan raft.Message, raftInboxSize),
+		proposed:  make(chan *proposal),
+		outboxes:  make(map[string]chan raft.Message),
+		waiters:   make(map[uint64]*proposal),
+		done:      make(chan struct{}),
+	}
+	r.status.Store(node.Status())
+	r.leader.Store("")
+	r.transport.Handle(MessageRaft, r.handleMessage)
+	for _, peer := range peers {
+		if peer != self {
+			r.outboxes[peer] = make(chan raft.Message, raftOutboxSize)
+			r.wait.Add(1)
+			go r.sendLoop(peer, r.outboxes[peer])
+		}
+	}
+	s.raft = r
+	db.HIGHWATER = raftHighWater{r}
+	r.wait.Add(1)
+	go r.run(s)
+	log.Info(fmt.Sprintf("Server replication raft started, id %s, %d nodes, applied %d", self, len(peers), applied))
+	return nil
+}
+
+func (r *replication) stop() {
+	close(r.done)
+	r.wait.Wait()
+}
+
+// run owns the node, it ticks it, steps the messages of the peers, proposes
+// and applies what is committed, one at a time
+func (r *replication) run(s *Server) {
+	defer r.wait.Done()
+	ticker := time.NewTicker(r.tick)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			err = r.node.Tick()
+		case m := <-r.inbox:
+			err = r.node.Step(m)
+		case p := <-r.proposed:
+			var perr error
+			if p.index, p.term, perr = r.node.Propose(p.command.Encode()); perr != nil {
+				p.result <- perr
+			} else {
+				r.waiters[p.index] = p
+			}
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("Server replication error: %v", err))
+		}
+		r.ready(s)
+	}
+}
+
+func (r *replication) ready(s *Server) {
+	for _, m := range r.node.ReadMessages() {
+		select {
+		case r.outboxes[m.To] <- m:
+		default:
+			// the peer is slow or gone, raft sends again
+		}
+	}
+
+	for _, entry := range r.node.ReadCommitted() {
+		err := s.applyEntry(entry)
+		if err != nil && err != raft.ErrConflict {
+			log.Error(fmt.Sprintf("Server replication apply %d error: %v", entry.Index, err))
+		}
+		if serr := r.storage.SetApplied(entry.Index); serr != nil {
+			log.Error(fmt.Sprintf("Server replication save applied %d error: %v", entry.Index, serr))
+		}
+		if p, ok := r.waiters[entry.Index]; ok {
+			delete(r.waiters, entry.Index)
+			if p.term != entry.Term {
+				err = errRaftDropped
+			}
+			p.result <- err
+		}
+	}
+
+	status := r.node.Status()
+	for index, p := range r.waiters {
+		// replaced by a snapshot, not applied one by one
+		if index <= status.Applied {
+			delete(r.waiters, index)
+			p.result <- errRaftDropped
+		}
+	}
+	last := r.status.Load().(raft.Status)
+	r.status.Store(status)
+	if status.Leader != "" {
+		r.leader.Store(status.Leader)
+	}
+	if status.Leader != last.Leader || status.State != last.State {
+		log.Info(fmt.Sprintf("Server replication term %d, %s, leader %s", status.Term, status.State, status.Leader))
+	}
+	if status.State == raft.StateLeader && last.State != raft.StateLeader {
+		// the keys section is provisioned by the leader, through the log
+		go func() {
+			if err := s.provisionKeys(); err != nil {
+				log.Error(fmt.Sprintf("Server replication provision keys error: %v", err))
+			}
+		}()
+	}
+}
+
+func (r *replication) sendLoop(to string, outbox chan raft.Message) {
+	defer r.wait.Done()
+	for {
+		select {
+		case <-r.done:
+			return
+		case m := <-outbox:
+			ctx, cancel := context.WithTimeout(context.Background(), r.tick*raftElectionTicks)
+			r.transport.Call(ctx, to, MessageRaft, m, nil)
+			cancel()
+		}
+	}
+}
+
+func (r *replication) handleMessage(from string, payload json.RawMessage) (interface{}, error) {
+	var m raft.Message
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, err
+	}
+	if m.To != r.self {
+		return nil, fmt.Errorf("raft message for %s, this is %s", m.To, r.self)
+	}
+	if m.From != from {
+		return nil, fmt.Errorf("raft message of %s sent by %s", m.From, from)
+	}
+	select {
+	case r.inbox <- m:
+	default:
+	}
+	return nil, nil
+}
+
+// propose commits a command and waits until this node applied it, the
+// result of applying it is returned
+func (r *replication) propose(command *raft.Command) error {
+	p := &proposal{command: command, result: make(chan error, 1)}
+	timeout := time.NewTimer(2 * r.tick * raftElectionTicks)
+	defer timeout.Stop()
+	select {
+	case r.proposed <- p:
+	case <-timeout.C:
+		return errRaftTimeout
+	case <-r.done:
+		return errRaftStopped
+	}
+	select {
+	case err := <-p.result:
+		return err
+	case <-timeout.C:
+		return errRaftTimeout
+	case <-r.done:
+		return errRaftStopped
+	}
+}
+
+func (r *replication) Status() raft.Status {
+	return r.status.Load().(raft.Status)
+}
+
+// owner is the raft id of the leader, or of the last one while electing
+func (r *replication) owner() (string, bool) {
+	if leader := r.Status().Leader; leader != "" {
+		return leader, true
+	}
+	return r.leader.Load().(string), false
+}
+
+// raftStorage is the raft.Storage of replication raft, the keys of data.db
+// are the snapshot
+type raftStorage struct {
+	*db.RaftLog
+	s *Server
+}
+
+func (r raftStorage) Snapshot() ([]byte, error) {
+	keys, err := db.DATA.KeyValues()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(keys)
+}
+
+// Restore sets the keys before the log, after a crash in between the leader
+// sends the snapshot again
+func (r raftStorage) Restore(snapshot raft.Snapshot) error {
+	keys := make(map[string]int64)
+	if err := json.Unmarshal(snapshot.Data, &keys); err != nil {
+		return err
+	}
+	if err := r.s.replaceKeys(keys); err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Server replication restored a snapshot of %d keys at %d", len(keys), snapshot.Index))
+	return r.Reset(snapshot.Index, snapshot.Term)
+}
+
+// raftHighWater commits the reservation of a batch before refill hands out
+// any id of it. A batch is never given back, the ids left are skipped.
+type raftHighWater struct {
+	r *replication
+}
+
+func (h raftHighWater) Reserve(key string, from, to int64) error {
+	return h.r.propose(&raft.Command{Op: raft.OpReserve, Key: key, From: from, To: to})
+}
+
+func (h raftHighWater) Release(key string, batchMax, cur int64) (bool, error) {
+	return false, nil
+}
+
+// applyEntry applies a committed entry to data.db and to the generators
+func (s *Server) applyEntry(entry raft.Entry) error {
+	if len(entry.Data) == 0 {
+		return nil
+	}
+	command, err := raft.DecodeCommand(entry.Data)
+	if err != nil {
+		return err
+	}
+	return s.applyCommand(command)
+}
+
+// applyCommand applies a change of a key made by the leader or the primary
+// to data.db and to the generators
+func (s *Server) applyCommand(command *raft.Command) error {
+	err := db.DATA.ApplyCommand(command)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	idgen, ok := s.keyGeneratorMap[command.Key]
+	switch command.Op {
+	case raft.OpDel:
+		if ok {
+			delete(s.keyGeneratorMap, command.Key)
+			idgen.Invalidate()
+		}
+	case raft.OpSet, raft.OpAdvance:
+		if ok {
+			idgen.Invalidate()
+			break
+		}
+		if idgen, err = db.NewIdGenerator(command.Key); err != nil {
+			return err
+		}
+		idgen.SetSpec(s.keySpecs[command.Key])
+		s.keyGeneratorMap[command.Key] = idgen
+	}
+	return nil
+}
+
+// replaceKeys makes the keys of data.db and the generators those given, the
+// others are deleted
+func (s *Server) replaceKeys(keys map[string]int64) error {
+	local, err := db.DATA.KeyValues()
+	if err != nil {
+		return err
+	}
+	for key := range local {
+		if _, ok := keys[key]; !ok {
+			if err = s.applyCommand(&raft.Command{Op: raft.OpDel, Key: key}); err != nil {
+				return err
+			}
+		}
+	}
+	for key, value := range keys {
+		if current, ok := local[key]; ok && current == value {
+			continue
+		}
+		if err = s.applyCommand(&raft.Command{Op: raft.OpSet, Key: key, To: value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicated is true when the keys change through the raft log
+func (s *Server) replicated() bool {
+	return config.Current().Replication == "raft"
+}
+
+// writable is true when this node may change the keys: always without
+// replication, the leader with raft and the primary with async
+func (s *Server) writable() bool {
+	switch config.Current().Replication {
+	case "raft":
+		return s.raft != nil && s.raft.Status().State == raft.StateLeader
+	case "async":
+		if s.async == nil {
+			return config.Current().ReplicaOf == ""
+		}
+		return s.async.isPrimary()
+	}
+	return true
+}
+
+// replicate commits a change of the keys when the leader, false without
+// replication, the caller changes data.db itself then
+func (s *Server) replicate(command *raft.Command) (bool, error) {
+	if !s.replicated() {
+		return false, nil
+	}
+	if s.raft == nil {
+		return true, raft.ErrNotLeader
+	}
+	return true, s.raft.propose(command)
+}
+
+func (s *Server) infoReplication() []string {
+	if s.async != nil {
+		return s.infoAsync()
+	}
+	if s.raft == nil {
+		return []string{infoLine("replication", config.Current().Replication), infoLine("role", s.role())}
+	}
+	status := s.raft.Status()
+	role := "slave"
+	if status.State == raft.StateLeader {
+		role = "master"
+	}
+	return []string{
+		infoLine("replication", config.Current().Replication),
+		infoLine("role", role),
+		infoLine("raft_id", status.Id),
+		infoLine("raft_state", status.State),
+		infoLine("raft_term", status.Term),
+		infoLine("raft_leader", status.Leader),
+		infoLine("raft_commit_index", status.Commit),
+		infoLine("raft_applied_index", status.Applied),
+		infoLine("raft_last_index", status.LastIndex),
+	}
+}
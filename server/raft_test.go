@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"Didgen/db"
+	"Didgen/model"
+	"Didgen/raft"
+)
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// waitFor polls cond for up to 10 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a GET after a negative SET commits one batch, not a MaxInt64 high-water
+// mark every node would keep
+func TestRaftReserveAfterNegativeSet(t *testing.T) {
+	trans := freePort(t)
+	s := newTestServer(t, func(c *model.ServerConfig) {
+		c.Replication = "raft"
+		c.ElectionTimeout = 100
+		c.TransPort = trans
+		c.ClusterSecret = "s3cret"
+		c.BatchSize = 100
+		c.Nodes = []map[string]string{{"server_host": "127.0.0.1", "server_port": "0", "trans_port": trans}}
+	})
+	if err := s.startCluster(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the election", func() bool { return s.raft.Status().State == raft.StateLeader })
+
+	c := s.testConn(t)
+	if got := c.do("SET", "k", "-10"); got != "+OK\r\n" {
+		t.Fatalf("SET k -10 = %q", got)
+	}
+	if got, want := c.do("GET", "k"), bulk("-9"); got != want {
+		t.Fatalf("GET k = %q, want %q", got, want)
+	}
+	high, err := db.DATA.GetKey("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if high != 90 {
+		t.Errorf("committed high-water %s, want 90", strconv.FormatInt(high, 10))
+	}
+}
+
+// a snapshot of the leader replaces the keys, the generators and the log, and
+// the node starts from it
+func TestRaftRestoreSnapshot(t *testing.T) {
+	trans := freePort(t)
+	s := newTestServer(t, func(c *model.ServerConfig) {
+		c.Replication = "raft"
+		c.ElectionTimeout = 100
+		c.TransPort = trans
+		c.ClusterSecret = "s3cret"
+		c.BatchSize = 100
+		c.Nodes = []map[string]string{{"server_host": "127.0.0.1", "server_port": "0", "trans_port": trans}}
+	})
+	for _, key := range []string{"stale", "b"} {
+		if err := s.applyCommand(&raft.Command{Op: raft.OpSet, Key: key, To: 7}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage, err := db.DATA.RaftLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Append([]raft.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	err = raftStorage{storage, s}.Restore(raft.Snapshot{Index: 50, Term: 2, Data: []byte(`{"b":300,"c":10}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]int64{"stale": -1, "b": 300, "c": 10} {
+		if got := keyValue(t, key); got != value {
+			t.Errorf("%s = %d after the snapshot, want %d", key, got, value)
+		}
+	}
+	if _, ok := s.keyGeneratorMap["stale"]; ok {
+		t.Error("the generator of a key the snapshot lacks is kept")
+	}
+
+	if err = s.startCluster(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the election", func() bool { return s.raft.Status().State == raft.StateLeader })
+	if status := s.raft.Status(); status.Applied < 51 {
+		t.Errorf("applied %d, want the entry of the leader after the snapshot at 50", status.Applied)
+	}
+	c := s.testConn(t)
+	if got := c.do("GET", "b"); got != bulk("301") {
+		t.Errorf("GET b = %q", got)
+	}
+	if got := c.do("GET", "c"); got != bulk("11") {
+		t.Errorf("GET c = %q", got)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"Didgen/config"
+	log "Didgen/logger_seelog"
+)
+
+// A node which does not serve GET, SET and DEL, a raft follower or an async
+// standby, sends the client to the node which does the way a redis cluster
+// node does for a slot it does not serve: MOVED when it knows the owner, ASK
+// while the owner is not confirmed, a raft election or a standby which lost
+// its link to the primary, so the client tries the last owner for this one
+// request only. The address is the server_host:server_port of the owner in
+// nodes. With redirect proxy the node forwards the request to the owner over
+// trans_port instead and the client gets the reply of the owner, for clients
+// which do not follow redirections.
+
+const (
+	MessageProxy = "proxy"
+
+	proxyTimeout = 5 * time.Second
+)
+
+// proxyRequest names the user the client authenticated as, the owner checks
+// the command against that user of its own ACL again
+type proxyRequest struct {
+	User      string   `json:"user"`
+	Protocol  int      `json:"protocol"`
+	Command   string   `json:"command"`
+	Arguments [][]byte `json:"arguments"`
+}
+
+type proxyReply struct {
+	Reply []byte `json:"reply"` // as written to the client
+}
+
+// nodeAddr is the host:server_port of the entry of nodes with the
+// host:trans_port addr
+func nodeAddr(addr string) string {
+	for _, node := range config.Current().Nodes {
+		if net.JoinHostPort(node["server_host"], node["trans_port"]) == addr {
+			return net.JoinHostPort(node["server_host"], node["server_port"])
+		}
+	}
+	return ""
+}
+
+// owner is the node serving the keys, its host:server_port for the clients,
+// its host:trans_port for proxying and whether it is confirmed
+func (s *Server) owner() (string, string, bool) {
+	if s.async != nil {
+		trans, primary, confirmed := s.async.owner()
+		if addr := nodeAddr(trans); addr != "" {
+			return addr, trans, confirmed
+		}
+		// the primary is not in nodes, it reported its address when linked
+		return primary, trans, confirmed && primary != ""
+	}
+	if s.raft != nil {
+		leader, confirmed := s.raft.owner()
+		if leader == "" {
+			return "", "", false
+		}
+		return s.raft.addrs[leader], leader, confirmed
+	}
+	return "", "", false
+}
+
+// redirect is nil when this node serves the keys, otherwise the reply sending
+// the client to the owner, or the reply of the owner with redirect proxy
+func (s *Server) redirect(r *Request) Reply {
+	if reply := s.slotRedirect(r); reply != nil {
+		return reply
+	}
+	if s.writable() {
+		return nil
+	}
+	addr, trans, confirmed := s.owner()
+	if addr == "" {
+		if s.async != nil {
+			return NewErrorReply(ErrPrefixDown, "The primary %s is not reachable", config.Current().ReplicaOf)
+		}
+		return NewErrorReply(ErrPrefixDown, "The cluster is down, no leader elected")
+	}
+	prefix := ErrPrefixMoved
+	if !confirmed {
+		prefix = ErrPrefixAsk
+	}
+	return s.redirectTo(r, prefix, requestSlot(r), addr, trans)
+}
+
+// redirectTo answers MOVED or ASK with the node serving the slot, with
+// redirect proxy the reply of that node
+func (s *Server) redirectTo(r *Request, prefix string, slot int, addr, trans string) Reply {
+	// a proxied request is never proxied again, the owner changed meanwhile
+	if config.Current().Redirect == "proxy" && !r.proxied && trans != "" {
+		reply, err := s.proxy(trans, r)
+		if err == nil {
+			atomic.AddInt64(&s.stats.ProxiedCommands, 1)
+			return reply
+		}
+		atomic.AddInt64(&s.stats.ProxyErrors, 1)
+		log.Warn(fmt.Sprintf("Server proxy %s to %s error: %v", r.Command, trans, err))
+	}
+	atomic.AddInt64(&s.stats.Redirections, 1)
+	return NewErrorReply(prefix, "%d %s", slot, addr)
+}
+
+// proxy runs the request on the owner as the user of the client, once it
+// passed the ACL here
+func (s *Server) proxy(trans string, r *Request) (Reply, error) {
+	if !r.allowed {
+		return nil, fmt.Errorf("%s did not pass the ACL", r.Command)
+	}
+	request := proxyRequest{
+		Protocol:  RESP2,
+		Command:   r.Command,
+		Arguments: r.Arguments,
+	}
+	if r.Client != nil {
+		if name, authenticated := r.Client.User(); authenticated {
+			request.User = name
+		}
+		request.Protocol = r.Client.Protocol()
+	}
+	var reply proxyReply
+	ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
+	defer cancel()
+	if err := s.cluster.Transport().Call(ctx, trans, MessageProxy, request, &reply); err != nil {
+		return nil, err
+	}
+	return &RawReply{value: reply.Reply}, nil
+}
+
+// handleProxy serves a request a node of nodes proxied, as the user of this
+// node's ACL the client authenticated as there, ServeRequest checks the
+// command against it again
+func (s *Server) handleProxy(from string, payload json.RawMessage) (interface{}, error) {
+	if nodeAddr(from) == "" {
+		return nil, fmt.Errorf("proxy from %s, not a node of nodes", from)
+	}
+	var request proxyRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	client := &Client{
+		Addr:       from,
+		CreateTime: time.Now(),
+		protocol:   int32(request.Protocol),
+	}
+	if user, ok := s.acl.User(request.User); ok && user.Enabled {
+		client.userName, client.authenticated = user.Name, true
+	}
+	reply := s.ServeRequest(&Request{
+		Command:       request.Command,
+		Arguments:     request.Arguments,
+		RemoteAddress: from,
+		Client:        client,
+		proxied:       true,
+	})
+	var buf bytes.Buffer
+	if _, err := reply.WriteTo(&protocolBuffer{Buffer: &buf, protocol: request.Protocol}); err != nil {
+		return nil, err
+	}
+	return proxyReply{Reply: buf.Bytes()}, nil
+}
+
+// protocolBuffer writes a reply in the protocol of the client of the proxy
+type protocolBuffer struct {
+	*bytes.Buffer
+	protocol int
+}
+
+func (b *protocolBuffer) Protocol() int {
+	return b.protocol
+}
+
+// RawReply is a reply already in the protocol of the client
+type RawReply struct {
+	value []byte
+}
+
+func (r *RawReply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.value)
+	return int64(n), err
+}
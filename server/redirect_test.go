@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"Didgen/model"
+)
+
+// a proxied request runs as the user of the ACL of the owner, whatever the
+// payload claims
+func TestHandleProxyACL(t *testing.T) {
+	s := newTestServer(t, func(c *model.ServerConfig) {
+		c.Users = []map[string]string{
+			{"name": "default", "password": "secret", "commands": "+@all", "keys": "*"},
+			{"name": "reader", "password": "secret", "commands": "+@connection +@read", "keys": "*"},
+			{"name": "other", "password": "secret", "commands": "+@all", "keys": "other_*"},
+			{"name": "off", "password": "secret", "commands": "+@all", "keys": "*", "enabled": "off"},
+		}
+		c.Nodes = []map[string]string{{"server_host": "127.0.0.1", "server_port": "6390", "trans_port": "6090"}}
+	})
+	proxied := func(from, user, payload string) (string, error) {
+		if payload == "" {
+			payload = `{"user":"` + user + `","authenticated":true,"protocol":2,"command":"get","arguments":["a2V5"]}`
+		}
+		reply, err := s.handleProxy(from, json.RawMessage(payload))
+		if err != nil {
+			return "", err
+		}
+		return string(reply.(proxyReply).Reply), nil
+	}
+
+	if _, err := proxied("127.0.0.1:7000", "default", ""); err == nil {
+		t.Error("proxy from a node not in nodes served")
+	}
+	cases := []struct {
+		user string
+		want string
+	}{
+		{"", "-NOAUTH "},
+		{"nosuch", "-NOAUTH "},
+		{"off", "-NOAUTH "},
+		{"reader", "-NOPERM "},
+		{"other", "-NOPERM "},
+		{"default", "$-1\r\n"}, // served, there is no such key
+	}
+	for _, tc := range cases {
+		got, err := proxied("127.0.0.1:6090", tc.user, "")
+		if err != nil {
+			t.Fatalf("user %q: %v", tc.user, err)
+		}
+		if !strings.HasPrefix(got, tc.want) {
+			t.Errorf("GET key as %q = %q, want %q", tc.user, got, tc.want)
+		}
+	}
+}
+
+// only a request which passed checkAccess here is sent to the owner
+func TestProxyNotAllowed(t *testing.T) {
+	s := newTestServer(t, nil)
+	if _, err := s.proxy("127.0.0.1:6090", &Request{Command: "get", Arguments: [][]byte{[]byte("key")}}); err == nil {
+		t.Error("a request which did not pass the ACL was proxied")
+	}
+}
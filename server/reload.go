@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"Didgen/config"
+	"Didgen/db"
+	log "Didgen/logger_seelog"
+	"Didgen/model"
+)
+
+// reloadable keys are applied by Reload, the others need a restart
+var reloadable = map[string]bool{
+	"log_level":            true,
+	"threads":              true,
+	"batch_size":           true,
+	"max_clients":          true,
+	"max_request_args":     true,
+	"max_bulk_length":      true,
+	"idle_timeout":         true,
+	"read_timeout":         true,
+	"shutdown_timeout":     true,
+	"promote_margin":       true,
+	"redirect":             true,
+	"sentinel_master_name": true,
+	"users":                true,
+	"keys":                 true,
+}
+
+// reloadState is what INFO reports about the last configuration reload
+type reloadState struct {
+	reloads    int64
+	lastTime   time.Time
+	lastStatus string
+	applied    []string
+	pending    []string
+	lock       sync.Mutex
+}
+
+// Reload reads configuration.yml again and applies the keys which are safe to
+// change at runtime, changed keys needing a restart are logged as pending
+func (s *Server) Reload() error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	newConfig, sources, err := config.Reload()
+	if err == nil && db.CONFIG != nil {
+		// values of CONFIG SET keep overriding the file, as they do at startup
+		var keys []string
+		keys, err = db.CONFIG.ApplyTo(newConfig)
+		for _, key := range keys {
+			sources[key] = "db"
+		}
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("Server reload %s error: %v", config.ConfigPath, err))
+		s.reload.done("err", nil, nil)
+		return err
+	}
+
+	oldConfig := config.Current()
+	applied := make([]string, 0)
+	pending := make([]string, 0)
+	changes := make([]db.ConfigChange, 0)
+	for _, f := range config.Schema {
+		if f.Type == config.TypeUsers {
+			if !reflect.DeepEqual(oldConfig.Users, newConfig.Users) {
+				applied = append(applied, f.Key)
+			}
+			continue
+		}
+		oldValue, _ := oldConfig.Get(f.Key)
+		newValue, _ := newConfig.Get(f.Key)
+		if oldValue == newValue {
+			continue
+		}
+		if !reloadable[f.Key] {
+			pending = append(pending, f.Key)
+			if f.Type == config.TypeSecret {
+				log.Warn(fmt.Sprintf("Server reload %s changed, needs a restart", f.Key))
+			} else {
+				log.Warn(fmt.Sprintf("Server reload %s: '%s' -> '%s' needs a restart", f.Key, oldValue, newValue))
+			}
+			continue
+		}
+		applied = append(applied, f.Key)
+		if f.Type != config.TypeKeys {
+			changes = append(changes, db.ConfigChange{Key: f.Key, Old: oldValue, New: newValue})
+		}
+		if f.Type == config.TypeKeys {
+			log.Info(fmt.Sprintf("Server reload %s changed", f.Key))
+		} else {
+			log.Info(fmt.Sprintf("Server reload %s: '%s' -> '%s'", f.Key, oldValue, newValue))
+		}
+	}
+
+	config.Update(func(c *model.ServerConfig) {
+		for _, key := range applied {
+			if key == "users" {
+				c.Users = newConfig.Users
+			} else {
+				value, _ := newConfig.Get(key)
+				c.Set(key, value)
+			}
+		}
+	})
+	for _, key := range applied {
+		config.SetSource(key, sources[key])
+	}
+	s.applyConfig(applied)
+	if db.CONFIG != nil {
+		// users are left out of the history, they hold passwords, and keys
+		// as CONFIG SET cannot set them
+		if _, err = db.CONFIG.Record("reload", "sighup", changes); err != nil {
+			log.Error(fmt.Sprintf("Server reload history error: %v", err))
+		}
+	}
+	s.reload.done("ok", applied, pending)
+	log.Info(fmt.Sprintf("Server reload %s, applied: [%s], pending restart: [%s]", config.ConfigPath, strings.Join(applied, ", "), strings.Join(pending, ", ")))
+	return nil
+}
+
+// applyConfig makes the running server use the changed keys of the config
+func (s *Server) applyConfig(keys []string) {
+	limits := false
+	for _, key := range keys {
+		switch key {
+		case "log_level":
+			if err := log.SetLevel("main", config.Current().LogLevel); err != nil {
+				log.Error(fmt.Sprintf("Server reload log_level error: %v", err))
+			}
+		case "threads":
+			runtime.GOMAXPROCS(config.Current().Threads)
+		case "batch_size":
+			s.RLock()
+			for _, idgen := range s.keyGeneratorMap {
+				idgen.SetBatchSize(config.Current().BatchSize)
+			}
+			s.RUnlock()
+		case "users":
+			dbUsers, err := db.CONFIG.GetUsers()
+			if err != nil {
+				log.Error(fmt.Sprintf("Server reload users error: %v", err))
+				continue
+			}
+			s.acl.Load(config.Current().Users, dbUsers)
+		case "keys":
+			if !s.waitReleased() {
+				log.Error("Server reload keys error: data.db not released by the old process")
+				continue
+			}
+			if err := s.provisionKeys(); err != nil {
+				log.Error(fmt.Sprintf("Server reload keys error: %v", err))
+			}
+		case "max_clients", "max_request_args", "max_bulk_length", "idle_timeout", "read_timeout":
+			limits = true
+		}
+	}
+	if limits {
+		s.SetLimits(LimitsFromConfig(config.Current()))
+	}
+}
+
+func (r *reloadState) done(status string, applied []string, pending []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reloads++
+	r.lastTime = time.Now()
+	r.lastStatus = status
+	if status == "ok" {
+		r.applied = applied
+		r.pending = pending
+	}
+}
+
+func (r *reloadState) info() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	lastTime := int64(0)
+	if r.reloads > 0 {
+		lastTime = r.lastTime.Unix()
+	}
+	return []string{
+		infoLine("config_reloads", r.reloads),
+		infoLine("config_last_reload_time", lastTime),
+		infoLine("config_last_reload_status", r.lastStatus),
+		infoLine("config_last_reload_applied", strings.Join(r.applied, ",")),
+		infoLine("config_pending_restart", strings.Join(r.pending, ",")),
+	}
+}
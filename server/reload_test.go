@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"Didgen/config"
+)
+
+// SIGHUP and CONFIG SET replace the config while requests read it, run with
+// -race; the last value set is the one in effect
+func TestConfigChangesDuringRequests(t *testing.T) {
+	s := newTestServer(t, nil)
+	const rounds = 50
+	var wait sync.WaitGroup
+	wait.Add(4)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < rounds; i++ {
+			s.Reload()
+		}
+	}()
+	go func() {
+		defer wait.Done()
+		c := s.testConn(t)
+		for i := 1; i <= rounds; i++ {
+			if got := c.do("CONFIG", "SET", "batch_size", strconv.Itoa(i), "promote_margin", strconv.Itoa(i)); got != "+OK\r\n" {
+				t.Errorf("CONFIG SET = %q", got)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wait.Done()
+		c := s.testConn(t)
+		for i := 0; i < rounds; i++ {
+			c.do("SET", "key"+strconv.Itoa(i), "1")
+			c.do("GET", "key"+strconv.Itoa(i))
+		}
+	}()
+	go func() {
+		defer wait.Done()
+		c := s.testConn(t)
+		for i := 0; i < rounds; i++ {
+			c.do("CONFIG", "GET", "*")
+			c.do("INFO")
+		}
+	}()
+	wait.Wait()
+
+	s.Reload()
+	c := s.testConn(t)
+	if got, want := c.do("CONFIG", "GET", "batch_size"), "*2\r\n"+bulk("batch_size")+bulk(strconv.Itoa(rounds)); got != want {
+		t.Errorf("CONFIG GET batch_size = %q, want %q", got, want)
+	}
+	if cfg := config.Current(); cfg.BatchSize != rounds || cfg.PromoteMargin != rounds {
+		t.Errorf("batch_size %d, promote_margin %d in effect, want %d", cfg.BatchSize, cfg.PromoteMargin, rounds)
+	}
+}
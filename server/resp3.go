@@ -0,0 +1,159 @@
+package server
+
+import (
+	"io"
+	"strconv"
+)
+
+// RESP2 is the default protocol, a connection switches to RESP3 with HELLO 3
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// protocolWriter is implemented by writers which know the protocol of the
+// connection, replies fall back to RESP2 for any other writer
+type protocolWriter interface {
+	Protocol() int
+}
+
+func protocolOf(w io.Writer) int {
+	if pw, ok := w.(protocolWriter); ok {
+		return pw.Protocol()
+	}
+	return RESP2
+}
+
+func writeAggregate(w io.Writer, kind byte, count int, values []Reply) (int64, error) {
+	wrote, err := w.Write([]byte(string(kind) + strconv.Itoa(count) + "\r\n"))
+	total := int64(wrote)
+	if err != nil {
+		return total, err
+	}
+	for _, value := range values {
+		wroteData, err := value.WriteTo(w)
+		total += wroteData
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// MapReply is a RESP3 map, RESP2 connections get a flat key value array
+type MapReply struct {
+	values []Reply // key, value, key, value ...
+}
+
+func NewMapReply() *MapReply {
+	return &MapReply{
+		values: make([]Reply, 0),
+	}
+}
+
+func (r *MapReply) Add(key string, value Reply) *MapReply {
+	r.values = append(r.values, &BulkReply{value: []byte(key)}, value)
+	return r
+}
+
+func (r *MapReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		return writeAggregate(w, '%', len(r.values)/2, r.values)
+	}
+	return writeAggregate(w, '*', len(r.values), r.values)
+}
+
+// SetReply is a RESP3 set, RESP2 connections get an array
+type SetReply struct {
+	values []Reply
+}
+
+func (r *SetReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		return writeAggregate(w, '~', len(r.values), r.values)
+	}
+	return writeAggregate(w, '*', len(r.values), r.values)
+}
+
+// PushReply is an out of band message, RESP2 connections get an array which
+// is only meaningful to clients in a subscribed state
+type PushReply struct {
+	values []Reply
+}
+
+func (r *PushReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		return writeAggregate(w, '>', len(r.values), r.values)
+	}
+	return writeAggregate(w, '*', len(r.values), r.values)
+}
+
+type NullReply struct{}
+
+func (r *NullReply) WriteTo(w io.Writer) (int64, error) {
+	return writeNullBytes(w)
+}
+
+type BoolReply struct {
+	value bool
+}
+
+func (r *BoolReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		if r.value {
+			n, err := w.Write([]byte("#t\r\n"))
+			return int64(n), err
+		}
+		n, err := w.Write([]byte("#f\r\n"))
+		return int64(n), err
+	}
+	var number int64
+	if r.value {
+		number = 1
+	}
+	return (&IntReply{number: number}).WriteTo(w)
+}
+
+type DoubleReply struct {
+	value float64
+}
+
+func (r *DoubleReply) WriteTo(w io.Writer) (int64, error) {
+	value := strconv.FormatFloat(r.value, 'f', -1, 64)
+	if protocolOf(w) == RESP3 {
+		n, err := w.Write([]byte("," + value + "\r\n"))
+		return int64(n), err
+	}
+	return writeBytes([]byte(value), w)
+}
+
+// VerbatimReply is a RESP3 verbatim string such as INFO output, RESP2
+// connections get a bulk string
+type VerbatimReply struct {
+	format string // three letters, txt or mkd
+	value  []byte
+}
+
+func (r *VerbatimReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		buf := []byte("=" + strconv.Itoa(len(r.value)+4) + "\r\n" + r.format + ":")
+		buf = append(buf, r.value...)
+		buf = append(buf, []byte("\r\n")...)
+		n, err := w.Write(buf)
+		return int64(n), err
+	}
+	return writeBytes(r.value, w)
+}
+
+// IdReply is a generated id, a bulk string for RESP2 clients which always got
+// one and an integer for RESP3 clients
+type IdReply struct {
+	id int64
+}
+
+func (r *IdReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		return (&IntReply{number: r.id}).WriteTo(w)
+	}
+	return writeBytes([]byte(strconv.FormatInt(r.id, 10)), w)
+}
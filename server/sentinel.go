@@ -0,0 +1,324 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"Didgen/cluster"
+	"Didgen/config"
+)
+
+// Every node answers the SENTINEL commands the Sentinel aware clients use to
+// find the primary, as if it were a sentinel watching one master named
+// sentinel_master_name. The primary is the node serving GET, SET and DEL: the
+// node itself without replication, the raft leader, or the async primary, so
+// after an election or a PROMOTE the clients asking again get the new one. The
+// other nodes are its replicas and, as they answer SENTINEL too, the other
+// sentinels. ROLE tells the clients connecting to a node whether it is the
+// primary.
+
+const sentinelDownAfter = 30000 // milliseconds, reported only
+
+// sentinelNode is a node as SENTINEL reports it
+type sentinelNode struct {
+	Addr   string // host:server_port
+	Id     string
+	Down   bool
+	Seen   time.Time // the last heartbeat reply, zero when never or self
+	Offset int64
+}
+
+// selfAddr is the host:server_port the clients reach this node at, its
+// entry in nodes or the address the client connected to
+func (s *Server) selfAddr(r *Request) string {
+	cfg := config.Current()
+	for _, node := range cfg.Nodes {
+		if node["trans_port"] == cfg.TransPort && node["server_port"] == cfg.ServerPort && isLocalHost(node["server_host"], cfg.ServerHost) {
+			return net.JoinHostPort(node["server_host"], node["server_port"])
+		}
+	}
+	host := cfg.ServerHost
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() && r.Client != nil {
+		if local, _, err := net.SplitHostPort(r.Client.LocalAddr); err == nil {
+			host = local
+		}
+	}
+	return net.JoinHostPort(host, cfg.ServerPort)
+}
+
+// role is master on the node serving the keys, slave on the others
+func (s *Server) role() string {
+	if s.writable() {
+		return "master"
+	}
+	return "slave"
+}
+
+// replOffset is the replication offset of this node, the raft applied index
+// with raft
+func (s *Server) replOffset() int64 {
+	if s.async != nil {
+		s.async.lock.Lock()
+		defer s.async.lock.Unlock()
+		if s.async.replicaOf == "" {
+			return s.async.offset
+		}
+		return s.async.primaryOffset
+	}
+	if s.raft != nil {
+		return int64(s.raft.Status().Applied)
+	}
+	return 0
+}
+
+// sentinelPrimary is the primary, down while it is not confirmed
+func (s *Server) sentinelPrimary(r *Request) sentinelNode {
+	addr := s.selfAddr(r)
+	if s.writable() {
+		return sentinelNode{Addr: addr, Id: s.sentinelId(), Offset: s.replOffset()}
+	}
+	owner, _, confirmed := s.owner()
+	primary := sentinelNode{Addr: owner, Down: !confirmed}
+	if peer, ok := s.sentinelPeers()[owner]; ok {
+		primary.Id, primary.Seen = peer.Id, peer.Seen
+	}
+	return primary
+}
+
+func (s *Server) sentinelId() string {
+	return cluster.NodeID(config.Current().ServerId, config.Current().ServerHost, config.Current().ServerPort)
+}
+
+// sentinelPeers are the other nodes by host:server_port, with the state of
+// their heartbeats. Without replication every node serves its own keys, they
+// are not replicas of this one.
+func (s *Server) sentinelPeers() map[string]sentinelNode {
+	peers := make(map[string]sentinelNode)
+	if s.cluster == nil || (s.raft == nil && s.async == nil) {
+		return peers
+	}
+	for _, peer := range s.cluster.Peers() {
+		addr := net.JoinHostPort(peer.Config.Host, peer.Config.ServerPort)
+		peers[addr] = sentinelNode{
+			Addr: addr,
+			Id:   peer.Info.Id,
+			Down: peer.State == cluster.StateDead || peer.State == cluster.StateUnknown,
+			Seen: peer.PongRecv,
+		}
+	}
+	return peers
+}
+
+// sentinelReplicas are the standbys syncing from an async primary, otherwise
+// the nodes but the primary
+func (s *Server) sentinelReplicas(r *Request, primary string) []sentinelNode {
+	replicas := make([]sentinelNode, 0)
+	peers := s.sentinelPeers()
+	if s.async != nil && s.writable() {
+		s.async.lock.Lock()
+		defer s.async.lock.Unlock()
+		for _, standby := range s.async.standbys {
+			replica := sentinelNode{
+				Addr:   standby.addr,
+				Down:   time.Since(standby.seen) > asyncStandbyTimeout,
+				Seen:   standby.seen,
+				Offset: standby.offset,
+			}
+			replica.Id = peers[standby.addr].Id
+			replicas = append(replicas, replica)
+		}
+		return replicas
+	}
+	if self := s.selfAddr(r); self != primary && (s.raft != nil || s.async != nil) {
+		replicas = append(replicas, sentinelNode{Addr: self, Id: s.sentinelId(), Offset: s.replOffset()})
+	}
+	for _, node := range config.Current().Nodes {
+		addr := net.JoinHostPort(node["server_host"], node["server_port"])
+		if peer, ok := peers[addr]; ok && addr != primary {
+			replicas = append(replicas, peer)
+		}
+	}
+	return replicas
+}
+
+// sentinelMaster checks the master name, nil when it is known
+func sentinelMaster(name []byte) Reply {
+	if string(name) != config.Current().SentinelMasterName {
+		return NewErrorReply(ErrPrefixErr, "No such master with that name")
+	}
+	return nil
+}
+
+func sinceMilli(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(int64(time.Since(t)/time.Millisecond), 10)
+}
+
+// fieldsReply is a map of string fields, the way sentinel reports an instance
+func fieldsReply(fields ...string) *MapReply {
+	reply := NewMapReply()
+	for i := 0; i+1 < len(fields); i += 2 {
+		reply.Add(fields[i], &BulkReply{value: []byte(fields[i+1])})
+	}
+	return reply
+}
+
+func (s *Server) sentinelMasterReply(r *Request) Reply {
+	primary := s.sentinelPrimary(r)
+	host, port, _ := net.SplitHostPort(primary.Addr)
+	flags := "master"
+	if primary.Down {
+		flags = "master,s_down"
+	}
+	return fieldsReply(
+		"name", config.Current().SentinelMasterName,
+		"ip", host,
+		"port", port,
+		"runid", primary.Id,
+		"flags", flags,
+		"last-ok-ping-reply", sinceMilli(primary.Seen),
+		"down-after-milliseconds", strconv.Itoa(sentinelDownAfter),
+		"role-reported", "master",
+		"num-slaves", strconv.Itoa(len(s.sentinelReplicas(r, primary.Addr))),
+		"num-other-sentinels", strconv.Itoa(len(s.sentinelPeers())),
+		"quorum", "1",
+	)
+}
+
+func (s *Server) sentinelReplicasReply(r *Request) Reply {
+	primary := s.sentinelPrimary(r)
+	masterHost, masterPort, _ := net.SplitHostPort(primary.Addr)
+	replies := make([]Reply, 0)
+	for _, replica := range s.sentinelReplicas(r, primary.Addr) {
+		host, port, _ := net.SplitHostPort(replica.Addr)
+		flags, link := "slave", "ok"
+		if replica.Down {
+			flags, link = "slave,s_down", "err"
+		}
+		replies = append(replies, fieldsReply(
+			"name", replica.Addr,
+			"ip", host,
+			"port", port,
+			"runid", replica.Id,
+			"flags", flags,
+			"last-ok-ping-reply", sinceMilli(replica.Seen),
+			"down-after-milliseconds", strconv.Itoa(sentinelDownAfter),
+			"role-reported", "slave",
+			"master-link-status", link,
+			"master-host", masterHost,
+			"master-port", masterPort,
+			"slave-priority", "100",
+			"slave-repl-offset", strconv.FormatInt(replica.Offset, 10),
+		))
+	}
+	return &ArrayReply{values: replies}
+}
+
+func (s *Server) sentinelSentinelsReply() Reply {
+	replies := make([]Reply, 0)
+	for _, peer := range s.sentinelPeers() {
+		host, port, _ := net.SplitHostPort(peer.Addr)
+		flags := "sentinel"
+		if peer.Down {
+			flags = "sentinel,s_down"
+		}
+		replies = append(replies, fieldsReply(
+			"name", peer.Id,
+			"ip", host,
+			"port", port,
+			"runid", peer.Id,
+			"flags", flags,
+			"last-ok-ping-reply", sinceMilli(peer.Seen),
+			"down-after-milliseconds", strconv.Itoa(sentinelDownAfter),
+		))
+	}
+	return &ArrayReply{values: replies}
+}
+
+// redis command(sentinel get-master-addr-by-name|master|masters|replicas|
+// slaves|sentinels|myid)
+func (s *Server) handleSentinel(r *Request) Reply {
+	if s.slots != nil {
+		return NewErrorReply(ErrPrefixErr, "SENTINEL is not available with cluster_enabled, use CLUSTER SLOTS")
+	}
+	sub := strings.ToUpper(string(r.Arguments[0]))
+	switch sub {
+	case "MYID":
+		return &BulkReply{value: []byte(s.sentinelId())}
+	case "MASTERS":
+		return &ArrayReply{values: []Reply{s.sentinelMasterReply(r)}}
+	case "GET-MASTER-ADDR-BY-NAME", "MASTER", "REPLICAS", "SLAVES", "SENTINELS":
+	default:
+		return NewErrorReply(ErrPrefixErr, "unknown subcommand '%s'. Try SENTINEL HELP.", r.Arguments[0])
+	}
+	if len(r.Arguments) != 2 {
+		return NewErrorReply(ErrPrefixErr, "wrong number of arguments for 'sentinel|%s' command", strings.ToLower(sub))
+	}
+	name := r.Arguments[1]
+	if sub == "GET-MASTER-ADDR-BY-NAME" {
+		if string(name) != config.Current().SentinelMasterName {
+			return &NullReply{}
+		}
+		host, port, err := net.SplitHostPort(s.sentinelPrimary(r).Addr)
+		if err != nil {
+			return &NullReply{}
+		}
+		return &ArrayReply{values: []Reply{
+			&BulkReply{value: []byte(host)},
+			&BulkReply{value: []byte(port)},
+		}}
+	}
+	if reply := sentinelMaster(name); reply != nil {
+		return reply
+	}
+	switch sub {
+	case "MASTER":
+		return s.sentinelMasterReply(r)
+	case "REPLICAS", "SLAVES":
+		return s.sentinelReplicasReply(r)
+	}
+	return s.sentinelSentinelsReply()
+}
+
+// redis command(role)
+func (s *Server) handleRole(r *Request) Reply {
+	if s.role() == "master" {
+		replicas := make([]Reply, 0)
+		if s.slots == nil {
+			for _, replica := range s.sentinelReplicas(r, s.selfAddr(r)) {
+				if replica.Down {
+					continue
+				}
+				host, port, _ := net.SplitHostPort(replica.Addr)
+				replicas = append(replicas, &ArrayReply{values: []Reply{
+					&BulkReply{value: []byte(host)},
+					&BulkReply{value: []byte(port)},
+					&BulkReply{value: []byte(strconv.FormatInt(replica.Offset, 10))},
+				}})
+			}
+		}
+		return &ArrayReply{values: []Reply{
+			&BulkReply{value: []byte("master")},
+			&IntReply{number: s.replOffset()},
+			&ArrayReply{values: replicas},
+		}}
+	}
+	owner, _, confirmed := s.owner()
+	host, port, _ := net.SplitHostPort(owner)
+	state := "connect"
+	if confirmed {
+		state = "connected"
+	}
+	portNumber, _ := strconv.ParseInt(port, 10, 64)
+	return &ArrayReply{values: []Reply{
+		&BulkReply{value: []byte("slave")},
+		&BulkReply{value: []byte(host)},
+		&IntReply{number: portNumber},
+		&BulkReply{value: []byte(state)},
+		&IntReply{number: s.replOffset()},
+	}}
+}
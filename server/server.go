@@ -1,82 +1,236 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
+	"Didgen/cluster"
+	"Didgen/config"
 	"Didgen/db"
 	log "Didgen/logger_seelog"
+	"Didgen/model"
 	"time"
 )
 
+const (
+	Version = "0.2.0"
+	// RedisVersion is reported to clients which check the server version
+	RedisVersion = "7.0.0"
+)
+
 type Server struct {
-	listener        *net.TCPListener
+	listeners       []*Listener
+	listenersWait   sync.WaitGroup
 	keyGeneratorMap map[string]*db.IdGenerator
+	keySpecs        map[string]*model.KeySpec // the keys section of the config
 	sync.RWMutex
-	running bool
+	running   int32
+	startTime time.Time
+	connWait  sync.WaitGroup
+
+	clients      map[int64]*Client
+	nextClientId int64
+	clientsLock  sync.Mutex
+
+	stats  ServerStats
+	acl    *ACL
+	limits atomic.Value // *Limits
+	reload reloadState
+	// one of Reload, CONFIG SET, ROLLBACK and REWRITE at a time
+	configLock sync.Mutex
+
+	tlsFiles  *TLSFiles
+	tlsConfig *tls.Config
+
+	// membership of the nodes, nil without other nodes
+	cluster *cluster.Cluster
+	// the raft log of replication raft, set before Serve accepts clients
+	raft *replication
+	// the primary or standby of replication async
+	async *asyncReplication
+	// the owners of the slots with cluster_enabled
+	slots *slotMap
+
+	// set when started by the restart of an older process, see Handoff
+	handoff  net.Conn
+	loading  int32
+	released chan struct{}
 }
 
+// NewServer listens on host:port, unless port is 0, and on the unix socket of
+// the config when one is set. A restarted server takes over the listeners of
+// the old process instead, a socket activated one the sockets of systemd
 func NewServer(host, port string) (*Server, error) {
 	var err error
 	s := new(Server)
-	tcpaddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%s", host, port))
-	if err != nil {
-		return nil, err
+	if config.Current().TLSCertFile != "" || config.Current().TLSKeyFile != "" {
+		s.tlsFiles, err = NewTLSFiles(config.Current().TLSCertFile, config.Current().TLSKeyFile, config.Current().TLSCACertFile, config.Current().TLSAuthClients)
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfig = s.tlsFiles.Config()
+		log.Info(fmt.Sprintf("NewServer TLS enabled, auth clients: %s", config.Current().TLSAuthClients))
 	}
-	listener, err := net.ListenTCP("tcp", tcpaddr)
+	s.listeners, s.handoff, err = inheritedListeners()
 	if err != nil {
 		return nil, err
 	}
-	s.listener = listener
+	if s.handoff != nil {
+		for _, l := range s.listeners {
+			if l.Network == "tcp" {
+				l.tlsConfig = s.tlsConfig
+			}
+			log.Info(fmt.Sprintf("NewServer inherited %s listener %s", l.Network, l.Address))
+		}
+		s.loading = 1
+		s.released = make(chan struct{})
+	} else {
+		s.listeners, err = systemdListeners(s.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	inherited := len(s.listeners) > 0
+	if port != "0" && !inherited {
+		listener, err := ListenTCP(host, port)
+		if err != nil {
+			return nil, err
+		}
+		listener.tlsConfig = s.tlsConfig
+		s.listeners = append(s.listeners, listener)
+		log.Info(fmt.Sprintf("NewServer(%s:%s)", host, port))
+	}
+	if config.Current().UnixSocket != "" && !inherited {
+		listener, err := ListenUnix(config.Current().UnixSocket, os.FileMode(config.Current().UnixSocketPerm))
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, listener)
+		log.Info(fmt.Sprintf("NewServer unix socket: %s, perm: %o", config.Current().UnixSocket, config.Current().UnixSocketPerm))
+	}
+	if len(s.listeners) == 0 {
+		return nil, fmt.Errorf("no listener, server_port is 0 and unix_socket is not set")
+	}
 	s.keyGeneratorMap = make(map[string]*db.IdGenerator)
-	log.Info(fmt.Sprintf("NewServer(%s:%s)", host, port))
+	s.acl = NewACL(nil, nil)
+	s.SetLimits(LimitsFromConfig(config.Current()))
+	s.clients = make(map[int64]*Client)
+	s.startTime = time.Now()
 	return s, nil
 }
 
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
 func (s *Server) Init() error {
 	var err error
-	err = db.DATA.CreateKeysRecordTable(false)
+	dbUsers, err := db.CONFIG.GetUsers()
 	if err != nil {
 		return err
 	}
+	s.acl = NewACL(config.Current().Users, dbUsers)
+	if s.acl.Enabled() {
+		log.Info(fmt.Sprintf("Server ACL enabled with %d users", len(s.acl.Users())))
+	}
+
+	if config.Current().ClusterEnabled == "yes" {
+		if s.slots, err = newSlotMap(config.Current()); err != nil {
+			return err
+		}
+	}
+	if s.replicated() {
+		if _, _, _, err = raftPeers(config.Current()); err != nil {
+			return err
+		}
+	}
+	if s.handoff != nil {
+		// data.db is still the old process's, the tables are prepared once
+		// it released it
+		return s.loadKeys()
+	}
+	return s.prepareData()
+}
+
+// loadKeys makes a generator for each key of __idgen__ this node serves, it
+// only reads data.db
+func (s *Server) loadKeys() error {
 	keys, err := db.DATA.GetKeysFromRecordTable()
+	if err != nil {
+		return err
+	}
 	for _, key := range keys {
-		idgen, ok := s.keyGeneratorMap[key]
-		if !ok {
-			err = db.DATA.CreateKeyTable(key)
-			if err != nil {
-				return err
-			}
-			idgen, err = db.NewIdGenerator(key)
+		if !s.servesKey(key) {
+			// left by a hand over which did not finish, sent again later
+			continue
+		}
+		s.Lock()
+		if _, ok := s.keyGeneratorMap[key]; !ok {
+			idgen, err := db.NewIdGenerator(key)
 			if err != nil {
+				s.Unlock()
 				return err
 			}
 			s.keyGeneratorMap[key] = idgen
 		}
+		s.Unlock()
 	}
 	return nil
 }
 
+// prepareData creates the tables of data.db and provisions the keys section,
+// on a restart only after the old process released data.db
+func (s *Server) prepareData() error {
+	if err := db.DATA.CreateKeysRecordTable(false); err != nil {
+		return err
+	}
+	if err := s.loadKeys(); err != nil {
+		return err
+	}
+	s.RLock()
+	keys := make([]string, 0, len(s.keyGeneratorMap))
+	for key := range s.keyGeneratorMap {
+		keys = append(keys, key)
+	}
+	s.RUnlock()
+	for _, key := range keys {
+		if err := db.DATA.CreateKeyTable(key); err != nil {
+			return err
+		}
+	}
+	return s.provisionKeys()
+}
+
 func (s *Server) Serve() error {
-	s.running = true
-	for s.running {
-		s.listener.SetDeadline(time.Now().Add(1 * time.Second))
-		conn, err := s.listener.Accept()
-		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && !opErr.Timeout() {
-				log.Error(fmt.Sprintf("Server Run error: %v", err))
-			}
-			continue
+	atomic.StoreInt32(&s.running, 1)
+	go s.statsCron()
+	if s.handoff == nil {
+		// on a restart the raft log is written once data.db is released
+		if err := s.startCluster(); err != nil {
+			log.Error(fmt.Sprintf("Server cluster start error: %v", err))
 		}
-		go s.onConn(conn)
 	}
-	s.listener.Close()
+	for _, l := range s.listeners {
+		s.listenersWait.Add(1)
+		go s.acceptLoop(l)
+	}
+	s.startHandoff()
+	s.listenersWait.Wait()
 	return nil
 }
 
 func (s *Server) onConn(conn net.Conn) error {
+	client := s.newClient(conn)
+	atomic.AddInt64(&s.stats.TotalConnections, 1)
+	defer s.connWait.Done()
 	defer func() {
 		clientAddr := conn.RemoteAddr().String()
 		r := recover()
@@ -85,53 +239,126 @@ func (s *Server) onConn(conn net.Conn) error {
 			buf := make([]byte, size)
 			buf = buf[:runtime.Stack(buf, false)] //获得当前goroutine的stacktrace
 			log.Error(fmt.Sprintf("Server onConn remoteAddr[%v], stack[%v], error: %v", clientAddr, string(buf), err))
-			reply := &ErrorReply{
+			client.WriteReply(&ErrorReply{
 				message: err.Error(),
-			}
-			reply.WriteTo(conn)
+			})
 		}
+		s.removeClient(client)
 		conn.Close()
 	}()
 
+	limits := s.Limits()
+	if limits.MaxClients > 0 && s.ClientsCount() > limits.MaxClients {
+		atomic.AddInt64(&s.stats.RejectedConnections, 1)
+		log.Warn(fmt.Sprintf("Server onConn remoteAddr[%v], max number of clients reached", client.Addr))
+		client.WriteReply(NewErrorReply(ErrPrefixErr, "max number of clients reached"))
+		return nil
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.handshakeTLS(tlsConn, client); err != nil {
+			log.Warn(fmt.Sprintf("Server TLS handshake with %s error: %v", client.Addr, err))
+			return err
+		}
+	}
+
 	for {
-		request, err := NewRequest(conn)
+		limits = s.Limits()
+		if limits.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(limits.IdleTimeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		// Shutdown wakes idle connections with a past deadline, which the
+		// line above may have just replaced
+		if !s.IsRunning() {
+			return nil
+		}
+		request, err := NewRequest(client.reader, conn, &limits.Request)
 		if err != nil {
+			if !s.IsRunning() {
+				return nil
+			}
+			if protoErr, ok := err.(*ProtocolError); ok {
+				atomic.AddInt64(&s.stats.ProtocolErrors, 1)
+				if protoErr.Limit {
+					atomic.AddInt64(&s.stats.LimitViolations, 1)
+				}
+				log.Debug(fmt.Sprintf("Server onConn remoteAddr[%v], %v", client.Addr, protoErr))
+				client.WriteReply(protoErr)
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				atomic.AddInt64(&s.stats.TimedoutConnections, 1)
+				log.Debug(fmt.Sprintf("Server onConn remoteAddr[%v], connection timed out", client.Addr))
+			}
 			return err
 		}
+		request.Client = client
+		request.RemoteAddress = client.Addr
+		atomic.StoreInt32(&client.inRequest, 1)
 
 		reply := s.ServeRequest(request)
-		if _, err := reply.WriteTo(conn); err != nil {
-			log.Error(fmt.Sprint("server onConn reply write error: %v", err))
+		if err := client.WriteReply(reply); err != nil {
+			log.Error(fmt.Sprintf("server onConn reply write error: %v", err))
 			return err
 		}
+		atomic.StoreInt32(&client.inRequest, 0)
+		if client.closing || !s.IsRunning() {
+			return nil
+		}
 	}
-	return nil
 }
 
 func (s *Server) ServeRequest(request *Request) Reply {
-	switch request.Command {
-	case "GET":
-		return s.handleGet(request)
-	case "SET":
-		return s.handleSet(request)
-	case "EXISTS":
-		return s.handleExists(request)
-	case "DEL":
-		return s.handleDel(request)
-	case "SELECT":
-		return s.handleSelect(request)
-	default:
-		return ErrMethodNotSupported
+	cmd, ok := lookupCommand(request.Command)
+	if !ok {
+		atomic.AddInt64(&s.stats.ErrorReplies, 1)
+		return ErrUnknownCommand(request)
+	}
+	if request.Client != nil {
+		request.Client.touch(request.Command)
+	}
+	if !cmd.checkArity(request) {
+		atomic.AddInt64(&s.stats.ErrorReplies, 1)
+		return ErrWrongArgs(request.Command)
+	}
+	if errReply := s.checkAccess(cmd, request); errReply != nil {
+		atomic.AddInt64(&s.stats.ErrorReplies, 1)
+		return errReply
+	}
+	request.allowed = true
+	if cmd.hasCategory("@write") && !s.waitReleased() {
+		atomic.AddInt64(&s.stats.ErrorReplies, 1)
+		return NewErrorReply(ErrPrefixLoading, "Didgen is waiting for the old process to release data.db")
 	}
 
-	return nil
+	if s.slots != nil && cmd.FirstKey > 0 {
+		s.slots.pause.RLock()
+		defer s.slots.pause.RUnlock()
+	}
+
+	start := time.Now()
+	reply := cmd.Handler(s, request)
+	atomic.AddInt64(&s.stats.TotalCommands, 1)
+	atomic.AddInt64(&cmd.stats.calls, 1)
+	atomic.AddInt64(&cmd.stats.usec, int64(time.Since(start)/time.Microsecond))
+	if _, ok := reply.(*ErrorReply); ok {
+		atomic.AddInt64(&s.stats.ErrorReplies, 1)
+		atomic.AddInt64(&cmd.stats.failedCalls, 1)
+	}
+	return reply
 }
 
+// Close stops accepting connections at once, see Shutdown for draining
 func (s *Server) Close() {
-	s.running = false
+	atomic.StoreInt32(&s.running, 0)
+	s.closeListeners()
 	log.Info("Server closed")
 }
 
+func (s *Server) IsRunning() bool {
+	return atomic.LoadInt32(&s.running) == 1
+}
+
 func (s *Server) IsKeyExist(key string) (bool, error) {
 	_, err := db.DATA.GetKeyFromRecordTable(key)
 	if err != nil {
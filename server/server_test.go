@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"Didgen/config"
+	"Didgen/db"
+	"Didgen/model"
+)
+
+// newTestServer runs a server on data.db and configuration.db of its own,
+// listening on a unix socket only, setup changes the config first
+func newTestServer(t *testing.T, setup func(c *model.ServerConfig)) *Server {
+	t.Helper()
+	cfg, _, err := config.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg.DataPath = dir
+	cfg.ServerHost = "127.0.0.1"
+	cfg.ServerPort = "0"
+	cfg.UnixSocket = filepath.Join(dir, "didgen.sock")
+	if setup != nil {
+		setup(cfg)
+	}
+	saved, savedHighWater := config.Current(), db.HIGHWATER
+	config.Store(cfg)
+	db.InitConfig()
+	db.InitData()
+	s, err := NewServer(cfg.ServerHost, cfg.ServerPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&s.running, 1)
+	t.Cleanup(func() {
+		s.Close()
+		s.closeCluster()
+		s.connWait.Wait()
+		db.Close()
+		db.DATA, db.CONFIG = nil, nil
+		config.Store(saved)
+		db.HIGHWATER = savedHighWater
+	})
+	return s
+}
+
+// testConn is a client connection served by onConn over a pipe
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (s *Server) testConn(t *testing.T) *testConn {
+	client, server := net.Pipe()
+	s.connWait.Add(1)
+	go s.onConn(server)
+	t.Cleanup(func() { client.Close() })
+	return &testConn{t: t, conn: client, reader: bufio.NewReader(client)}
+}
+
+// do sends a command and returns the bytes of the whole reply
+func (c *testConn) do(args ...string) string {
+	c.t.Helper()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		c.t.Fatalf("%v: write error: %v", args, err)
+	}
+	reply, err := readReply(c.reader)
+	if err != nil {
+		c.t.Fatalf("%v: read error: %v", args, err)
+	}
+	return reply
+}
+
+// readReply reads one RESP2 or RESP3 reply as it is on the wire
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("bad line %q", line)
+	}
+	elements := 0
+	switch line[0] {
+	case '$', '=', '!':
+		n, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil || n < 0 {
+			return line, err
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return line + string(data), nil
+	case '*', '~', '>':
+		elements, err = strconv.Atoi(line[1 : len(line)-2])
+	case '%':
+		elements, err = strconv.Atoi(line[1 : len(line)-2])
+		elements *= 2
+	case '|':
+		elements, err = strconv.Atoi(line[1 : len(line)-2])
+		elements = elements*2 + 1
+	default:
+		return line, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	reply := line
+	for i := 0; i < elements; i++ {
+		element, err := readReply(r)
+		if err != nil {
+			return "", err
+		}
+		reply += element
+	}
+	return reply, nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"Didgen/config"
+	"Didgen/db"
+)
+
+// With shared_storage several instances issue ids from one data.db, each
+// refill takes its batch by a compare and swap, so the batches of the
+// instances never overlap. A key created or deleted by another instance is
+// noticed by the next GET of it here.
+
+func (s *Server) sharedStorage() bool {
+	return config.Current().SharedStorage == "yes"
+}
+
+// sharedKey returns the generator of a key another instance created, nil
+// when data.db has no such key
+func (s *Server) sharedKey(key string) *db.IdGenerator {
+	if !s.sharedStorage() {
+		return nil
+	}
+	exists, err := db.DATA.HasKey(key)
+	if err != nil || !exists {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	idgen, ok := s.keyGeneratorMap[key]
+	if !ok {
+		if idgen, err = db.NewIdGenerator(key); err != nil {
+			return nil
+		}
+		idgen.SetSpec(s.keySpecs[key])
+		s.keyGeneratorMap[key] = idgen
+	}
+	return idgen
+}
+
+// sharedKeyDeleted drops the generator of a key another instance deleted,
+// true when it did
+func (s *Server) sharedKeyDeleted(key string, idgen *db.IdGenerator) bool {
+	if !s.sharedStorage() {
+		return false
+	}
+	if exists, err := db.DATA.HasKey(key); err != nil || exists {
+		return false
+	}
+	s.Lock()
+	if s.keyGeneratorMap[key] == idgen {
+		delete(s.keyGeneratorMap, key)
+	}
+	s.Unlock()
+	return true
+}
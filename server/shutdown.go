@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "Didgen/logger_seelog"
+)
+
+// Shutdown stops accepting connections, closes idle connections, lets the
+// requests in flight finish until ctx is done, then closes whatever is left
+// and hands the unused ids of every generator back to data.db
+func (s *Server) Shutdown(ctx context.Context) error {
+	start := time.Now()
+	atomic.StoreInt32(&s.running, 0)
+	s.closeListeners()
+	log.Info(fmt.Sprintf("Server shutdown, stop accepting, %d connections to drain", s.ClientsCount()))
+
+	s.wakeIdleClients()
+	done := make(chan struct{})
+	go func() {
+		s.connWait.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+		log.Info(fmt.Sprintf("Server shutdown, connections drained in %v", time.Since(start)))
+	case <-ctx.Done():
+		err = ctx.Err()
+		clients := s.Clients()
+		log.Warn(fmt.Sprintf("Server shutdown, %v, closing %d connections", err, len(clients)))
+		for _, c := range clients {
+			c.conn.Close()
+		}
+	}
+
+	s.closeCluster()
+	s.flushGenerators()
+	return err
+}
+
+// wakeIdleClients interrupts the connections waiting for a request, the
+// ones serving a request notice the shutdown after their reply
+func (s *Server) wakeIdleClients() {
+	for _, c := range s.Clients() {
+		if atomic.LoadInt32(&c.inRequest) == 0 {
+			c.conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+func (s *Server) flushGenerators() {
+	s.Lock()
+	defer s.Unlock()
+	for key, idgen := range s.keyGeneratorMap {
+		if err := idgen.Close(); err != nil {
+			log.Error(fmt.Sprintf("Server shutdown, flush '%s' error: %v", key, err))
+		}
+	}
+	log.Info(fmt.Sprintf("Server shutdown, %d generators flushed", len(s.keyGeneratorMap)))
+}
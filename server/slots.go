@@ -0,0 +1,697 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"Didgen/cluster"
+	"Didgen/config"
+	"Didgen/db"
+	log "Didgen/logger_seelog"
+	"Didgen/model"
+)
+
+// With cluster_enabled the keys are spread over the nodes the way redis
+// cluster spreads them: the slot of a key is the crc16 of its name, or of
+// its hash tag, modulo 16384 and every slot belongs to one node, the only one
+// serving its keys. The others answer MOVED with the slot and the owner, so
+// cluster clients route by themselves after CLUSTER SLOTS. CLUSTER MIGRATE
+// moves slots to another node: the owner stops serving them, gives the
+// batches back and hands the high-water mark of every key over, the new owner
+// only ever moves a key forward. The moves are kept in data.db with an epoch
+// and exchanged on trans_port, a node which missed one learns it from the
+// others, and keys left behind by a failed hand over are sent again.
+
+const (
+	MessageSlots = "slots"
+	MessageKeys  = "keys"
+
+	handOverTimeout = 5 * time.Second
+)
+
+type slotNode struct {
+	Addr  string // host:server_port, the node in the slot map
+	Host  string
+	Port  string
+	Trans string // host:trans_port
+}
+
+type slotMap struct {
+	self  string
+	nodes []slotNode
+	slots *cluster.Slots
+
+	// requests on keys hold it shared, moving slots away holds it alone
+	pause sync.RWMutex
+	// one migration or hand over at a time
+	migrate sync.Mutex
+	done    chan struct{}
+	wait    sync.WaitGroup
+	lock    sync.RWMutex
+}
+
+type slotsMessage struct {
+	Moved []cluster.SlotOwner `json:"moved"`
+}
+
+type keysMessage struct {
+	Moved []cluster.SlotOwner `json:"moved"`
+	Keys  map[string]int64    `json:"keys"` // the high-water marks
+}
+
+// newSlotMap assigns the slots to nodes, the entry of this node included,
+// then applies the moves kept in data.db
+func newSlotMap(cfg *model.ServerConfig) (*slotMap, error) {
+	m := &slotMap{done: make(chan struct{})}
+	addrs := make([]string, 0, len(cfg.Nodes))
+	specs := make(map[string][]cluster.SlotRange)
+	for _, node := range cfg.Nodes {
+		n := slotNode{
+			Addr:  net.JoinHostPort(node["server_host"], node["server_port"]),
+			Host:  node["server_host"],
+			Port:  node["server_port"],
+			Trans: net.JoinHostPort(node["server_host"], node["trans_port"]),
+		}
+		if node["trans_port"] == cfg.TransPort && node["server_port"] == cfg.ServerPort && isLocalHost(node["server_host"], cfg.ServerHost) {
+			m.self = n.Addr
+		}
+		ranges, err := cluster.ParseSlots(node["slots"])
+		if err != nil {
+			return nil, fmt.Errorf("nodes %s slots %v", n.Addr, err)
+		}
+		m.nodes = append(m.nodes, n)
+		addrs = append(addrs, n.Addr)
+		specs[n.Addr] = ranges
+	}
+	if m.self == "" {
+		return nil, fmt.Errorf("cluster_enabled: nodes does not list this node, server_port %s trans_port %s", cfg.ServerPort, cfg.TransPort)
+	}
+	slots, err := cluster.NewSlots(addrs, specs)
+	if err != nil {
+		return nil, err
+	}
+	moved, err := db.DATA.MovedSlots()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range moved {
+		slots.Assign(o)
+	}
+	m.slots = slots
+	return m, nil
+}
+
+func (m *slotMap) owner(slot int) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.slots.Owner(slot)
+}
+
+func (m *slotMap) owns(key string) bool {
+	return m.owner(cluster.KeySlot([]byte(key))) == m.self
+}
+
+func (m *slotMap) node(addr string) (slotNode, bool) {
+	for _, n := range m.nodes {
+		if n.Addr == addr {
+			return n, true
+		}
+	}
+	return slotNode{}, false
+}
+
+func (m *slotMap) moved() []cluster.SlotOwner {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.slots.Moved()
+}
+
+func (m *slotMap) ranges(addr string) []cluster.SlotRange {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.slots.Ranges(addr)
+}
+
+func (m *slotMap) epoch() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.slots.Epoch()
+}
+
+// servesKey is false for a key of a slot of another node
+func (s *Server) servesKey(key string) bool {
+	return s.slots == nil || s.slots.owns(key)
+}
+
+func (s *Server) startSlots() {
+	m := s.slots
+	s.cluster.Transport().Handle(MessageSlots, s.handleSlots)
+	s.cluster.Transport().Handle(MessageKeys, s.handleKeys)
+	m.wait.Add(1)
+	go s.slotsLoop()
+	log.Info(fmt.Sprintf("Server cluster slots %s served here, epoch %d", cluster.FormatSlots(m.ranges(m.self)), m.epoch()))
+}
+
+func (m *slotMap) stop() {
+	close(m.done)
+	m.wait.Wait()
+}
+
+// requestKeys are the keys of a request, by the key positions of its command
+func requestKeys(r *Request) [][]byte {
+	cmd, ok := lookupCommand(r.Command)
+	if !ok || cmd.FirstKey <= 0 {
+		return nil
+	}
+	last, step := cmd.LastKey, cmd.Step
+	if last < 0 {
+		last += len(r.Arguments) + 1
+	}
+	if step <= 0 {
+		step = 1
+	}
+	keys := make([][]byte, 0, 1)
+	for i := cmd.FirstKey; i <= last && i <= len(r.Arguments); i += step {
+		keys = append(keys, r.Arguments[i-1])
+	}
+	return keys
+}
+
+// requestSlot is the slot of the keys of a request, 0 without keys
+func requestSlot(r *Request) int {
+	keys := requestKeys(r)
+	if len(keys) == 0 {
+		return 0
+	}
+	return cluster.KeySlot(keys[0])
+}
+
+// slotRedirect sends a request on the keys of a slot of another node to that
+// node, nil when the slot is served here
+func (s *Server) slotRedirect(r *Request) Reply {
+	if s.slots == nil {
+		return nil
+	}
+	keys := requestKeys(r)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return NewErrorReply(ErrPrefixCrossSlot, "Keys in request don't hash to the same slot")
+		}
+	}
+	owner := s.slots.owner(slot)
+	if owner == s.slots.self {
+		return nil
+	}
+	node, _ := s.slots.node(owner)
+	return s.redirectTo(r, ErrPrefixMoved, slot, owner, node.Trans)
+}
+
+// mergeSlots applies the moves another node knows of, true when a slot of
+// this node moved away
+func (s *Server) mergeSlots(moved []cluster.SlotOwner) bool {
+	m := s.slots
+	lost := false
+	accepted := make([]cluster.SlotOwner, 0)
+	changed := make(map[string][]cluster.SlotRange)
+	m.lock.Lock()
+	for _, o := range moved {
+		was := m.slots.Owner(o.Slot)
+		if !m.slots.Assign(o) {
+			continue
+		}
+		accepted = append(accepted, o)
+		if was == m.self && o.Node != m.self {
+			lost = true
+		}
+		if was != o.Node {
+			ranges := changed[o.Node]
+			if n := len(ranges); n > 0 && ranges[n-1].End == o.Slot-1 {
+				ranges[n-1].End = o.Slot
+			} else {
+				changed[o.Node] = append(ranges, cluster.SlotRange{Start: o.Slot, End: o.Slot})
+			}
+		}
+	}
+	m.lock.Unlock()
+	for node, ranges := range changed {
+		log.Info(fmt.Sprintf("Server cluster slots %s moved to %s", cluster.FormatSlots(ranges), node))
+	}
+	if len(accepted) > 0 {
+		if err := db.DATA.SaveSlots(accepted); err != nil {
+			log.Error(fmt.Sprintf("Server cluster save slots error: %v", err))
+		}
+	}
+	return lost
+}
+
+// dropForeignKeys stops the generators of the keys of slots served by other
+// nodes, their batches are given back so data.db has their last id. The
+// caller holds pause, no request is using them.
+func (s *Server) dropForeignKeys() int {
+	dropped := make([]*db.IdGenerator, 0)
+	s.Lock()
+	for key, idgen := range s.keyGeneratorMap {
+		if !s.slots.owns(key) {
+			delete(s.keyGeneratorMap, key)
+			dropped = append(dropped, idgen)
+		}
+	}
+	s.Unlock()
+	for _, idgen := range dropped {
+		if err := idgen.Close(); err != nil {
+			log.Error(fmt.Sprintf("Server cluster close generator error: %v", err))
+		}
+	}
+	return len(dropped)
+}
+
+func (s *Server) releaseSlots() {
+	s.slots.migrate.Lock()
+	defer s.slots.migrate.Unlock()
+	s.slots.pause.Lock()
+	defer s.slots.pause.Unlock()
+	if n := s.dropForeignKeys(); n > 0 {
+		log.Info(fmt.Sprintf("Server cluster %d keys of moved slots stopped", n))
+	}
+}
+
+// migrateSlots moves slots of this node to another one, their keys are
+// handed over at once, or later when the other node cannot be reached
+func (s *Server) migrateSlots(ranges []cluster.SlotRange, target string) (int, int, error) {
+	m := s.slots
+	if _, ok := m.node(target); !ok || target == m.self {
+		return 0, 0, fmt.Errorf("%s is not another node of nodes", target)
+	}
+	m.migrate.Lock()
+	defer m.migrate.Unlock()
+	// requests on keys wait until the keys are with the other node, then
+	// they get MOVED
+	m.pause.Lock()
+	defer m.pause.Unlock()
+
+	m.lock.RLock()
+	epoch := m.slots.Epoch() + 1
+	moved := make([]cluster.SlotOwner, 0)
+	for _, r := range ranges {
+		for slot := r.Start; slot <= r.End; slot++ {
+			if owner := m.slots.Owner(slot); owner != m.self {
+				m.lock.RUnlock()
+				return 0, 0, fmt.Errorf("slot %d is served by %s", slot, owner)
+			}
+			moved = append(moved, cluster.SlotOwner{Slot: slot, Node: target, Epoch: epoch})
+		}
+	}
+	m.lock.RUnlock()
+	// kept first, after a crash this node must not serve them again
+	if err := db.DATA.SaveSlots(moved); err != nil {
+		return 0, 0, err
+	}
+	m.lock.Lock()
+	for _, o := range moved {
+		m.slots.Assign(o)
+	}
+	m.lock.Unlock()
+	s.dropForeignKeys()
+	log.Info(fmt.Sprintf("Server cluster slots %s moved to %s, epoch %d", cluster.FormatSlots(ranges), target, epoch))
+
+	keys, err := s.handOver()
+	return len(moved), keys, err
+}
+
+// handOver sends the keys data.db still has in slots of other nodes to them
+// and deletes them here once taken. The caller holds migrate.
+func (s *Server) handOver() (int, error) {
+	m := s.slots
+	keys, err := db.DATA.GetKeysFromRecordTable()
+	if err != nil {
+		return 0, err
+	}
+	foreign := make(map[string][]string)
+	s.RLock()
+	for _, key := range keys {
+		if _, ok := s.keyGeneratorMap[key]; ok {
+			continue
+		}
+		if owner := m.owner(cluster.KeySlot([]byte(key))); owner != m.self {
+			foreign[owner] = append(foreign[owner], key)
+		}
+	}
+	s.RUnlock()
+
+	handed := 0
+	var lastErr error
+	for owner, keys := range foreign {
+		node, ok := m.node(owner)
+		if !ok {
+			lastErr = fmt.Errorf("slots of %d keys are served by %s, not in nodes", len(keys), owner)
+			continue
+		}
+		message := keysMessage{Moved: m.moved(), Keys: make(map[string]int64)}
+		for _, key := range keys {
+			value, err := db.DATA.GetKey(key)
+			if err != nil {
+				return handed, err
+			}
+			message.Keys[key] = value
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), handOverTimeout)
+		err := s.cluster.Transport().Call(ctx, node.Trans, MessageKeys, message, nil)
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("%d keys to %s: %v", len(keys), owner, err)
+			continue
+		}
+		for _, key := range keys {
+			if err = db.DATA.DeleteKeyTable(key); err == nil {
+				err = db.DATA.DeleteKeyFromRecordTable(key)
+			}
+			if err != nil {
+				return handed, err
+			}
+		}
+		handed += len(keys)
+		log.Info(fmt.Sprintf("Server cluster %d keys handed to %s", len(keys), owner))
+	}
+	return handed, lastErr
+}
+
+func (s *Server) handleSlots(from string, payload json.RawMessage) (interface{}, error) {
+	var message slotsMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return nil, err
+	}
+	if s.mergeSlots(message.Moved) {
+		go s.releaseSlots()
+	}
+	return slotsMessage{Moved: s.slots.moved()}, nil
+}
+
+// handleKeys takes the keys of slots moved to this node, before the moves
+// so the slots are served once their keys are here
+func (s *Server) handleKeys(from string, payload json.RawMessage) (interface{}, error) {
+	var message keysMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return nil, err
+	}
+	m := s.slots
+	moves := make(map[int]cluster.SlotOwner)
+	for _, o := range message.Moved {
+		moves[o.Slot] = o
+	}
+	m.lock.RLock()
+	for key := range message.Keys {
+		slot := cluster.KeySlot([]byte(key))
+		owner := m.slots.Of(slot)
+		if o, ok := moves[slot]; ok && o.Epoch > owner.Epoch {
+			owner = o
+		}
+		if owner.Node != m.self {
+			m.lock.RUnlock()
+			return nil, fmt.Errorf("slot %d of key '%s' is served by %s", slot, key, owner.Node)
+		}
+	}
+	m.lock.RUnlock()
+	for key, value := range message.Keys {
+		if err := s.importKey(key, value); err != nil {
+			return nil, err
+		}
+	}
+	if s.mergeSlots(message.Moved) {
+		go s.releaseSlots()
+	}
+	log.Info(fmt.Sprintf("Server cluster %d keys taken from %s", len(message.Keys), from))
+	return nil, nil
+}
+
+// importKey moves a key forward to the high-water mark of its last node, a
+// key this node had before is never moved back
+func (s *Server) importKey(key string, value int64) error {
+	s.Lock()
+	idgen, ok := s.keyGeneratorMap[key]
+	if !ok {
+		var err error
+		if idgen, err = db.NewIdGenerator(key); err == nil {
+			if err = db.DATA.CreateKeyTable(key); err == nil {
+				err = s.SetKey(key)
+			}
+		}
+		if err != nil {
+			s.Unlock()
+			return err
+		}
+		idgen.SetSpec(s.keySpecs[key])
+		s.keyGeneratorMap[key] = idgen
+	}
+	s.Unlock()
+	_, err := idgen.Advance(value)
+	return err
+}
+
+// slotsLoop exchanges the moves with the other nodes every heartbeat and
+// hands over the keys left behind
+func (s *Server) slotsLoop() {
+	m := s.slots
+	defer m.wait.Done()
+	interval := time.Duration(config.Current().HeartbeatTimeInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		lost := false
+		for _, node := range m.nodes {
+			if node.Addr == m.self {
+				continue
+			}
+			var reply slotsMessage
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := s.cluster.Transport().Call(ctx, node.Trans, MessageSlots, slotsMessage{Moved: m.moved()}, &reply)
+			cancel()
+			if err != nil {
+				log.Debug(fmt.Sprintf("Server cluster slots %s error: %v", node.Addr, err))
+				continue
+			}
+			if s.mergeSlots(reply.Moved) {
+				lost = true
+			}
+		}
+		if lost {
+			s.releaseSlots()
+		}
+		m.migrate.Lock()
+		if _, err := s.handOver(); err != nil {
+			log.Debug(fmt.Sprintf("Server cluster hand over error: %v", err))
+		}
+		m.migrate.Unlock()
+	}
+}
+
+// nodeId is the id of a node in CLUSTER NODES, zeros until it answered
+func (s *Server) nodeId(addr string) (string, string) {
+	if addr == s.slots.self {
+		return s.cluster.Self().Id, "online"
+	}
+	for _, peer := range s.cluster.Peers() {
+		if net.JoinHostPort(peer.Config.Host, peer.Config.ServerPort) != addr {
+			continue
+		}
+		health := "online"
+		if peer.State == cluster.StateDead {
+			health = "fail"
+		}
+		if peer.Info.Id == "" {
+			return strings.Repeat("0", 40), health
+		}
+		return peer.Info.Id, health
+	}
+	return strings.Repeat("0", 40), "fail"
+}
+
+// redis command(cluster slots)
+func (s *Server) clusterSlots() Reply {
+	type slotRange struct {
+		cluster.SlotRange
+		node slotNode
+	}
+	all := make([]slotRange, 0)
+	for _, node := range s.slots.nodes {
+		for _, r := range s.slots.ranges(node.Addr) {
+			all = append(all, slotRange{r, node})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Start < all[j].Start })
+	values := make([]Reply, 0, len(all))
+	for _, r := range all {
+		id, _ := s.nodeId(r.node.Addr)
+		port, _ := strconv.ParseInt(r.node.Port, 10, 64)
+		values = append(values, &ArrayReply{values: []Reply{
+			&IntReply{number: int64(r.Start)},
+			&IntReply{number: int64(r.End)},
+			&ArrayReply{values: []Reply{
+				&BulkReply{value: []byte(r.node.Host)},
+				&IntReply{number: port},
+				&BulkReply{value: []byte(id)},
+			}},
+		}})
+	}
+	return &ArrayReply{values: values}
+}
+
+// redis command(cluster shards), every node is a shard of its own
+func (s *Server) clusterShards() Reply {
+	values := make([]Reply, 0, len(s.slots.nodes))
+	for _, node := range s.slots.nodes {
+		slots := make([]Reply, 0)
+		for _, r := range s.slots.ranges(node.Addr) {
+			slots = append(slots, &IntReply{number: int64(r.Start)}, &IntReply{number: int64(r.End)})
+		}
+		id, health := s.nodeId(node.Addr)
+		port, _ := strconv.ParseInt(node.Port, 10, 64)
+		nodeReply := NewMapReply().
+			Add("id", &BulkReply{value: []byte(id)}).
+			Add("port", &IntReply{number: port}).
+			Add("ip", &BulkReply{value: []byte(node.Host)}).
+			Add("endpoint", &BulkReply{value: []byte(node.Host)}).
+			Add("role", &BulkReply{value: []byte("master")}).
+			Add("replication-offset", &IntReply{number: 0}).
+			Add("health", &BulkReply{value: []byte(health)})
+		values = append(values, NewMapReply().
+			Add("slots", &ArrayReply{values: slots}).
+			Add("nodes", &ArrayReply{values: []Reply{nodeReply}}))
+	}
+	return &ArrayReply{values: values}
+}
+
+// redis command(cluster info)
+func (s *Server) clusterInfo() Reply {
+	ok, fail := 0, 0
+	owners := make(map[string]bool)
+	for _, node := range s.slots.nodes {
+		count := 0
+		for _, r := range s.slots.ranges(node.Addr) {
+			count += r.End - r.Start + 1
+		}
+		if count == 0 {
+			continue
+		}
+		owners[node.Addr] = true
+		if _, health := s.nodeId(node.Addr); health == "fail" {
+			fail += count
+		} else {
+			ok += count
+		}
+	}
+	state := "ok"
+	if fail > 0 {
+		state = "fail"
+	}
+	epoch := s.slots.epoch()
+	lines := []string{
+		infoLine("cluster_enabled", 1),
+		infoLine("cluster_state", state),
+		infoLine("cluster_slots_assigned", ok+fail),
+		infoLine("cluster_slots_ok", ok),
+		infoLine("cluster_slots_pfail", 0),
+		infoLine("cluster_slots_fail", fail),
+		infoLine("cluster_known_nodes", len(s.slots.nodes)),
+		infoLine("cluster_size", len(owners)),
+		infoLine("cluster_current_epoch", epoch),
+		infoLine("cluster_my_epoch", epoch),
+	}
+	return &VerbatimReply{
+		format: "txt",
+		value:  []byte(strings.Join(lines, "")),
+	}
+}
+
+func (s *Server) keysInSlot(slot int) []string {
+	keys := make([]string, 0)
+	s.RLock()
+	for key := range s.keyGeneratorMap {
+		if cluster.KeySlot([]byte(key)) == slot {
+			keys = append(keys, key)
+		}
+	}
+	s.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) handleClusterSlots(sub string, r *Request) Reply {
+	if s.slots == nil {
+		return NewErrorReply(ErrPrefixErr, "This instance has cluster support disabled")
+	}
+	switch sub {
+	case "SLOTS":
+		return s.clusterSlots()
+	case "SHARDS":
+		return s.clusterShards()
+	case "INFO":
+		return s.clusterInfo()
+	case "KEYSLOT":
+		return &IntReply{number: int64(cluster.KeySlot(r.Arguments[1]))}
+	case "COUNTKEYSINSLOT", "GETKEYSINSLOT":
+		slot, errReply := r.GetInt(1)
+		if errReply != nil {
+			return errReply
+		}
+		if slot < 0 || slot >= cluster.SlotCount {
+			return NewErrorReply(ErrPrefixErr, "Invalid slot")
+		}
+		keys := s.keysInSlot(int(slot))
+		if sub == "COUNTKEYSINSLOT" {
+			return &IntReply{number: int64(len(keys))}
+		}
+		count, errReply := r.GetInt(2)
+		if errReply != nil {
+			return errReply
+		}
+		if count < 0 {
+			return NewErrorReply(ErrPrefixErr, "Invalid number of keys")
+		}
+		values := make([][]byte, 0, len(keys))
+		for _, key := range keys {
+			if int64(len(values)) == count {
+				break
+			}
+			values = append(values, []byte(key))
+		}
+		return &MultiBulkReply{values: values}
+	case "MIGRATE":
+		ranges, err := cluster.ParseSlots(string(r.Arguments[1]))
+		if err != nil || len(ranges) == 0 {
+			return NewErrorReply(ErrPrefixErr, "Invalid slot range '%s'", r.Arguments[1])
+		}
+		target := string(r.Arguments[2])
+		slots, keys, err := s.migrateSlots(ranges, target)
+		if err != nil {
+			if slots == 0 {
+				return NewErrorReply(ErrPrefixErr, "%v", err)
+			}
+			return NewErrorReply(ErrPrefixErr, "%d slots moved to %s, their keys are handed over in the background: %v", slots, target, err)
+		}
+		log.Info(fmt.Sprintf("Server cluster migrate %s to %s, %d slots, %d keys", r.Arguments[1], target, slots, keys))
+		return &StatusReply{code: "OK"}
+	}
+	return nil
+}
+
+// redis command(asking), (readonly) and (readwrite) are accepted for cluster
+// clients, a slot is always served by one node only
+func (s *Server) handleAsking(r *Request) Reply {
+	return &StatusReply{code: "OK"}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsSamples        = 16
+	statsSampleInterval = 100 * time.Millisecond
+)
+
+// ServerStats are the counters reported by INFO stats
+type ServerStats struct {
+	TotalConnections    int64
+	TotalCommands       int64
+	ErrorReplies        int64
+	RejectedConnections int64 // max_clients reached
+	TimedoutConnections int64 // idle_timeout or read_timeout
+	ProtocolErrors      int64
+	LimitViolations     int64 // requests beyond max_request_args or max_bulk_length
+	Redirections        int64 // MOVED and ASK replies
+	ProxiedCommands     int64 // forwarded to the owner with redirect proxy
+	ProxyErrors         int64
+	PeakMemory          uint64 // the highest heap in use seen, see statsCron
+
+	// instantaneous ops per second, sampled like redis does
+	samples     [statsSamples]int64
+	sampleIndex int
+	lastSample  int64
+	lastTime    time.Time
+	opsPerSec   int64
+}
+
+// commandStats are per command counters reported by INFO commandstats
+type commandStats struct {
+	calls       int64
+	usec        int64
+	failedCalls int64
+}
+
+func (st *ServerStats) sample(now time.Time) {
+	commands := atomic.LoadInt64(&st.TotalCommands)
+	if !st.lastTime.IsZero() {
+		elapsed := now.Sub(st.lastTime)
+		if elapsed > 0 {
+			st.samples[st.sampleIndex] = (commands - st.lastSample) * int64(time.Second) / int64(elapsed)
+			st.sampleIndex = (st.sampleIndex + 1) % statsSamples
+		}
+	}
+	st.lastSample = commands
+	st.lastTime = now
+
+	var sum int64
+	for _, v := range st.samples {
+		sum += v
+	}
+	atomic.StoreInt64(&st.opsPerSec, sum/statsSamples)
+}
+
+func (st *ServerStats) OpsPerSec() int64 {
+	return atomic.LoadInt64(&st.opsPerSec)
+}
+
+func (st *ServerStats) Reset() {
+	atomic.StoreInt64(&st.TotalConnections, 0)
+	atomic.StoreInt64(&st.TotalCommands, 0)
+	atomic.StoreInt64(&st.ErrorReplies, 0)
+	atomic.StoreInt64(&st.RejectedConnections, 0)
+	atomic.StoreInt64(&st.TimedoutConnections, 0)
+	atomic.StoreInt64(&st.ProtocolErrors, 0)
+	atomic.StoreInt64(&st.LimitViolations, 0)
+	atomic.StoreInt64(&st.Redirections, 0)
+	atomic.StoreInt64(&st.ProxiedCommands, 0)
+	atomic.StoreInt64(&st.ProxyErrors, 0)
+	for _, cmd := range commandTable {
+		atomic.StoreInt64(&cmd.stats.calls, 0)
+		atomic.StoreInt64(&cmd.stats.usec, 0)
+		atomic.StoreInt64(&cmd.stats.failedCalls, 0)
+	}
+}
+
+func (s *Server) statsCron() {
+	ticker := time.NewTicker(statsSampleInterval)
+	defer ticker.Stop()
+	var m runtime.MemStats
+	for s.IsRunning() {
+		now := <-ticker.C
+		s.stats.sample(now)
+		runtime.ReadMemStats(&m)
+		s.stats.samplePeak(m.HeapAlloc)
+	}
+}
+
+// samplePeak raises PeakMemory to used when higher and returns the peak
+func (st *ServerStats) samplePeak(used uint64) uint64 {
+	for {
+		peak := atomic.LoadUint64(&st.PeakMemory)
+		if used <= peak {
+			return peak
+		}
+		if atomic.CompareAndSwapUint64(&st.PeakMemory, peak, used) {
+			return used
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "Didgen/logger_seelog"
+)
+
+const (
+	tlsCheckInterval    = 1 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// TLSFiles keeps the tls.Config built from the certificate files and rebuilds
+// it when one of the files changes, so certificates can be rotated in place
+type TLSFiles struct {
+	CertFile    string
+	KeyFile     string
+	CACertFile  string
+	AuthClients string // no, optional or yes
+
+	config    *tls.Config
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+	lock      sync.Mutex
+}
+
+func NewTLSFiles(certFile, keyFile, caCertFile, authClients string) (*TLSFiles, error) {
+	t := &TLSFiles{
+		CertFile:    certFile,
+		KeyFile:     keyFile,
+		CACertFile:  caCertFile,
+		AuthClients: authClients,
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Config is the tls.Config handed to the listener, every handshake picks the
+// current certificates through GetConfigForClient
+func (t *TLSFiles) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current(), nil
+		},
+	}
+}
+
+func (t *TLSFiles) current() *tls.Config {
+	t.lock.Lock()
+	if time.Since(t.lastCheck) < tlsCheckInterval {
+		config := t.config
+		t.lock.Unlock()
+		return config
+	}
+	t.lastCheck = time.Now()
+	changed := t.changed()
+	t.lock.Unlock()
+
+	if changed {
+		if err := t.Reload(); err != nil {
+			log.Error(fmt.Sprintf("TLS reload error, keep the old certificates: %v", err))
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.config
+}
+
+func (t *TLSFiles) files() []string {
+	files := []string{t.CertFile, t.KeyFile}
+	if t.CACertFile != "" {
+		files = append(files, t.CACertFile)
+	}
+	return files
+}
+
+func (t *TLSFiles) changed() bool {
+	for _, file := range t.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(t.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload reads the certificate files again, the old config stays in use when
+// the new files are invalid
+func (t *TLSFiles) Reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range t.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if t.CACertFile != "" {
+		pem, err := ioutil.ReadFile(t.CACertFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", t.CACertFile)
+		}
+		config.ClientCAs = pool
+	}
+	switch t.AuthClients {
+	case "yes":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		config.ClientAuth = tls.NoClientCert
+	}
+
+	t.lock.Lock()
+	reloaded := t.config != nil
+	t.config = config
+	t.modTimes = modTimes
+	t.lock.Unlock()
+	if reloaded {
+		log.Info(fmt.Sprintf("TLS certificates reloaded from %s", t.CertFile))
+	}
+	return nil
+}
+
+// handshakeTLS finishes the handshake of a TLS connection and authenticates
+// the client as the ACL user named by the CN of a verified client certificate
+func (s *Server) handshakeTLS(conn *tls.Conn, client *Client) error {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cn := state.PeerCertificates[0].Subject.CommonName
+	if user, ok := s.acl.User(cn); ok && user.Enabled {
+		client.SetUser(cn, true)
+		log.Debug(fmt.Sprintf("Server TLS client %s authenticated as '%s'", client.Addr, cn))
+	}
+	return nil
+}
+
+func wrapTLS(conn net.Conn, config *tls.Config) net.Conn {
+	if config == nil {
+		return conn
+	}
+	return tls.Server(conn, config)
+}
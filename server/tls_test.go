@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"Didgen/model"
+)
+
+// testCA signs the certificates of a test, generated at test time
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem  []byte
+}
+
+var serial int64
+
+func newCertificate(t *testing.T, template *x509.Certificate, parent *testCA) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func newTestCA(t *testing.T) *testCA {
+	cert, key, certPem, _ := newCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "didgen test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool, pem: certPem}
+}
+
+// serverCert writes the certificate of the server and its key to dir
+func (ca *testCA) serverCert(t *testing.T, dir string) *x509.Certificate {
+	cert, _, certPem, keyPem := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	writeFile(t, filepath.Join(dir, "didgen.crt"), certPem)
+	writeFile(t, filepath.Join(dir, "didgen.key"), keyPem)
+	return cert
+}
+
+func (ca *testCA) clientCert(t *testing.T, cn string) *tls.Certificate {
+	_, _, certPem, keyPem := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+// writeFile replaces a file with a modification time of its own, the
+// reload notices the change even within the resolution of the clock
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !modTime.IsZero() {
+		os.Chtimes(path, modTime, modTime)
+	}
+}
+
+// newTLSServer serves TLS with the certificates of ca, authClients is
+// tls_auth_clients
+func newTLSServer(t *testing.T, ca *testCA, authClients string) (*Server, string) {
+	dir := t.TempDir()
+	ca.serverCert(t, dir)
+	writeFile(t, filepath.Join(dir, "ca.crt"), ca.pem)
+	s := newTestServer(t, func(c *model.ServerConfig) {
+		c.TLSCertFile = filepath.Join(dir, "didgen.crt")
+		c.TLSKeyFile = filepath.Join(dir, "didgen.key")
+		c.TLSCACertFile = filepath.Join(dir, "ca.crt")
+		c.TLSAuthClients = authClients
+		c.Users = []map[string]string{
+			{"name": "default", "password": "secret", "commands": "+@all", "keys": "*"},
+			{"name": "app", "commands": "+@all", "keys": "*"},
+		}
+	})
+	return s, dir
+}
+
+// tlsConn is a client connection served by onConn over TLS on loopback, an
+// error when the handshake fails. Unlike a pipe the socket buffers the alert
+// of a refused handshake while the client writes
+func (s *Server) tlsConn(t *testing.T, roots *x509.CertPool, cert *tls.Certificate) (*testConn, *tls.ConnectionState, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.connWait.Add(1)
+	go s.onConn(wrapTLS(server, s.tlsConfig))
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	conn := tls.Client(client, config)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	// with TLS 1.3 the server checks the client certificate after the client
+	// finished, a refused one fails the first read
+	c := &testConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	if _, err := io.WriteString(conn, "*1\r\n$4\r\nPING\r\n"); err != nil {
+		return nil, nil, err
+	}
+	if _, err := readReply(c.reader); err != nil {
+		return nil, nil, err
+	}
+	state := conn.ConnectionState()
+	return c, &state, nil
+}
+
+func TestTLSHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	s, _ := newTLSServer(t, ca, "no")
+	c, state, err := s.tlsConn(t, ca.pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.PeerCertificates[0].Subject.CommonName != "localhost" {
+		t.Errorf("server certificate %s", state.PeerCertificates[0].Subject)
+	}
+	if got := c.do("AUTH", "secret"); got != "+OK\r\n" {
+		t.Errorf("AUTH over TLS = %q", got)
+	}
+	if got := c.do("ECHO", "over tls"); got != bulk("over tls") {
+		t.Errorf("ECHO over TLS = %q", got)
+	}
+	if fields := infoFields(c.do("INFO", "config")); fields["tls_enabled"] != "1" {
+		t.Errorf("tls_enabled = %q", fields["tls_enabled"])
+	}
+	// a server of another CA is not trusted
+	if _, _, err = s.tlsConn(t, newTestCA(t).pool, nil); err == nil {
+		t.Error("handshake with an unknown CA succeeded")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	s, dir := newTLSServer(t, ca, "no")
+	_, state, err := s.tlsConn(t, ca.pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := state.PeerCertificates[0].SerialNumber
+
+	renewed := ca.serverCert(t, dir)
+	time.Sleep(tlsCheckInterval + 100*time.Millisecond)
+	if _, state, err = s.tlsConn(t, ca.pool, nil); err != nil {
+		t.Fatal(err)
+	}
+	if serial := state.PeerCertificates[0].SerialNumber; serial.Cmp(renewed.SerialNumber) != 0 {
+		t.Errorf("certificate %v after the renewal, want %v, was %v", serial, renewed.SerialNumber, old)
+	}
+
+	// invalid files keep the certificate in use
+	writeFile(t, filepath.Join(dir, "didgen.key"), []byte("not a key"))
+	time.Sleep(tlsCheckInterval + 100*time.Millisecond)
+	if _, state, err = s.tlsConn(t, ca.pool, nil); err != nil {
+		t.Fatalf("handshake after an invalid key: %v", err)
+	}
+	if serial := state.PeerCertificates[0].SerialNumber; serial.Cmp(renewed.SerialNumber) != 0 {
+		t.Errorf("certificate %v after an invalid key, want %v", serial, renewed.SerialNumber)
+	}
+}
+
+func TestTLSAuthClients(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.clientCert(t, "app")
+	rogue := newTestCA(t).clientCert(t, "app")
+	cases := []struct {
+		authClients string
+		cert        *tls.Certificate
+		ok          bool
+	}{
+		{"yes", nil, false},
+		{"yes", cert, true},
+		{"yes", rogue, false},
+		{"optional", nil, true},
+		{"optional", cert, true},
+		{"optional", rogue, false},
+		{"no", cert, true},
+	}
+	for _, tc := range cases {
+		s, _ := newTLSServer(t, ca, tc.authClients)
+		_, _, err := s.tlsConn(t, ca.pool, tc.cert)
+		if (err == nil) != tc.ok {
+			t.Errorf("tls_auth_clients %s, client certificate %v: error %v", tc.authClients, tc.cert != nil, err)
+		}
+	}
+}
+
+// the CN of a verified client certificate is the ACL user of the client
+func TestTLSClientCertUser(t *testing.T) {
+	ca := newTestCA(t)
+	s, _ := newTLSServer(t, ca, "optional")
+	cases := []struct {
+		cert *tls.Certificate
+		want string
+	}{
+		{ca.clientCert(t, "app"), bulk("app")},
+		{ca.clientCert(t, "nobody"), "-NOAUTH "},
+		{nil, "-NOAUTH "},
+	}
+	for _, tc := range cases {
+		c, _, err := s.tlsConn(t, ca.pool, tc.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.do("ACL", "WHOAMI"); !strings.HasPrefix(got, tc.want) {
+			t.Errorf("ACL WHOAMI = %q, want %q", got, tc.want)
+		}
+	}
+	// without tls_auth_clients the certificate is not verified, nor used
+	s, _ = newTLSServer(t, ca, "no")
+	c, _, err := s.tlsConn(t, ca.pool, ca.clientCert(t, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do("ACL", "WHOAMI"); !strings.HasPrefix(got, "-NOAUTH ") {
+		t.Errorf("ACL WHOAMI with tls_auth_clients no = %q", got)
+	}
+}
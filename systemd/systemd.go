@@ -0,0 +1,112 @@
+// Package systemd implements socket activation and sd_notify without libsystemd
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, SD_LISTEN_FDS_START
+const listenFdsStart = 3
+
+// Listener is a socket passed by systemd, Name comes from FileDescriptorName=
+type Listener struct {
+	net.Listener
+	Name string
+}
+
+// Listeners returns the sockets of socket activation, none when the process
+// was not started by systemd with sockets. The environment is cleared so
+// child processes do not take the sockets for theirs
+func Listeners() ([]*Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]*Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - listenFdsStart; i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s is not a listening stream socket: %v", name, err)
+		}
+		listeners = append(listeners, &Listener{Listener: listener, Name: name})
+	}
+	return listeners, nil
+}
+
+// Notify sends a state such as READY=1 to systemd, it returns false without
+// an error when NOTIFY_SOCKET is not set
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// a leading @ is an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval is WatchdogSec= of the unit, 0 when the watchdog is off
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings systemd twice per watchdog interval for as long as alive
+// returns true, systemd restarts the service when the pings stop
+func Watchdog(alive func() bool) bool {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return false
+	}
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !alive() {
+				return
+			}
+			Notify("WATCHDOG=1")
+		}
+	}()
+	return true
+}
@@ -0,0 +1,214 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// notifySocket listens on a datagram socket in place of systemd and sets
+// NOTIFY_SOCKET to it
+func notifySocket(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if name[0] == '\x00' {
+		name = "@" + name[1:]
+	}
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Errorf("without NOTIFY_SOCKET: %v, %v", sent, err)
+	}
+
+	conn := notifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	for _, state := range []string{"READY=1\nMAINPID=42", "STOPPING=1"} {
+		if sent, err := Notify(state); !sent || err != nil {
+			t.Fatalf("Notify(%q): %v, %v", state, sent, err)
+		}
+		if got := receive(t, conn); got != state {
+			t.Errorf("received %q, want %q", got, state)
+		}
+	}
+
+	conn = notifySocket(t, fmt.Sprintf("\x00didgen-test-%d", os.Getpid()))
+	if sent, err := Notify("READY=1"); !sent || err != nil {
+		t.Fatalf("abstract socket: %v, %v", sent, err)
+	}
+	if got := receive(t, conn); got != "READY=1" {
+		t.Errorf("abstract socket received %q", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if _, err := Notify("READY=1"); err == nil {
+		t.Error("no error without a socket listening")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	cases := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"abc", "", 0},
+		{"-1", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", pid, 30 * time.Second},
+		{"30000000", "1", 0},
+	}
+	for _, tc := range cases {
+		t.Setenv("WATCHDOG_USEC", tc.usec)
+		t.Setenv("WATCHDOG_PID", tc.pid)
+		if got := WatchdogInterval(); got != tc.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: %v, want %v", tc.usec, tc.pid, got, tc.want)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn := notifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if Watchdog(func() bool { return true }) {
+		t.Fatal("watchdog started without WATCHDOG_USEC")
+	}
+
+	t.Setenv("WATCHDOG_USEC", "20000")
+	var alive int32 = 1
+	if !Watchdog(func() bool { return atomic.LoadInt32(&alive) == 1 }) {
+		t.Fatal("watchdog not started")
+	}
+	for i := 0; i < 3; i++ {
+		if got := receive(t, conn); got != "WATCHDOG=1" {
+			t.Fatalf("received %q", got)
+		}
+	}
+	// the pings stop once the process is not alive any more
+	atomic.StoreInt32(&alive, 0)
+	time.Sleep(50 * time.Millisecond)
+	buf := make([]byte, 1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("received %q after alive returned false", buf[:n])
+	}
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "1")
+	if listeners, err := Listeners(); listeners != nil || err != nil {
+		t.Errorf("without LISTEN_PID: %v, %v", listeners, err)
+	}
+	// the sockets of another process, such as the parent
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if listeners, err := Listeners(); listeners != nil || err != nil {
+		t.Errorf("LISTEN_PID of another process: %v, %v", listeners, err)
+	}
+	for _, fds := range []string{"", "0", "x"} {
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		t.Setenv("LISTEN_FDS", fds)
+		if _, err := Listeners(); err == nil {
+			t.Errorf("LISTEN_FDS=%q: no error", fds)
+		}
+		if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+			t.Error("the environment of socket activation was not cleared")
+		}
+	}
+}
+
+// TestListeners starts the test binary again with sockets from fd 3, as
+// systemd does, LISTEN_PID is only known to the child so it sets it itself
+func TestListeners(t *testing.T) {
+	if os.Getenv("DIDGEN_TEST_LISTENERS") == "1" {
+		listenersChild()
+		return
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "didgen.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+	files := make([]*os.File, 0, 2)
+	for _, l := range []net.Listener{tcp, unix} {
+		f, err := l.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestListeners$")
+	cmd.Env = append(os.Environ(), "DIDGEN_TEST_LISTENERS=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=client:")
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	want := []string{
+		"client tcp " + tcp.Addr().String(),
+		"LISTEN_FD_4 unix " + unix.Addr().String(),
+		"cleared",
+	}
+	for _, line := range want {
+		if !strings.Contains(string(out), line+"\n") {
+			t.Errorf("output %q lacks %q", out, line)
+		}
+	}
+}
+
+func listenersChild() {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listeners, err := Listeners()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, l := range listeners {
+		fmt.Printf("%s %s %s\n", l.Name, l.Addr().Network(), l.Addr())
+		l.Close()
+	}
+	if os.Getenv("LISTEN_PID") == "" && os.Getenv("LISTEN_FDS") == "" && os.Getenv("LISTEN_FDNAMES") == "" {
+		fmt.Println("cleared")
+	}
+	os.Exit(0)
+}